@@ -2,77 +2,123 @@
 package main
 
 import (
-	"encoding/json"
-	"fmt"
+	"context"
 	"ghost/agent/client"
+	"ghost/agent/comms"
 	"io/ioutil"
-	"math/rand"
-	"os"
 	"runtime/debug"
 	"strings"
-	"time"
 )
 
 // CheckinManager checks for updates from the client
-func CheckinManager(client *client.Client) {
+// Returns when the context is cancelled
+func CheckinManager(ctx context.Context, client *client.Client) {
+	// back off while the controller is unreachable -- the poll time is stretched, never shortened
+	backoff := comms.NewBackoff(client.Sender.GetRetryPolicy())
 
 	for {
 		// house keeping first
 		// clean up and set polltime jitter
 		debug.FreeOSMemory()
-		rand.Seed(time.Now().UnixNano())
-		client.PollTime = (time.Second * time.Duration(client.Config.PollTime)) + (time.Millisecond * time.Duration(rand.Intn(1000)))
-
-		// send basic get request
-		resp, err := client.Sender.Get(fmt.Sprintf("/core/hello/%s/", client.UUID))
-		if err != nil {
-			client.Log.Error("Error sending check-in message (1): %s", err)
-			// attempt different controller & proxy combinations
-			client.Sender.UpdateConnection(client.Config.ProxyList, client.Config.ControllerList)
-			time.Sleep(client.PollTime)
-			continue
+		client.SetPollTime()
+
+		// follow retry settings changed by a configuration reload
+		backoff.Policy = client.Sender.GetRetryPolicy()
+
+		sleep := client.GetPollTime()
+		if err := checkin(ctx, client); err != nil {
+			sleep += backoff.Next(err)
+			client.Log.Debug("Retrying check-in in %v", sleep)
+		} else {
+			backoff.Reset()
 		}
 
-		// log return message (debug only)
-		client.Log.Debug("Check-in reply from server %v: %v", client.Version, resp)
+		//sleep
+		if !client.Sleep(ctx, sleep) {
+			client.Log.Debug("Check-in manager stopped")
+			return
+		}
+	}
+}
 
-		// parse response
-		var respMap map[string]string
-		err = json.Unmarshal([]byte(resp), &respMap)
-		if err != nil {
-			client.Log.Error("Unable to parse JSON from controller: %s", err)
-			time.Sleep(client.PollTime)
-			continue
+// checkin sends a single check-in message and processes the reply
+// Returns an error if the check-in message could not be delivered
+func checkin(ctx context.Context, client *client.Client) error {
+	// send check-in message
+	reply, err := client.Checkin()
+	if err != nil {
+		client.Log.Error("Error sending check-in message (1): %s", err)
+		// attempt different controller & proxy combinations
+		if comms.IsConnectivityError(err) {
+			config := client.GetConfig()
+			client.Sender.UpdateConnection(config.ProxyList, config.ControllerList)
 		}
+		return err
+	}
+
+	// agent is bootstrapped, checked in and writing heartbeats -- confirm any pending update
+	if !client.Debug {
+		client.MarkHealthy()
+	}
+
+	// request or renew the client certificate presented for mutual TLS
+	if err := client.RenewClientCertificate(); err != nil {
+		client.Log.Error("%s", err)
+	}
+
+	// run tasks queued by the controller
+	client.RunTasks(reply.Tasks)
+
+	// Check for new configuration file
+	if reqConfig := reply.RequiredConfig; reqConfig != "" {
+		if configHash := client.GetConfigHash(); !strings.EqualFold(configHash, reqConfig) {
+			// don't re-apply a configuration that was rolled back
+			if client.ConfigUpdateFailed(reqConfig) {
+				return nil
+			}
+
+			client.Log.Info("New client configuration required. Have: %s -> Need: %s", configHash, reqConfig)
+
+			// Get new configuration file
+			configBytes, err := client.DownloadConfig(reqConfig)
+			if err != nil {
+				client.Log.Error("%s", err)
+				return nil
+			}
 
-		// Check for new configuration file
-		if reqConfig, ok := respMap["required_config"]; ok {
-			if !strings.EqualFold(client.ConfigHash, reqConfig) {
-				client.Log.Info("New client configuration required. Have: %s -> Need: %s", client.ConfigHash, reqConfig)
-
-				// Get new configuration file
-				configBytes, err := client.Sender.GetResource(reqConfig)
-				if err != nil {
-					client.Log.Error("Unable to get new configuration file: %s", err)
-					time.Sleep(client.PollTime)
-					continue
-				}
-
-				// Overwrite configuration file on disk
-				if err := ioutil.WriteFile(client.ConfigPath, configBytes, 0644); err != nil {
-					client.Log.Error("Unable to write new configuration file to disk: %s", err)
-					time.Sleep(client.PollTime)
-					continue
-				}
-
-				// Exit client
-				// Nanny is responsible for restarting client
-				client.Log.Info("Client configuration has been updated. Going for shut down...")
-				os.Exit(0)
+			// Back up the current configuration so the nanny can roll back if the new one fails
+			if err := client.BeginConfigUpdate(reqConfig); err != nil {
+				client.Log.Error("Unable to record configuration update: %s", err)
+				return nil
+			}
+
+			// Overwrite configuration file on disk
+			if err := ioutil.WriteFile(client.ConfigPath, configBytes, 0644); err != nil {
+				client.Log.Error("Unable to write new configuration file to disk: %s", err)
+				return nil
+			}
+
+			// Apply new configuration in place
+			if err := client.ReloadConfig(); err != nil {
+				client.Log.Error("Unable to apply new configuration: %s", err)
+				return nil
 			}
 		}
+	}
 
-		//sleep
-		time.Sleep(client.PollTime)
+	// Check for binary updates (e.g. required by a new configuration)
+	if !client.Debug && !strings.EqualFold(client.GetConfig().BinaryHash, client.BinaryHash) && !client.BinaryUpdateFailed() {
+		client.Log.Info("Client binary hash on disk does not match configuration. Downloading update...")
+		if err := client.DownloadBinary(ctx); err != nil {
+			client.Log.Error("%s", err)
+			return nil
+		}
+
+		// Shut down client
+		// Nanny is responsible for restarting client with the new binary
+		client.Log.Info("New client binary written to disk. Going for shut down...")
+		client.Shutdown()
 	}
+
+	return nil
 }
@@ -0,0 +1,142 @@
+// Package client content addressed blob store for resource files
+package client
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// DefaultBlobRetention is how long an unreferenced blob is kept (e.g. for plugin rollbacks) when none is configured
+const DefaultBlobRetention = time.Hour * 24 * 30
+
+// BlobDir returns the directory of the blob store
+func (client *Client) BlobDir() string {
+	return filepath.Join(client.InstallDir, "blobs")
+}
+
+// BlobPath returns the path a blob is stored at: blobs/<first two hex characters>/<sha256>
+func (client *Client) BlobPath(hash string) string {
+	hash = strings.ToLower(hash)
+	if len(hash) < 2 {
+		return filepath.Join(client.BlobDir(), hash)
+	}
+	return filepath.Join(client.BlobDir(), hash[:2], hash)
+}
+
+// EnsureBlob makes sure a verified copy of a resource is in the blob store, downloading it if needed
+// Returns the path of the blob
+func (client *Client) EnsureBlob(ctx context.Context, hash string) (string, error) {
+	blobPath := client.BlobPath(hash)
+
+	// use the stored copy if it is intact
+	if storedHash, err := FileSHA256(blobPath); err == nil {
+		if strings.EqualFold(storedHash, hash) {
+			return blobPath, client.LocalDb.BlobTouch(hash)
+		}
+		client.Log.Error("Blob %s is corrupt. Downloading again...", hash)
+		os.Remove(blobPath)
+	}
+
+	if client.Offline {
+		return "", errors.New("resource " + hash + " is not in the blob store")
+	}
+
+	// only download resource files listed in the signed update manifest
+	if err := client.VerifyArtifact(ArtifactResource, hash); err != nil {
+		return "", err
+	}
+
+	if err := os.MkdirAll(filepath.Dir(blobPath), 0755); err != nil {
+		return "", err
+	}
+	if err := client.DownloadResource(ctx, hash, blobPath, 0755); err != nil {
+		return "", err
+	}
+
+	return blobPath, client.LocalDb.BlobTouch(hash)
+}
+
+// AddBlob adds a file already on disk to the blob store (if not already stored) so it can be restored without a download
+func (client *Client) AddBlob(path, hash string) error {
+	blobPath := client.BlobPath(hash)
+	if _, err := os.Stat(blobPath); err == nil {
+		return client.LocalDb.BlobTouch(hash)
+	}
+
+	if err := os.MkdirAll(filepath.Dir(blobPath), 0755); err != nil {
+		return err
+	}
+	if err := CopyFile(path, blobPath); err != nil {
+		return err
+	}
+
+	return client.LocalDb.BlobTouch(hash)
+}
+
+// CopyBlob places a copy of a blob at path
+// Plugins get their own copy so a plugin changing its resource file cannot corrupt the blob or other plugins' files
+func (client *Client) CopyBlob(hash, path string) error {
+	return CopyFile(client.BlobPath(hash), path)
+}
+
+// CollectBlobs releases blob references of plugins no longer in the configuration
+// and deletes blobs that have been unreferenced for longer than the configured BlobRetention
+func (client *Client) CollectBlobs() error {
+	config := client.GetConfig()
+
+	// release references of removed plugins
+	configured := make(map[string]bool)
+	for _, plugin := range config.Plugins {
+		configured[plugin.UUID] = true
+	}
+	owners, err := client.LocalDb.BlobRefOwners()
+	if err != nil {
+		return err
+	}
+	for _, owner := range owners {
+		if !configured[owner] {
+			if err := client.LocalDb.BlobRefReplace(owner, nil); err != nil {
+				return err
+			}
+		}
+	}
+
+	retention := DefaultBlobRetention
+	if config.BlobRetention > 0 {
+		retention = time.Hour * 24 * time.Duration(config.BlobRetention)
+	}
+
+	unused, err := client.LocalDb.BlobSelectUnused(time.Now().Add(-retention))
+	if err != nil {
+		return err
+	}
+	for _, hash := range unused {
+		if err := os.Remove(client.BlobPath(hash)); err != nil && !os.IsNotExist(err) {
+			client.Log.Error("Unable to remove blob %s: %v", hash, err)
+			continue
+		}
+		client.LocalDb.BlobDelete(hash)
+		client.Log.Info("Removed unused blob %s", hash)
+	}
+
+	// remove stale partial downloads
+	prefixes, _ := ioutil.ReadDir(client.BlobDir())
+	for _, prefix := range prefixes {
+		if !prefix.IsDir() {
+			continue
+		}
+		files, _ := ioutil.ReadDir(filepath.Join(client.BlobDir(), prefix.Name()))
+		for _, file := range files {
+			if strings.HasSuffix(file.Name(), ".part") && time.Since(file.ModTime()) > retention {
+				os.Remove(filepath.Join(client.BlobDir(), prefix.Name(), file.Name()))
+			}
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,147 @@
+// Package client mutual TLS client certificates
+package client
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"ghost/agent/comms"
+	"time"
+)
+
+// time to wait before asking the controller for a client certificate again
+const clientCertificateRetry = time.Hour
+
+// CreateCSR returns a pem certificate signing request for the agent's key pair
+// The controller issues the client certificate presented for mutual TLS from this request
+func (client *Client) CreateCSR() (string, error) {
+	client.keyMutex.Lock()
+	defer client.keyMutex.Unlock()
+
+	// identify by UUID once registered
+	fqdn := client.hostFQDN()
+	commonName := client.UUID
+	if commonName == "" {
+		commonName = fqdn
+	}
+
+	return createCSR(client.PrivateKey, commonName, []string{fqdn})
+}
+
+// createCSR returns a pem certificate signing request for a pem private key
+func createCSR(privateKey, commonName string, dnsNames []string) (string, error) {
+	key, err := comms.ParsePrivateKey(privateKey)
+	if err != nil {
+		return "", errors.New("unable to parse private key: " + err.Error())
+	}
+
+	template := x509.CertificateRequest{
+		Subject:  pkix.Name{CommonName: commonName},
+		DNSNames: dnsNames,
+	}
+	der, err := x509.CreateCertificateRequest(rand.Reader, &template, key)
+	if err != nil {
+		return "", err
+	}
+
+	return string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE REQUEST", Bytes: der})), nil
+}
+
+// SetClientCertificate checks a certificate issued by the controller matches the agent's key pair,
+// stores it in the key store and presents it on all further connections
+func (client *Client) SetClientCertificate(certPEM string) error {
+	cert, err := parseClientCertificate(certPEM)
+	if err != nil {
+		return err
+	}
+
+	client.keyMutex.Lock()
+	defer client.keyMutex.Unlock()
+
+	// the certificate must be for our key (the key pair may have been rotated since the request)
+	block, _ := pem.Decode([]byte(client.PublicKey))
+	if block == nil || !bytes.Equal(block.Bytes, cert.RawSubjectPublicKeyInfo) {
+		return errors.New("client certificate does not match the agent's public key")
+	}
+
+	client.ClientCertificate = certPEM
+	client.CertName = cert.Subject.CommonName
+	if err := client.LocalDb.KeyStoreInsert("ClientCertificate", client.ClientCertificate); err != nil {
+		return err
+	}
+	if err := client.LocalDb.KeyStoreInsert("CertName", client.CertName); err != nil {
+		return err
+	}
+
+	if err := client.Sender.SetClientCertificate(certPEM); err != nil {
+		return err
+	}
+
+	client.Log.Info("Using client certificate %s valid until %v", client.CertName, cert.NotAfter.Format(time.RFC3339))
+	return nil
+}
+
+// ClientCertificateNeedsRenewal reports whether the agent has no usable client certificate
+// or its certificate is in the last third of its validity period
+func (client *Client) ClientCertificateNeedsRenewal() bool {
+	client.keyMutex.Lock()
+	certPEM := client.ClientCertificate
+	client.keyMutex.Unlock()
+
+	cert, err := parseClientCertificate(certPEM)
+	if err != nil {
+		return true
+	}
+
+	lifetime := cert.NotAfter.Sub(cert.NotBefore)
+	renewAt := cert.NotAfter.Add(-lifetime / 3)
+	return time.Now().After(renewAt)
+}
+
+// RenewClientCertificate requests a new client certificate from the controller if the current one is missing or expiring
+// Requests are retried at most every clientCertificateRetry
+func (client *Client) RenewClientCertificate() error {
+	if !client.ClientCertificateNeedsRenewal() || time.Since(client.certRequested) < clientCertificateRetry {
+		return nil
+	}
+	client.certRequested = time.Now()
+
+	client.Log.Info("Requesting new client certificate...")
+
+	csr, err := client.CreateCSR()
+	if err != nil {
+		return errors.New("unable to create client certificate request: " + err.Error())
+	}
+	jsonStr, err := json.Marshal(map[string]string{"csr": csr})
+	if err != nil {
+		return err
+	}
+
+	resp, err := client.Sender.Send(jsonStr, "/core/certificate/")
+	if err != nil {
+		return errors.New("unable to request client certificate: " + err.Error())
+	}
+
+	respMap := make(map[string]string)
+	if err := json.Unmarshal([]byte(resp), &respMap); err != nil {
+		return errors.New("unable to parse client certificate response: " + err.Error())
+	}
+	if respMap["client_certificate"] == "" {
+		return errors.New("no client certificate found in response")
+	}
+
+	return client.SetClientCertificate(respMap["client_certificate"])
+}
+
+// parseClientCertificate parses a pem encoded client certificate
+func parseClientCertificate(certPEM string) (*x509.Certificate, error) {
+	block, _ := pem.Decode([]byte(certPEM))
+	if block == nil {
+		return nil, errors.New("failed to decode PEM block of client certificate")
+	}
+	return x509.ParseCertificate(block.Bytes)
+}
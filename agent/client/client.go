@@ -3,6 +3,11 @@
 package client
 
 import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
 	"crypto/rand"
 	"crypto/rsa"
 	"crypto/sha256"
@@ -27,55 +32,96 @@ import (
 	"time"
 
 	"github.com/matishsiao/goInfo"
+	"github.com/shirou/gopsutil/process"
 )
 
 // Client struct stores information about the local system
 type Client struct {
-	UUID         string
-	InstallDir   string
-	InstallName  string
-	Initialized  bool
-	Hostname     string
-	ConfigPath   string
-	ConfigHash   string
-	BinaryHash   string
-	Debug        bool
-	Offline      bool
-	Domain       string
-	FQDN         string
-	Architecture string
-	OSVersion    string
-	PublicKey    string
-	PrivateKey   string
-	CertName     string
-	LocalDbName  string
-	Version      string
-	Interfaces   []map[string]string
-	LocalPort    uint64
-	PollTime     time.Duration
-	Config       Config
-	Log          logger.Logger
-	Sender       comms.Sender
-	LocalDb      Database
-	PluginLock   sync.Mutex
+	UUID              string
+	InstallDir        string
+	InstallName       string
+	Initialized       bool
+	Hostname          string
+	ConfigPath        string
+	ConfigHash        string
+	BinaryHash        string
+	Debug             bool
+	Offline           bool
+	Domain            string
+	FQDN              string
+	Architecture      string
+	OSVersion         string
+	PublicKey         string
+	PrivateKey        string
+	PreviousKey       string // private key replaced by the last key rotation until the controller has accepted the new key
+	CertName          string // subject of the client certificate
+	ClientCertificate string // pem client certificate issued by the controller for mutual TLS
+	LocalDbName       string
+	Version           string
+	Interfaces        []map[string]string
+	LocalPort         uint64
+	PollTime          time.Duration
+	Config            Config
+	Log               logger.Logger
+	Sender            comms.Sender
+	LocalDb           Database
+	PluginLock        sync.Mutex
+	Shutdown          context.CancelFunc // requests a graceful shutdown of the agent
+	PluginTasks       chan Task          // controller tasks for the plugin manager (run / kill plugin)
+	Started           time.Time          // when the agent started
+	CloneDetected     bool               // the key store was created on another host and kept (ClonePolicy report)
+	configMutex       sync.RWMutex       // guards Config, ConfigHash and PollTime once managers are running
+	keyMutex          sync.Mutex         // guards the key pair, PreviousKey and the client certificate once managers are running
+	healthy           map[string]string  // last known good hashes recorded by MarkHealthy
+	certRequested     time.Time          // last client certificate request
+	self              *process.Process   // agent process, for health reports
+	inventoryMutex    sync.Mutex         // serializes inventory refreshes
+	hostMutex         sync.RWMutex       // guards the host information collected by CollectHostInfo
 }
 
 // Config struct to hold configuration data
 type Config struct {
-	BinaryHash        string   `yaml:"BinaryHash"`
-	Tags              string   `yaml:"Tags"`
-	LogLevel          string   `yaml:"LogLevel"`
-	ControllerList    []string `yaml:"ControllerList"`
-	ProxyList         []string `yaml:"ProxyList"`
-	ProxyBlackList    []string `yaml:"ProxyBlackList"`
-	UseSystemProxies  bool     `yaml:"UseSystemProxies"`
-	PollTime          int      `yaml:"PollTime"`
-	ServerCertificate string   `yaml:"ServerCertificate"`
-	Plugins           []Plugin `yaml:"Plugins"`
+	BinaryHash          string   `yaml:"BinaryHash"`
+	Tags                string   `yaml:"Tags"`
+	LogLevel            string   `yaml:"LogLevel"`
+	ControllerList      []string `yaml:"ControllerList"`
+	ProxyList           []string `yaml:"ProxyList"`
+	ProxyBlackList      []string `yaml:"ProxyBlackList"`
+	UseSystemProxies    bool     `yaml:"UseSystemProxies"`
+	PollTime            int      `yaml:"PollTime"`
+	ServerCertificate   string   `yaml:"ServerCertificate"`
+	TLSCABundle         string   `yaml:"TLSCABundle"`   // pem CA bundle used to verify controllers (system roots if empty); relative to the install directory
+	TLSPinMode          string   `yaml:"TLSPinMode"`    // "certificate" or "spki" to pin the controller to ServerCertificate
+	TLSPinnedKeys       []string `yaml:"TLSPinnedKeys"` // additional base64 sha256 SPKI pins, e.g. for key rollover
+	Plugins             []Plugin `yaml:"Plugins"`
+	UpdateHealthWindow  int      `yaml:"UpdateHealthWindow"`  // seconds a new configuration has to prove itself healthy before it is rolled back
+	BlobRetention       int      `yaml:"BlobRetention"`       // days unused resource files are kept in the blob store
+	InventoryInterval   int      `yaml:"InventoryInterval"`   // seconds between host inventory refreshes
+	RetryBaseInterval   int      `yaml:"RetryBaseInterval"`   // seconds; delay ceiling after the first failed request to the controller
+	RetryMaxInterval    int      `yaml:"RetryMaxInterval"`    // seconds; upper limit of the retry delay
+	BreakerThreshold    int      `yaml:"BreakerThreshold"`    // consecutive failures before a controller / proxy is skipped
+	BreakerCooldown     int      `yaml:"BreakerCooldown"`     // seconds a failing controller / proxy is skipped for
+	EnrollmentToken     string   `yaml:"EnrollmentToken"`     // token proving the host may register; overridden by GHOST_ENROLLMENT_TOKEN or the token file
+	EnrollmentTokenFile string   `yaml:"EnrollmentTokenFile"` // file holding the enrollment token (default enrollment.token in the install directory); wiped after registration
+	UpdateSigningKey    string   `yaml:"UpdateSigningKey"`    // pem public key or certificate update manifests are signed with; defaults to ServerCertificate
+	KeyType             string   `yaml:"KeyType"`             // type of rotated key pairs: "rsa" (default), "ecdsa-p256" or "ed25519"; agents register with RSA and change type at their next rotation
+	SignatureAlgorithm  string   `yaml:"SignatureAlgorithm"`  // "RS256" (default) or "PS256" for RSA keys; PS256 is only used once the controller accepts it
+	KeyStoreKeySource   string   `yaml:"KeyStoreKeySource"`   // where the key encrypting the private key at rest comes from: "file" (default), "env" or "keyring"
+	KeyStoreKeyFile     string   `yaml:"KeyStoreKeyFile"`     // key file of the file source (default keystore.key in the install directory); created on first use
+	ClonePolicy         string   `yaml:"ClonePolicy"`         // when the key store was created on another host: "report" (default) to the controller or "reinitialize" as a new agent
+	DeadLetterSize      int      `yaml:"DeadLetterSize"`      // rejected messages kept in the dead_letter table (default 1000); the oldest are dropped and counted in health reports
+
+	// maximum queued messages posted per request, by controller uri (e.g. /core/pluginlog/: 200)
+	QueueBatchLimits map[string]int `yaml:"QueueBatchLimits"`
 }
 
 // Bootstrap builds client object and initializes if needed
 func (client *Client) Bootstrap() {
+	// record start for health reports (the first CPU reading only sets a baseline)
+	client.Started = time.Now()
+	client.self = &process.Process{Pid: int32(os.Getpid())}
+	client.self.Percent(0)
+
 	// take hash of binary and configuration file
 	var err error
 	client.BinaryHash, err = client.GetSHA256(os.Args[0])
@@ -89,17 +135,25 @@ func (client *Client) Bootstrap() {
 	}
 
 	// create local database
-	client.LocalDbName = filepath.Join(client.InstallDir, "ghost.db") //TODO: Make generic
-	client.LocalDb = Database{Name: client.LocalDbName}
-	client.LocalDb.Init()
+	if err := client.OpenLocalDb(); err != nil {
+		client.Log.Fatal("Could not open local database: %v", err)
+	}
+
+	// controller tasks are handed to the plugin manager through a buffered channel
+	client.PluginTasks = make(chan Task, 16)
 
 	// update log level
-	client.Log.Level = client.Config.LogLevel
+	client.Log.SetLevel(client.Config.LogLevel)
 	client.Log.Info("Agent starting...")
 
 	// set polltime
 	mathrand.Seed(time.Now().UnixNano())
-	client.PollTime = (time.Second * time.Duration(client.Config.PollTime)) + (time.Millisecond * time.Duration(mathrand.Intn(1000)))
+	client.SetPollTime()
+
+	// unlock (and on upgrade encrypt) the sensitive key store entries
+	if err := client.EncryptKeyStore(); err != nil {
+		client.Log.Fatal("Unable to unlock key store: %v", err)
+	}
 
 	// check if client previously initialized
 	isInitialized, err := client.LocalDb.KeyStoreSelect("IsInitialized")
@@ -113,6 +167,11 @@ func (client *Client) Bootstrap() {
 		client.Initialized = false
 	}
 
+	// a key store copied from another host (e.g. a golden image) must not share its identity
+	if client.Initialized && client.CheckClone() {
+		client.Initialized = false
+	}
+
 	// Initialize client if needed
 	if !client.Initialized {
 		client.Log.Info("Client has not been initialized, initializing now...")
@@ -131,44 +190,18 @@ func (client *Client) Bootstrap() {
 	}
 
 	// find proxies from system if needed
-	var foundProxies []string
-	if client.Config.UseSystemProxies {
-		foundProxies, err = comms.FindProxies()
-		if err != nil {
-			client.Log.Error("Error finding system proxies: %v", err)
-		}
-	}
-
-	// deduplicate and remove black listed proxies
-	for _, proxy := range foundProxies {
-		addProxy := true
-		for _, stopWord := range append(client.Config.ProxyList, client.Config.ProxyBlackList...) {
-			if strings.Contains(strings.ToLower(proxy), strings.ToLower(stopWord)) {
-				addProxy = false
-			}
-		}
-		if addProxy {
-			client.Config.ProxyList = append(client.Config.ProxyList, proxy)
-		}
-	}
-
-	// initalize url and proxy to first in list
-	var proxy string
-	if client.Config.ProxyList != nil {
-		proxy = client.Config.ProxyList[0]
-	}
-	controllerURL := client.Config.ControllerList[0]
+	client.addSystemProxies(&client.Config)
 
 	//create and initialize comm sender
-	client.Sender = comms.Sender{
-		ControllerURL:     controllerURL,
-		Proxy:             proxy,
-		ClientUUID:        client.UUID,
-		ClientPrivateKey:  client.PrivateKey,
-		ClientPublicKey:   client.PublicKey,
-		Log:               &client.Log,
-		ServerCertificate: client.Config.ServerCertificate,
-	}
+	// url and proxy are initialized to first in list
+	client.Sender = client.senderSettings(client.Config)
+	client.Sender.ClientUUID = client.UUID
+	client.Sender.ClientPrivateKey = client.PrivateKey
+	client.Sender.ClientPublicKey = client.PublicKey
+	client.Sender.PreviousKey = client.PreviousKey
+	client.Sender.KeyConfirmed = client.keyConfirmed
+	client.Sender.ClientCertificate = client.ClientCertificate
+	client.Sender.Log = &client.Log
 
 	err = client.Sender.Init()
 	if err != nil {
@@ -178,25 +211,33 @@ func (client *Client) Bootstrap() {
 	// check if client is registered
 	if client.UUID == "" {
 
-		// loop until registration is successful
+		// loop until registration is successful, backing off while the controller is unavailable
+		backoff := comms.NewBackoff(client.Sender.RetryPolicy)
 		for client.UUID == "" {
 			client.Log.Info("Client not registered with controller. Beginning registration process...")
 
-			messageMap := make(map[string]string)
+			// host information, as sent in inventory updates
+			messageMap := client.Inventory()
 			hash, err := client.GetSHA256(os.Args[0])
 			if err != nil {
 				client.Log.Fatal("Could not get hash of current binary: %v", err)
 			}
 			messageMap["hash"] = hash
-			messageMap["hostname"] = client.Hostname
-			messageMap["os_version"] = client.OSVersion
-			messageMap["domain"] = client.Domain
-			messageMap["fqdn"] = client.FQDN
-			messageMap["architecture"] = client.Architecture
-			interfaces, _ := json.Marshal(client.Interfaces)
-			messageMap["interfaces"] = string(interfaces)
 			messageMap["public_key"] = client.PublicKey
 			messageMap["tags"] = client.Config.Tags
+			if csr, err := client.CreateCSR(); err != nil {
+				client.Log.Error("Unable to create client certificate request: %v", err)
+			} else {
+				messageMap["csr"] = csr
+			}
+
+			// prove the host may join (read on every attempt so a rejected token can be replaced)
+			token, tokenPath, err := client.EnrollmentToken()
+			if err != nil {
+				client.Log.Error("%v", err)
+			} else if token != "" {
+				messageMap["enrollment_token"] = token
+			}
 
 			jsonStr, err := json.Marshal(&messageMap)
 			if err != nil {
@@ -204,11 +245,20 @@ func (client *Client) Bootstrap() {
 			}
 
 			resp, err := client.Sender.Send(jsonStr, "/core/register/")
-			if err != nil {
+			if IsEnrollmentRejected(err) {
+				if token == "" {
+					client.Log.Error("Registration refused: controller requires an enrollment token (%s, %s or EnrollmentToken)", EnrollmentTokenEnv, client.enrollmentTokenPath())
+				} else {
+					client.Log.Error("Registration refused: enrollment token rejected by controller: %s", err)
+				}
+				time.Sleep(backoff.Next(err))
+			} else if err != nil {
 				client.Log.Error("Error sending registration message: %s", err)
 				//attempt different controller & proxy combinations
-				client.Sender.UpdateConnection(client.Config.ProxyList, client.Config.ControllerList)
-				time.Sleep(time.Second * 2)
+				if comms.IsConnectivityError(err) {
+					client.Sender.UpdateConnection(client.Config.ProxyList, client.Config.ControllerList)
+				}
+				time.Sleep(backoff.Next(err))
 			} else {
 				// parse json response and save uuid
 				respMap := make(map[string]string)
@@ -216,11 +266,25 @@ func (client *Client) Bootstrap() {
 				client.UUID = respMap["uuid"]
 				if client.UUID == "" {
 					client.Log.Error("No UUID found in registration response")
-					time.Sleep(time.Second * 2)
+					time.Sleep(backoff.Next(nil))
 				} else {
 					client.Log.Info("Successfully registered with controller. UUID is %s", client.UUID)
 					client.Sender.ClientUUID = client.UUID // update UUID of sender object
 					client.KeyStoreWriteOut()
+
+					// enrollment tokens are not kept on disk once used
+					if tokenPath != "" {
+						if err := WipeFile(tokenPath); err != nil {
+							client.Log.Error("Unable to wipe enrollment token file %s: %v", tokenPath, err)
+						}
+					}
+
+					// start using the client certificate (if issued)
+					if certPEM := respMap["client_certificate"]; certPEM != "" {
+						if err := client.SetClientCertificate(certPEM); err != nil {
+							client.Log.Error("Unable to use issued client certificate: %v", err)
+						}
+					}
 				}
 			}
 		}
@@ -228,31 +292,29 @@ func (client *Client) Bootstrap() {
 }
 
 // VerifyBinary checks client binary hash against configuration
-// will attempt to download new binary
-func (client *Client) VerifyBinary() bool {
+// will attempt to download new binary until it succeeds or ctx is cancelled
+func (client *Client) VerifyBinary(ctx context.Context) bool {
 	// check binary hash
 	if strings.EqualFold(client.Config.BinaryHash, client.BinaryHash) {
 		return true
+	} else if client.BinaryUpdateFailed() {
+		// keep running the binary the nanny rolled back to
+		return true
 	} else if !client.Offline {
 		// loop forever as successful update will trigger exit
+		backoff := comms.NewBackoff(client.Sender.RetryPolicy)
 		for {
 			client.Log.Info("Client binary hash on disk does not match configuration. Downloading update...")
 
-			// get new binary from control server
-			clientBytes, err := client.Sender.GetResource(client.Config.BinaryHash)
-			if err != nil {
-				client.Log.Error("Unable to retrieve new client binary: %s", err)
+			if err := client.DownloadBinary(ctx); err != nil {
+				client.Log.Error("%s", err)
 				//attempt different controller & proxy combinations
-				client.Sender.UpdateConnection(client.Config.ProxyList, client.Config.ControllerList)
-				time.Sleep(time.Second * 10)
-				continue
-			}
-
-			// write new binary to disk
-			// add .new extension to avoid locked files -- Nanny will check for .new and replace before restarting
-			if err := ioutil.WriteFile(filepath.Join(client.InstallDir, client.InstallName)+".new", clientBytes, 0755); err != nil {
-				client.Log.Error("Unable to write new binary file to disk: %s", err)
-				time.Sleep(client.PollTime)
+				if comms.IsConnectivityError(err) {
+					client.Sender.UpdateConnection(client.Config.ProxyList, client.Config.ControllerList)
+				}
+				if !client.Sleep(ctx, time.Second*10+backoff.Next(err)) {
+					return false
+				}
 				continue
 			}
 
@@ -263,18 +325,172 @@ func (client *Client) VerifyBinary() bool {
 	return false
 }
 
+// DownloadBinary retrieves the client binary matching the configured BinaryHash and writes it next to the current binary
+// The agent must be restarted for the update to take effect
+// The download is abandoned if ctx is cancelled
+func (client *Client) DownloadBinary(ctx context.Context) error {
+	config := client.GetConfig()
+
+	// only download binaries listed in the signed update manifest
+	if err := client.VerifyArtifact(UpdateBinary, config.BinaryHash); err != nil {
+		return errors.New("Refusing client binary update: " + err.Error())
+	}
+
+	// get new binary from control server
+	// add .new extension to avoid locked files -- Nanny will check for .new and replace before restarting
+	if err := client.DownloadResource(ctx, config.BinaryHash, filepath.Join(client.InstallDir, client.InstallName)+".new", 0755); err != nil {
+		return fmt.Errorf("Unable to retrieve new client binary: %w", err)
+	}
+
+	return nil
+}
+
+// DownloadResource retrieves a resource file from the control server and writes it to path once its hash is verified
+// Files are streamed (and resumed if interrupted) when the controller supports it, otherwise retrieved with GetResource
+// Streamed downloads are abandoned if ctx is cancelled
+func (client *Client) DownloadResource(ctx context.Context, hash, path string, perm os.FileMode) error {
+	err := client.Sender.DownloadResource(ctx, hash, path, perm)
+	if !errors.Is(err, comms.ErrDownloadNotSupported) {
+		return err
+	}
+
+	// older controllers only send whole files
+	client.Log.Debug("Controller does not support streaming downloads. Retrieving %s in one piece...", hash)
+	content, err := client.Sender.GetResource(hash)
+	if err != nil {
+		return err
+	}
+	if err := VerifySHA256(content, hash); err != nil {
+		return err
+	}
+
+	// write through a temporary file so path is never left partially written
+	tmp := path + ".part"
+	if err := ioutil.WriteFile(tmp, content, perm); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// DownloadConfig retrieves the configuration file with the given hash
+// The configuration must be covered by the signed update manifest
+func (client *Client) DownloadConfig(hash string) ([]byte, error) {
+	// only download configurations listed in the signed update manifest
+	if err := client.VerifyArtifact(UpdateConfig, hash); err != nil {
+		return nil, errors.New("Refusing configuration update: " + err.Error())
+	}
+
+	configBytes, err := client.Sender.GetResource(hash)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to get new configuration file: %w", err)
+	}
+	if err := VerifySHA256(configBytes, hash); err != nil {
+		return nil, errors.New("Retrieved configuration file is not valid: " + err.Error())
+	}
+
+	return configBytes, nil
+}
+
 // Initialize sets initial values for client struct values
 func (client *Client) Initialize() error {
 	var err error
 
 	client.UUID = "" // set UUID to blank to avoid mismatched keys
 
+	// gather host information
+	client.CollectHostInfo()
+
+	//create public and private keys
+	// agents register with an RSA key as what the controller verifies is not known yet -- the configured
+	// KeyType is adopted at the first key rotation once the controller accepts its algorithm (see RotateKeys)
+	client.PublicKey, client.PrivateKey, err = GenerateKeyPair(KeyTypeRSA)
+	if err != nil {
+		client.Log.Fatal("Unable to create client's key pair: %v", err)
+	}
+
+	client.Initialized = true // set initialized to true
+
+	// the new identity belongs to this host
+	client.recordHostFingerprint(CollectHostFingerprint())
+
+	//store values to registry
+	err = client.KeyStoreWriteOut()
+
+	//log and return any errors
+	if err != nil {
+		client.Log.Error("Unable to initialize client: %v", err)
+		return err
+	}
+
+	return nil
+}
+
+// Key types of agent key pairs
+const (
+	KeyTypeRSA     = "rsa"        // 2048 bit RSA
+	KeyTypeECDSA   = "ecdsa-p256" // ECDSA on the P-256 curve
+	KeyTypeEd25519 = "ed25519"
+)
+
+// GenerateKeyPair creates a new key pair of the given type (RSA if empty)
+// Returns the pem encoded public (PKIX) and private keys
+func GenerateKeyPair(keyType string) (string, string, error) {
+	var publicKey crypto.PublicKey
+	var privateBlock *pem.Block
+
+	switch strings.ToLower(keyType) {
+	case KeyTypeRSA, "":
+		key, err := rsa.GenerateKey(rand.Reader, 2048)
+		if err != nil {
+			return "", "", errors.New("private key cannot be created: " + err.Error())
+		}
+		publicKey = &key.PublicKey
+		privateBlock = &pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(key)}
+	case KeyTypeECDSA, KeyTypeEd25519:
+		var key crypto.Signer
+		var err error
+		if strings.ToLower(keyType) == KeyTypeECDSA {
+			key, err = ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		} else {
+			_, key, err = ed25519.GenerateKey(rand.Reader)
+		}
+		if err != nil {
+			return "", "", errors.New("private key cannot be created: " + err.Error())
+		}
+		der, err := x509.MarshalPKCS8PrivateKey(key)
+		if err != nil {
+			return "", "", errors.New("unable to encode private key: " + err.Error())
+		}
+		publicKey = key.Public()
+		privateBlock = &pem.Block{Type: "PRIVATE KEY", Bytes: der}
+	default:
+		return "", "", errors.New("unknown key type " + keyType)
+	}
+
+	//store keys as pem files
+	der, err := x509.MarshalPKIXPublicKey(publicKey)
+	if err != nil {
+		return "", "", errors.New("unable to create public key: " + err.Error())
+	}
+
+	publicPEM := string(pem.EncodeToMemory(&pem.Block{
+		Type:  "PUBLIC KEY",
+		Bytes: der,
+	}))
+
+	return publicPEM, string(pem.EncodeToMemory(privateBlock)), nil
+}
+
+// CollectHostInfo gathers hostname, network interfaces, FQDN, domain, architecture and OS version
+// Values are stored in the client struct; call KeyStoreWriteOut to persist them
+func (client *Client) CollectHostInfo() {
 	//use goInfo to system information
 	sysinfo := goInfo.GetInfo()
-	client.Hostname = sysinfo.Hostname
+	hostname := sysinfo.Hostname
 
 	//find interface information
-	ifaces, err := net.Interfaces()
+	var interfaces []map[string]string
+	ifaces, _ := net.Interfaces()
 	for _, i := range ifaces {
 		//skip invalid mac address
 		if i.HardwareAddr.String() == "" {
@@ -295,30 +511,45 @@ func (client *Client) Initialize() error {
 				ip = v.IP
 			}
 
-			client.Interfaces = append(client.Interfaces, map[string]string{"name": i.Name, "ip": ip.String(), "mac": i.HardwareAddr.String()})
+			// label the address family
+			family := "ipv6"
+			if ip.To4() != nil {
+				family = "ipv4"
+			}
+
+			interfaces = append(interfaces, map[string]string{"name": i.Name, "ip": ip.String(), "family": family, "mac": i.HardwareAddr.String()})
 		}
 	}
 
-	for _, item := range client.Interfaces {
+	fqdn := ""
+	for _, item := range interfaces {
 		hosts, err := net.LookupAddr(item["ip"])
 		if err != nil {
 			client.Log.Error("Error getting FQDN: %v", err)
 		} else if len(hosts) == 0 {
 			client.Log.Debug("No FQDN found for %s", item["ip"])
 		} else {
-			client.FQDN = strings.TrimSuffix(hosts[0], ".")
+			fqdn = strings.TrimSuffix(hosts[0], ".")
 			break // stop looking after we find one
 		}
 	}
 
 	//default to hostname
-	if client.FQDN == "" {
-		client.Log.Debug("No FQDN found. Using hostname: %s", client.Hostname)
-		client.FQDN = client.Hostname
+	if fqdn == "" {
+		client.Log.Debug("No FQDN found. Using hostname: %s", hostname)
+		fqdn = hostname
 	} else {
-		client.Log.Debug("Using FQDN: %s", client.FQDN)
+		client.Log.Debug("Using FQDN: %s", fqdn)
 	}
 
+	// the lookups above are slow, only hold the lock while the fields are replaced
+	client.hostMutex.Lock()
+	defer client.hostMutex.Unlock()
+
+	client.Hostname = hostname
+	client.Interfaces = interfaces
+	client.FQDN = fqdn
+
 	//parse domain
 	client.Domain = strings.Split(client.FQDN, ".")[0]
 
@@ -330,48 +561,24 @@ func (client *Client) Initialize() error {
 	client.OSVersion = fmt.Sprintf("%v (%v) %v", sysinfo.OS, sysinfo.Kernel, sysinfo.Core)
 
 	client.Log.Debug("Agent is running on OS %s", client.OSVersion)
+}
 
-	//create public and private keys
-	key, err := rsa.GenerateKey(rand.Reader, 2048)
-	if err != nil {
-		client.Log.Error("Private key cannot be created. %v", err)
-	}
-
-	//store keys as pem files
-	pubKey := key.PublicKey
-	der, err := x509.MarshalPKIXPublicKey(&pubKey)
-	if err != nil {
-		client.Log.Fatal("Unable to create client's public key: %v", err)
-	}
-
-	client.PublicKey = string(pem.EncodeToMemory(&pem.Block{
-		Type:  "RSA PUBLIC KEY",
-		Bytes: der,
-	}))
-
-	// Generate a pem block with the private key
-	client.PrivateKey = string(pem.EncodeToMemory(&pem.Block{
-		Type:  "RSA PRIVATE KEY",
-		Bytes: x509.MarshalPKCS1PrivateKey(key),
-	}))
-
-	client.Initialized = true // set initialized to true
-	//store values to registry
-	err = client.KeyStoreWriteOut()
-
-	//log and return any errors
-	if err != nil {
-		client.Log.Error("Unable to initialize client: %v", err)
-		return err
-	}
-
-	return nil
+// hostFQDN returns the FQDN collected by CollectHostInfo
+func (client *Client) hostFQDN() string {
+	client.hostMutex.RLock()
+	defer client.hostMutex.RUnlock()
+	return client.FQDN
 }
 
 // KeyStoreWriteOut - write current client struct values to the key store
 func (client *Client) KeyStoreWriteOut() error {
 	var err error
 
+	client.hostMutex.RLock()
+	defer client.hostMutex.RUnlock()
+	client.keyMutex.Lock()
+	defer client.keyMutex.Unlock()
+
 	//format data to strings
 	interfaces, _ := json.Marshal(client.Interfaces)
 
@@ -386,7 +593,9 @@ func (client *Client) KeyStoreWriteOut() error {
 	err = client.LocalDb.KeyStoreInsert("OSVersion", client.OSVersion)
 	err = client.LocalDb.KeyStoreInsert("PublicKey", client.PublicKey)
 	err = client.LocalDb.KeyStoreInsert("PrivateKey", client.PrivateKey)
+	err = client.LocalDb.KeyStoreInsert("PreviousKey", client.PreviousKey)
 	err = client.LocalDb.KeyStoreInsert("CertName", client.CertName)
+	err = client.LocalDb.KeyStoreInsert("ClientCertificate", client.ClientCertificate)
 	err = client.LocalDb.KeyStoreInsert("LocalDbName", client.LocalDbName)
 	err = client.LocalDb.KeyStoreInsert("Interfaces", string(interfaces))
 	err = client.LocalDb.KeyStoreInsert("LocalPort", strconv.FormatUint(client.LocalPort, 10))
@@ -406,7 +615,9 @@ func (client *Client) KeyStoreReadIn() error {
 	client.OSVersion, err = client.LocalDb.KeyStoreSelect("OSVersion")
 	client.PublicKey, err = client.LocalDb.KeyStoreSelect("PublicKey")
 	client.PrivateKey, err = client.LocalDb.KeyStoreSelect("PrivateKey")
+	client.PreviousKey, err = client.LocalDb.KeyStoreSelect("PreviousKey")
 	client.CertName, err = client.LocalDb.KeyStoreSelect("CertName")
+	client.ClientCertificate, err = client.LocalDb.KeyStoreSelect("ClientCertificate")
 	client.LocalDbName, err = client.LocalDb.KeyStoreSelect("LocalDbName")
 
 	//the following keys require a bit of parsing
@@ -491,6 +702,11 @@ func (client *Client) RSADecrypt(in []byte) ([]byte, error) {
 
 // GetSHA256 method to get the sha256 of a file given the filepath
 func (client *Client) GetSHA256(path string) (string, error) {
+	return FileSHA256(path)
+}
+
+// FileSHA256 returns the hex encoded sha256 of a file given the filepath
+func FileSHA256(path string) (string, error) {
 	//take hash
 	file, err := os.Open(path)
 	if err != nil {
@@ -507,12 +723,35 @@ func (client *Client) GetSHA256(path string) (string, error) {
 }
 
 // Heartbeat - should run as seperate goroutine
-func (client *Client) Heartbeat() {
+// Returns when the context is cancelled
+func (client *Client) Heartbeat(ctx context.Context) {
+	ticker := time.NewTicker(time.Second * 1)
+	defer ticker.Stop()
+
 	//write out current time every second
-	for range time.Tick(time.Second * 1) {
-		timestamp := []byte(fmt.Sprintf("%v", time.Now().UnixNano()))
-		if err := ioutil.WriteFile(filepath.Join(client.InstallDir, "heartbeat"), timestamp, 0644); err != nil {
-			client.Log.Fatal("Unable to write out heartbeat: %v", err)
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			timestamp := []byte(fmt.Sprintf("%v", time.Now().UnixNano()))
+			if err := ioutil.WriteFile(filepath.Join(client.InstallDir, "heartbeat"), timestamp, 0644); err != nil {
+				client.Log.Fatal("Unable to write out heartbeat: %v", err)
+			}
 		}
 	}
 }
+
+// Sleep pauses the calling goroutine for duration d or until the context is cancelled
+// Returns false if the context was cancelled before the duration elapsed
+func (client *Client) Sleep(ctx context.Context, d time.Duration) bool {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+
+	select {
+	case <-ctx.Done():
+		return false
+	case <-timer.C:
+		return true
+	}
+}
@@ -0,0 +1,221 @@
+// Package client configuration loading and in place reloading
+package client
+
+import (
+	"errors"
+	"ghost/agent/comms"
+	"io/ioutil"
+	mathrand "math/rand"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v2"
+)
+
+// DefaultQueueBatchLimit is the number of queued messages posted per request when no limit is configured for a uri
+const DefaultQueueBatchLimit = 100
+
+// defaultQueueBatchLimits are the built-in limits of uris whose messages are large
+var defaultQueueBatchLimits = map[string]int{
+	InventoryDocumentURI: 10, // package lists can run to megabytes
+}
+
+// DefaultDeadLetterSize is the number of rejected messages kept in the dead_letter table when none is configured
+const DefaultDeadLetterSize = 1000
+
+// LoadConfig reads and parses a YAML configuration file
+func LoadConfig(path string) (Config, error) {
+	var config Config
+
+	rawConfig, err := ioutil.ReadFile(path)
+	if err != nil {
+		return config, err
+	}
+
+	if err := yaml.Unmarshal(rawConfig, &config); err != nil {
+		return config, err
+	}
+
+	if len(config.ControllerList) == 0 {
+		return config, errors.New("configuration has an empty ControllerList")
+	}
+
+	return config, nil
+}
+
+// GetConfig returns a copy of the active configuration
+// The configuration can be replaced by ReloadConfig at any time so long running managers should work from a copy
+func (client *Client) GetConfig() Config {
+	client.configMutex.RLock()
+	defer client.configMutex.RUnlock()
+
+	return client.Config
+}
+
+// GetConfigHash returns the hash of the active configuration file
+func (client *Client) GetConfigHash() string {
+	client.configMutex.RLock()
+	defer client.configMutex.RUnlock()
+
+	return client.ConfigHash
+}
+
+// SetPollTime recalculates the poll time from the active configuration, adding up to a second of jitter
+func (client *Client) SetPollTime() {
+	client.configMutex.Lock()
+	defer client.configMutex.Unlock()
+
+	client.PollTime = (time.Second * time.Duration(client.Config.PollTime)) + (time.Millisecond * time.Duration(mathrand.Intn(1000)))
+}
+
+// GetPollTime returns the current poll time
+func (client *Client) GetPollTime() time.Duration {
+	client.configMutex.RLock()
+	defer client.configMutex.RUnlock()
+
+	return client.PollTime
+}
+
+// ReloadConfig reads the configuration file at ConfigPath and applies it to the running client
+// Log level, poll time, controller / proxy settings and plugins are applied in place.
+// The plugin manager picks up plugin changes on its next pass; unchanged plugins keep running.
+// A changed BinaryHash still requires a binary update and restart
+func (client *Client) ReloadConfig() error {
+	config, err := LoadConfig(client.ConfigPath)
+	if err != nil {
+		return errors.New("unable to load configuration file: " + err.Error())
+	}
+
+	hash, err := client.GetSHA256(client.ConfigPath)
+	if err != nil {
+		return err
+	}
+
+	// find proxies before taking the lock -- this may be slow on some systems
+	if !client.Offline {
+		client.addSystemProxies(&config)
+	}
+
+	// swap configuration
+	client.configMutex.Lock()
+	oldHash := client.ConfigHash
+	client.Config = config
+	client.ConfigHash = hash
+	client.configMutex.Unlock()
+
+	// update log level and poll time
+	client.Log.SetLevel(config.LogLevel)
+	client.SetPollTime()
+
+	// rebuild the comms sender with the new controller and proxy lists
+	if !client.Offline {
+		if err := client.Sender.Reconfigure(client.senderSettings(config)); err != nil {
+			return errors.New("unable to reconfigure communication sender: " + err.Error())
+		}
+	}
+
+	if !client.Debug && !strings.EqualFold(config.BinaryHash, client.BinaryHash) {
+		client.Log.Info("Reloaded configuration requires a different client binary. Have: %s -> Need: %s", client.BinaryHash, config.BinaryHash)
+	}
+
+	client.Log.Info("Client configuration reloaded. Was: %s -> Now: %s (%v plugins)", oldHash, hash, len(config.Plugins))
+	return nil
+}
+
+// addSystemProxies appends proxies found on the system to the configuration's proxy list (if enabled)
+// Duplicates and black listed proxies are skipped
+func (client *Client) addSystemProxies(config *Config) {
+	// find proxies from system if needed
+	var foundProxies []string
+	var err error
+	if config.UseSystemProxies {
+		foundProxies, err = comms.FindProxies()
+		if err != nil {
+			client.Log.Error("Error finding system proxies: %v", err)
+		}
+	}
+
+	// deduplicate and remove black listed proxies
+	for _, proxy := range foundProxies {
+		addProxy := true
+		for _, stopWord := range append(config.ProxyList, config.ProxyBlackList...) {
+			if strings.Contains(strings.ToLower(proxy), strings.ToLower(stopWord)) {
+				addProxy = false
+			}
+		}
+		if addProxy {
+			config.ProxyList = append(config.ProxyList, proxy)
+		}
+	}
+}
+
+// senderSettings returns the comms sender connection settings for a configuration
+// The active controller URL and proxy are kept if they are still listed, otherwise the first of each is used
+func (client *Client) senderSettings(config Config) comms.Sender {
+	settings := comms.Sender{
+		ControllerURL:      config.ControllerList[0],
+		ServerCertificate:  config.ServerCertificate,
+		TLSPinMode:         config.TLSPinMode,
+		TLSPinnedKeys:      config.TLSPinnedKeys,
+		RetryPolicy:        config.retryPolicy(),
+		SignatureAlgorithm: config.SignatureAlgorithm,
+	}
+	if config.TLSCABundle != "" {
+		settings.TLSCABundle = config.TLSCABundle
+		if !filepath.IsAbs(settings.TLSCABundle) {
+			settings.TLSCABundle = filepath.Join(client.InstallDir, settings.TLSCABundle)
+		}
+	}
+	if config.ProxyList != nil {
+		settings.Proxy = config.ProxyList[0]
+	}
+
+	// prefer the connection that is currently working
+	for _, controllerURL := range config.ControllerList {
+		if strings.TrimSuffix(controllerURL, "/") == strings.TrimSuffix(client.Sender.ControllerURL, "/") {
+			settings.ControllerURL = controllerURL
+		}
+	}
+	for _, proxy := range config.ProxyList {
+		if proxy == client.Sender.Proxy {
+			settings.Proxy = proxy
+		}
+	}
+
+	return settings
+}
+
+// QueueBatchLimit returns the maximum number of queued messages posted to uri in one request
+// Limits are configured per uri in QueueBatchLimits; other uris use the built-in limits
+func (client *Client) QueueBatchLimit(uri string) int {
+	config := client.GetConfig()
+	for configured, limit := range config.QueueBatchLimits {
+		if limit > 0 && strings.Trim(configured, "/") == strings.Trim(uri, "/") {
+			return limit
+		}
+	}
+	if limit, ok := defaultQueueBatchLimits[uri]; ok {
+		return limit
+	}
+	return DefaultQueueBatchLimit
+}
+
+// retryPolicy returns the comms retry policy of a configuration
+// Values left at zero use comms.DefaultRetryPolicy
+func (config Config) retryPolicy() comms.RetryPolicy {
+	return comms.RetryPolicy{
+		BaseInterval:     time.Second * time.Duration(config.RetryBaseInterval),
+		MaxInterval:      time.Second * time.Duration(config.RetryMaxInterval),
+		BreakerThreshold: config.BreakerThreshold,
+		BreakerCooldown:  time.Second * time.Duration(config.BreakerCooldown),
+	}
+}
+
+// DeadLetterSize returns the number of rejected messages kept in the dead_letter table
+func (client *Client) DeadLetterSize() int {
+	if size := client.GetConfig().DeadLetterSize; size > 0 {
+		return size
+	}
+	return DefaultDeadLetterSize
+}
@@ -4,6 +4,7 @@ package client
 import (
 	"database/sql"
 	"errors"
+	"fmt"
 	"strings"
 	"time"
 
@@ -14,10 +15,36 @@ import (
 // DBDRIVERNAME ...
 const DBDRIVERNAME = "sqlite3"
 
+// Message priorities of the message queue -- higher priorities are delivered first and evicted last
+const (
+	PriorityLow    = 0  // routine data such as plugin output
+	PriorityNormal = 10 // default
+	PriorityHigh   = 20 // reports the controller must not miss (task results, rollbacks, clones)
+)
+
+// messageQueueSize is the number of messages the rolling queue keeps
+const messageQueueSize = 20000
+
+// queueURIs are the controller endpoints messages can be queued for
+var queueURIs = map[string]bool{
+	"/core/pluginlog/":   true,
+	"/core/agentlog/":    true,
+	InventoryURI:         true,
+	InventoryDocumentURI: true,
+	TaskResultURI:        true,
+	CloneURI:             true,
+}
+
+// IsQueueURI reports whether messages can be queued for a controller uri
+func IsQueueURI(uri string) bool {
+	return queueURIs[uri]
+}
+
 // Database used by methods
 type Database struct {
 	Db   *sql.DB
 	Name string
+	kek  []byte // key encryption key of sensitive key store entries (see SetKeyEncryptionKey)
 }
 
 // Init method to initialize database
@@ -27,7 +54,20 @@ func (db *Database) Init() error {
 		return errors.New("Database Name cannot be empty")
 	}
 	db.Db, err = sql.Open(DBDRIVERNAME, db.Name)
-	return err
+	if err != nil {
+		return err
+	}
+
+	// bring tables of earlier versions up to date
+	return db.messageQueueMigrate()
+}
+
+// Close method to close the database
+func (db *Database) Close() error {
+	if db.Db == nil {
+		return nil
+	}
+	return db.Db.Close()
 }
 
 // Vacuum method to execute the VACUUM command
@@ -65,6 +105,7 @@ func (db *Database) KeyStoreCreateTable() error {
 }
 
 // KeyStoreInsert inserts data into key_store
+// Sensitive entries are encrypted once a key encryption key is set
 func (db *Database) KeyStoreInsert(key string, data string) error {
 	//create table if needed
 	err := db.KeyStoreCreateTable()
@@ -72,6 +113,14 @@ func (db *Database) KeyStoreInsert(key string, data string) error {
 		return err
 	}
 
+	//encrypt sensitive entries
+	if db.kek != nil && sensitiveKeys[key] && data != "" {
+		data, err = sealKeyStoreValue(db.kek, key, data)
+		if err != nil {
+			return err
+		}
+	}
+
 	//build and execute update statement
 	stmtStr := `UPDATE key_store 
 				SET data=? 
@@ -100,6 +149,59 @@ func (db *Database) KeyStoreInsert(key string, data string) error {
 	return err
 }
 
+// KeyStoreInsertValues inserts or updates several key_store entries in a single transaction
+// Sensitive entries are encrypted once a key encryption key is set
+func (db *Database) KeyStoreInsertValues(values map[string]string) error {
+	//create table if needed
+	err := db.KeyStoreCreateTable()
+	if err != nil {
+		return err
+	}
+
+	tx, err := db.Db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	//build update and insert statements
+	update, err := tx.Prepare(`UPDATE key_store 
+				SET data=? 
+				WHERE key=?;`)
+	if err != nil {
+		return err
+	}
+	defer update.Close()
+
+	insert, err := tx.Prepare(`INSERT OR IGNORE INTO key_store( 
+					key,
+					data) 
+				VALUES (?, ?);`)
+	if err != nil {
+		return err
+	}
+	defer insert.Close()
+
+	for key, data := range values {
+		//encrypt sensitive entries
+		if db.kek != nil && sensitiveKeys[key] && data != "" {
+			data, err = sealKeyStoreValue(db.kek, key, data)
+			if err != nil {
+				return err
+			}
+		}
+
+		if _, err := update.Exec(data, key); err != nil {
+			return err
+		}
+		if _, err := insert.Exec(key, data); err != nil {
+			return err
+		}
+	}
+
+	return tx.Commit()
+}
+
 // KeyStoreDelete removes a key pair from the key_store table
 // Returns true if a key pair was actually removed
 func (db *Database) KeyStoreDelete(key string) (bool, error) {
@@ -150,7 +252,21 @@ func (db *Database) KeyStoreDeleteAll(subkey string) (int64, error) {
 
 // KeyStoreSelect Returns stored value for a stored key pair
 // Used for core data only -- plugin data stored in plugin_store table
+// Encrypted entries are decrypted with the key encryption key
 func (db *Database) KeyStoreSelect(key string) (string, error) {
+	outStr, err := db.KeyStoreSelectRaw(key)
+	if err != nil || !isSealed(outStr) {
+		return outStr, err
+	}
+
+	if db.kek == nil {
+		return "", errors.New("key store entry " + key + " is encrypted but no key encryption key is loaded")
+	}
+	return openKeyStoreValue(db.kek, key, outStr)
+}
+
+// KeyStoreSelectRaw returns a stored value as it is held in the database (encrypted entries are not decrypted)
+func (db *Database) KeyStoreSelectRaw(key string) (string, error) {
 	//initialize return string
 	var outStr string
 
@@ -188,6 +304,40 @@ func (db *Database) KeyStoreSelect(key string) (string, error) {
 	return outStr, err
 }
 
+// KeyStoreUpdateRaw replaces the values of existing keys in a single transaction
+// Values are stored as given (they are not encrypted)
+func (db *Database) KeyStoreUpdateRaw(values map[string]string) error {
+	//create table if needed
+	err := db.KeyStoreCreateTable()
+	if err != nil {
+		return err
+	}
+
+	tx, err := db.Db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	//build and execute update statement
+	stmtStr := `UPDATE key_store 
+				SET data=? 
+				WHERE key=?;`
+	stmt, err := tx.Prepare(stmtStr)
+	if err != nil {
+		return err
+	}
+	defer stmt.Close()
+
+	for key, data := range values {
+		if _, err := stmt.Exec(data, key); err != nil {
+			return err
+		}
+	}
+
+	return tx.Commit()
+}
+
 // KeyStoreGetSubkeys returns a list of subkeys for a given prefix
 func (db *Database) KeyStoreGetSubkeys(prefix string) ([]string, error) {
 	//initialize return string list
@@ -472,7 +622,9 @@ func (db *Database) MessageQueueCreateTable() error {
 	stmtStr := `CREATE TABLE IF NOT EXISTS message_queue( 
 				post_string TEXT, 
 				post_uri TEXT,
-				rowid INTEGER PRIMARY KEY ASC);`
+				rowid INTEGER PRIMARY KEY ASC,
+				priority INTEGER NOT NULL DEFAULT 10,
+				expires INTEGER);`
 
 	stmt, err := db.Db.Prepare(stmtStr)
 	if err != nil {
@@ -481,32 +633,247 @@ func (db *Database) MessageQueueCreateTable() error {
 	defer stmt.Close()
 
 	_, err = stmt.Exec()
-	if err != nil {
+
+	return err
+}
+
+// messageQueueMigrate brings the message queue schema of earlier versions up to date and installs the rolling queue trigger
+// Run once when the database is opened
+func (db *Database) messageQueueMigrate() error {
+	//create table if needed
+	if err := db.MessageQueueCreateTable(); err != nil {
 		return err
 	}
 
-	triggerStr := `
-		CREATE TRIGGER IF NOT EXISTS rolling_queue AFTER INSERT ON message_queue
-		   BEGIN
-		     DELETE FROM message_queue WHERE rowid <= (SELECT rowid FROM message_queue ORDER BY rowid DESC LIMIT 20000, 1);
-		   END;`
+	// tables of earlier versions have neither priorities nor expiry
+	if err := db.messageQueueAddColumns(); err != nil {
+		return err
+	}
+
+	// delivery and eviction order
+	if _, err := db.Db.Exec(`CREATE INDEX IF NOT EXISTS message_queue_priority ON message_queue(priority, rowid);`); err != nil {
+		return err
+	}
+
+	// message_queue_stats counts messages dropped from the queue: evicted when the queue is full (dropped),
+	// of those the ones above normal priority (dropped_priority), expired before delivery (expired)
+	// and rejected messages dropped from a full dead_letter table (dead_letter_dropped)
+	statsStr := `CREATE TABLE IF NOT EXISTS message_queue_stats(
+				name TEXT UNIQUE,
+				value INTEGER);
+			INSERT OR IGNORE INTO message_queue_stats(name, value) VALUES('dropped', 0);
+			INSERT OR IGNORE INTO message_queue_stats(name, value) VALUES('dropped_priority', 0);
+			INSERT OR IGNORE INTO message_queue_stats(name, value) VALUES('expired', 0);
+			INSERT OR IGNORE INTO message_queue_stats(name, value) VALUES('dead_letter_dropped', 0);`
+
+	if _, err := db.Db.Exec(statsStr); err != nil {
+		return err
+	}
 
-	triggerStmt, err := db.Db.Prepare(triggerStr)
-	//defer triggerStmt.Close()
+	// the rolling queue keeps the newest 20000 messages, evicting the lowest priority (then oldest) message
+	// when an insert fills it and counting what it drops (replaces the FIFO triggers of earlier versions)
+	triggerStr := fmt.Sprintf(`
+		DROP TRIGGER IF EXISTS rolling_queue;
+		DROP TRIGGER IF EXISTS rolling_queue_counted;
+		DROP TRIGGER IF EXISTS rolling_queue_priority;
+		CREATE TRIGGER rolling_queue_priority AFTER INSERT ON message_queue
+		   WHEN (SELECT COUNT(*) FROM message_queue) > %[1]d
+		   BEGIN
+		     UPDATE message_queue_stats SET value = value + 1 WHERE name='dropped';
+		     UPDATE message_queue_stats SET value = value + 1 WHERE name='dropped_priority'
+		       AND (SELECT priority FROM message_queue ORDER BY priority, rowid LIMIT 1) > %[2]d;
+		     DELETE FROM message_queue WHERE rowid = (SELECT rowid FROM message_queue ORDER BY priority, rowid LIMIT 1);
+		   END;`, messageQueueSize, PriorityNormal)
+
+	// replaced in a transaction as the nanny and agent may open the database at the same time
+	tx, err := db.Db.Begin()
 	if err != nil {
 		return err
 	}
-	_, err = triggerStmt.Exec()
+	defer tx.Rollback()
+	if _, err := tx.Exec(triggerStr); err != nil {
+		return err
+	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
 
+	// the trigger evicts one message per insert, so trim queues that are already over size
+	if err := db.messageQueueTrim(); err != nil {
+		return err
+	}
+
+	// dead letters are limited when they are added (see MessageQueueDeadLetter)
+	if err := db.DeadLetterCreateTable(); err != nil {
+		return err
+	}
+	_, err = db.Db.Exec(`DROP TRIGGER IF EXISTS rolling_dead_letter;`)
 	return err
 }
 
-// MessageQueueSelectURI returns a string map list with the first 100 messages in the queue
-// Responses are limited to 100 results
+// messageQueueTrim evicts the lowest priority (then oldest) messages of a queue holding more than 20000 messages
+func (db *Database) messageQueueTrim() error {
+	var depth int
+	if err := db.Db.QueryRow(`SELECT COUNT(*) FROM message_queue;`).Scan(&depth); err != nil || depth <= messageQueueSize {
+		return err
+	}
+	excess := depth - messageQueueSize
+
+	tx, err := db.Db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	evicted := `SELECT rowid, priority FROM message_queue ORDER BY priority, rowid LIMIT ?`
+	if _, err := tx.Exec(`UPDATE message_queue_stats SET value = value + (SELECT COUNT(*) FROM (`+evicted+`) WHERE priority > ?) WHERE name='dropped_priority';`, excess, PriorityNormal); err != nil {
+		return err
+	}
+	if _, err := tx.Exec(`UPDATE message_queue_stats SET value = value + ? WHERE name='dropped';`, excess); err != nil {
+		return err
+	}
+	if _, err := tx.Exec(`DELETE FROM message_queue WHERE rowid IN (SELECT rowid FROM (`+evicted+`));`, excess); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// messageQueueAddColumns adds the priority and expires columns to message_queue tables of earlier versions
+func (db *Database) messageQueueAddColumns() error {
+	rows, err := db.Db.Query(`PRAGMA table_info(message_queue);`)
+	if err != nil {
+		return err
+	}
+	columns := make(map[string]bool)
+	for rows.Next() {
+		var cid, notNull, pk int
+		var name, columnType string
+		var defaultValue sql.NullString
+		if err := rows.Scan(&cid, &name, &columnType, &notNull, &defaultValue, &pk); err != nil {
+			rows.Close()
+			return err
+		}
+		columns[name] = true
+	}
+	rows.Close()
+
+	if !columns["priority"] {
+		if _, err := db.Db.Exec(`ALTER TABLE message_queue ADD COLUMN priority INTEGER NOT NULL DEFAULT 10;`); err != nil {
+			return err
+		}
+	}
+	if !columns["expires"] {
+		if _, err := db.Db.Exec(`ALTER TABLE message_queue ADD COLUMN expires INTEGER;`); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// MessageQueueDepth returns the number of messages waiting in the message_queue table
+func (db *Database) MessageQueueDepth() (int, error) {
+	//create table if needed
+	if err := db.MessageQueueCreateTable(); err != nil {
+		return 0, err
+	}
+
+	var depth int
+	err := db.Db.QueryRow(`SELECT COUNT(*) FROM message_queue;`).Scan(&depth)
+	return depth, err
+}
+
+// MessageQueueDropped returns the number of messages evicted by the rolling queue since the table was created
+func (db *Database) MessageQueueDropped() (int64, error) {
+	return db.messageQueueStat("dropped")
+}
+
+// MessageQueueDroppedPriority returns the number of messages above normal priority evicted by the rolling queue
+func (db *Database) MessageQueueDroppedPriority() (int64, error) {
+	return db.messageQueueStat("dropped_priority")
+}
+
+// MessageQueueExpired returns the number of messages that expired before they were delivered
+func (db *Database) MessageQueueExpired() (int64, error) {
+	return db.messageQueueStat("expired")
+}
+
+// messageQueueStat returns a counter of the message_queue_stats table
+func (db *Database) messageQueueStat(name string) (int64, error) {
+	//create table if needed
+	if err := db.MessageQueueCreateTable(); err != nil {
+		return 0, err
+	}
+
+	var value int64
+	err := db.Db.QueryRow(`SELECT value FROM message_queue_stats WHERE name=?;`, name).Scan(&value)
+	return value, err
+}
+
+// MessageQueueExpire removes messages whose time-to-live has passed
+// Returns the number of messages removed
+func (db *Database) MessageQueueExpire() (int64, error) {
+	//create table if needed
+	if err := db.MessageQueueCreateTable(); err != nil {
+		return 0, err
+	}
+
+	tx, err := db.Db.Begin()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	now := time.Now().Unix()
+	result, err := tx.Exec(`DELETE FROM message_queue WHERE expires IS NOT NULL AND expires <= ?;`, now)
+	if err != nil {
+		return 0, err
+	}
+	n, err := result.RowsAffected()
+	if err != nil || n == 0 {
+		return 0, err
+	}
+	if _, err := tx.Exec(`UPDATE message_queue_stats SET value = value + ? WHERE name='expired';`, n); err != nil {
+		return 0, err
+	}
+
+	return n, tx.Commit()
+}
+
+// MessageQueueURIs returns the post uris messages are queued for (an empty string for messages without a uri)
+// Uris holding the highest priority messages come first, then the uri of the oldest message
+func (db *Database) MessageQueueURIs() (uris []string, err error) {
+	//create table if needed
+	if err := db.MessageQueueCreateTable(); err != nil {
+		return uris, err
+	}
+
+	rows, err := db.Db.Query(`SELECT COALESCE(post_uri, '')
+				FROM message_queue
+				GROUP BY COALESCE(post_uri, '')
+				ORDER BY MAX(priority) DESC, MIN(rowid);`)
+	if err != nil {
+		return uris, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var uri string
+		if err := rows.Scan(&uri); err != nil {
+			return uris, err
+		}
+		uris = append(uris, uri)
+	}
+	return uris, rows.Err()
+}
+
+// MessageQueueSelectURI returns a string map list with the highest priority (then oldest) unexpired messages queued for a post uri
+// Responses are limited to limit results
 // INPUT uri (string) - post uris to filter search on
-// OUTPUT outMsgs ([]string) - list of output messages
-// OUPUT rowIds ([]int) - list of ints corresponding to row ids that should be removed from the database once messages are transmitted
-func (db *Database) MessageQueueSelectURI(uri string) (outMsgs []string, rowIds []int, err error) {
+// INPUT limit (int) - maximum number of messages returned
+// OUTPUT outMsgs ([]string) - list of output messages (empty messages are removed from the queue)
+// OUPUT rowIds ([]int) - list of ints corresponding to row ids that should be removed from the database once messages are transmitted; rowIds[i] holds outMsgs[i]
+func (db *Database) MessageQueueSelectURI(uri string, limit int) (outMsgs []string, rowIds []int, err error) {
 
 	//create table if needed
 	err = db.MessageQueueCreateTable()
@@ -514,13 +881,20 @@ func (db *Database) MessageQueueSelectURI(uri string) (outMsgs []string, rowIds
 		return
 	}
 
+	// empty messages have nothing to deliver
+	_, err = db.Db.Exec(`DELETE FROM message_queue WHERE post_uri=? AND (post_string IS NULL OR post_string = '');`, uri)
+	if err != nil {
+		return
+	}
+
 	//build and execute query
 	stmtStr := `SELECT  
 					rowid,
 					post_string  
 				FROM message_queue 
-				ORDER BY ROWID 
-				LIMIT 100;`
+				WHERE post_uri=? AND (expires IS NULL OR expires > ?)
+				ORDER BY priority DESC, ROWID 
+				LIMIT ?;`
 
 	stmt, err := db.Db.Prepare(stmtStr)
 	if err != nil {
@@ -528,7 +902,7 @@ func (db *Database) MessageQueueSelectURI(uri string) (outMsgs []string, rowIds
 	}
 	defer stmt.Close()
 
-	rows, err := stmt.Query()
+	rows, err := stmt.Query(uri, time.Now().Unix(), limit)
 	if err != nil {
 		return
 	}
@@ -544,18 +918,26 @@ func (db *Database) MessageQueueSelectURI(uri string) (outMsgs []string, rowIds
 		}
 
 		// add to list results actually returned
-		if postString != "" {
-			outMsgs = append(outMsgs, postString)
-		}
-		if rowid != 0 {
-			rowIds = append(rowIds, rowid)
-		}
+		outMsgs = append(outMsgs, postString)
+		rowIds = append(rowIds, rowid)
 	}
 	return
 }
 
-// MessageQueueInsert inserts messages into the message_queue table
+// MessageQueueInsert inserts messages into the message_queue table at normal priority
 func (db *Database) MessageQueueInsert(postString string, postURI string) error {
+	return db.MessageQueueInsertPriority(postString, postURI, PriorityNormal, 0)
+}
+
+// MessageQueueInsertPriority inserts messages into the message_queue table
+// INPUT priority (int) - PriorityLow, PriorityNormal or PriorityHigh
+// INPUT ttl (time.Duration) - time after which the message is dropped if it was not delivered; 0 to keep it until delivered
+func (db *Database) MessageQueueInsertPriority(postString string, postURI string, priority int, ttl time.Duration) error {
+	// only messages the message queue manager can deliver are queued
+	if !IsQueueURI(postURI) {
+		return errors.New("cannot queue message for unknown uri \"" + postURI + "\"")
+	}
+
 	//create table if needed
 	err := db.MessageQueueCreateTable()
 	if err != nil {
@@ -565,8 +947,10 @@ func (db *Database) MessageQueueInsert(postString string, postURI string) error
 	//build and execute query
 	stmtStr := `INSERT INTO message_queue(  
 					post_string, 
-					post_uri) 
-				VALUES(?, ?);`
+					post_uri,
+					priority,
+					expires) 
+				VALUES(?, ?, ?, ?);`
 
 	stmt, err := db.Db.Prepare(stmtStr)
 	if err != nil {
@@ -574,11 +958,30 @@ func (db *Database) MessageQueueInsert(postString string, postURI string) error
 	}
 	defer stmt.Close()
 
-	_, err = stmt.Exec(postString, postURI)
+	var expires interface{}
+	if ttl > 0 {
+		expires = time.Now().Add(ttl).Unix()
+	}
+	_, err = stmt.Exec(postString, postURI, priority, expires)
 
 	return err
 }
 
+// MessageQueueDeleteURI deletes all messages queued for a post uri (an empty string for messages without a uri)
+// Returns number of rows deleted
+func (db *Database) MessageQueueDeleteURI(uri string) (int64, error) {
+	//create table if needed
+	if err := db.MessageQueueCreateTable(); err != nil {
+		return 0, err
+	}
+
+	result, err := db.Db.Exec(`DELETE FROM message_queue WHERE COALESCE(post_uri, '')=?;`, uri)
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected()
+}
+
 // MessageQueueDelete deletes messages by rowID from the message_queue table
 // INPUT rowIds []int - list of rowids to remove
 // Returns number of rows deleted
@@ -613,3 +1016,433 @@ func (db *Database) MessageQueueDelete(rowIds []int) (int, error) {
 
 	return int(n), err
 }
+
+// BlobCreateTable method to create the blobs and blob_refs tables if not exist
+// blobs tracks when each blob in the blob store was last used, blob_refs which plugin resource files use it
+func (db *Database) BlobCreateTable() error {
+	stmtStr := `CREATE TABLE IF NOT EXISTS blobs(
+				hash TEXT UNIQUE,
+				last_used TEXT,
+				rowid INTEGER PRIMARY KEY ASC);
+			CREATE TABLE IF NOT EXISTS blob_refs(
+				owner TEXT,
+				path TEXT,
+				hash TEXT,
+				rowid INTEGER PRIMARY KEY ASC,
+				UNIQUE(owner, path));`
+
+	_, err := db.Db.Exec(stmtStr)
+	return err
+}
+
+// BlobTouch records a blob as used now
+func (db *Database) BlobTouch(hash string) error {
+	//create table if needed
+	err := db.BlobCreateTable()
+	if err != nil {
+		return err
+	}
+
+	//build and execute query
+	stmtStr := `INSERT OR REPLACE INTO blobs(hash, last_used) VALUES(?, ?);`
+
+	stmt, err := db.Db.Prepare(stmtStr)
+	if err != nil {
+		return err
+	}
+	defer stmt.Close()
+
+	_, err = stmt.Exec(strings.ToLower(hash), time.Now().UTC().Format(time.RFC3339Nano))
+	return err
+}
+
+// BlobRefReplace replaces the blob references held by owner (e.g. a plugin UUID)
+// INPUT owner (string) - owner of the references
+// INPUT refs (map[string]string) - resource file paths mapped to blob hashes. Empty to release all references
+func (db *Database) BlobRefReplace(owner string, refs map[string]string) error {
+	//create table if needed
+	err := db.BlobCreateTable()
+	if err != nil {
+		return err
+	}
+
+	tx, err := db.Db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	// released blobs start their retention period now
+	now := time.Now().UTC().Format(time.RFC3339Nano)
+	if _, err := tx.Exec(`UPDATE blobs SET last_used=? WHERE hash IN (SELECT hash FROM blob_refs WHERE owner=?);`, now, owner); err != nil {
+		return err
+	}
+	if _, err := tx.Exec(`DELETE FROM blob_refs WHERE owner=?;`, owner); err != nil {
+		return err
+	}
+
+	for path, hash := range refs {
+		hash = strings.ToLower(hash)
+		if _, err := tx.Exec(`INSERT INTO blob_refs(owner, path, hash) VALUES(?, ?, ?);`, owner, path, hash); err != nil {
+			return err
+		}
+		if _, err := tx.Exec(`INSERT OR REPLACE INTO blobs(hash, last_used) VALUES(?, ?);`, hash, now); err != nil {
+			return err
+		}
+	}
+
+	return tx.Commit()
+}
+
+// BlobRefOwners returns the owners holding blob references
+func (db *Database) BlobRefOwners() (owners []string, err error) {
+	//create table if needed
+	if err := db.BlobCreateTable(); err != nil {
+		return owners, err
+	}
+
+	rows, err := db.Db.Query(`SELECT DISTINCT owner FROM blob_refs;`)
+	if err != nil {
+		return owners, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var owner string
+		if err = rows.Scan(&owner); err != nil {
+			return owners, err
+		}
+		owners = append(owners, owner)
+	}
+	return owners, rows.Err()
+}
+
+// BlobSelectUnused returns blobs without references that have not been used since the given time
+func (db *Database) BlobSelectUnused(before time.Time) (hashes []string, err error) {
+	//create table if needed
+	if err := db.BlobCreateTable(); err != nil {
+		return hashes, err
+	}
+
+	//build and execute query
+	stmtStr := `SELECT hash, last_used FROM blobs
+				WHERE hash NOT IN (SELECT hash FROM blob_refs);`
+
+	rows, err := db.Db.Query(stmtStr)
+	if err != nil {
+		return hashes, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var hash, lastUsed string
+		if err = rows.Scan(&hash, &lastUsed); err != nil {
+			return hashes, err
+		}
+		if used, err := time.Parse(time.RFC3339Nano, lastUsed); err != nil || used.Before(before) {
+			hashes = append(hashes, hash)
+		}
+	}
+	return hashes, rows.Err()
+}
+
+// BlobDelete removes a blob from the blobs table
+func (db *Database) BlobDelete(hash string) error {
+	//create table if needed
+	if err := db.BlobCreateTable(); err != nil {
+		return err
+	}
+
+	_, err := db.Db.Exec(`DELETE FROM blobs WHERE hash=?;`, hash)
+	return err
+}
+
+// TaskCreateTable method to create the tasks table if not exist
+// tasks records controller tasks the agent has received so a task is never run twice
+func (db *Database) TaskCreateTable() error {
+	stmtStr := `CREATE TABLE IF NOT EXISTS tasks(
+				task_id TEXT UNIQUE,
+				type TEXT,
+				status TEXT,
+				received TEXT,
+				rowid INTEGER PRIMARY KEY ASC);`
+
+	_, err := db.Db.Exec(stmtStr)
+	return err
+}
+
+// TaskBegin records a task as received
+// Returns false if the task had already been received
+func (db *Database) TaskBegin(taskID string, taskType string) (bool, error) {
+	//create table if needed
+	if err := db.TaskCreateTable(); err != nil {
+		return false, err
+	}
+
+	//build and execute query
+	stmtStr := `INSERT OR IGNORE INTO tasks(task_id, type, status, received) VALUES(?, ?, ?, ?);`
+
+	result, err := db.Db.Exec(stmtStr, taskID, taskType, "running", time.Now().UTC().Format(time.RFC3339Nano))
+	if err != nil {
+		return false, err
+	}
+	n, err := result.RowsAffected()
+
+	return (n == int64(1)), err
+}
+
+// TaskUpdateStatus updates the status of a received task
+func (db *Database) TaskUpdateStatus(taskID string, status string) error {
+	//create table if needed
+	if err := db.TaskCreateTable(); err != nil {
+		return err
+	}
+
+	_, err := db.Db.Exec(`UPDATE tasks SET status=? WHERE task_id=?;`, status, taskID)
+	return err
+}
+
+// TaskForget removes a received task so it is run if the controller sends it again
+func (db *Database) TaskForget(taskID string) error {
+	//create table if needed
+	if err := db.TaskCreateTable(); err != nil {
+		return err
+	}
+
+	_, err := db.Db.Exec(`DELETE FROM tasks WHERE task_id=?;`, taskID)
+	return err
+}
+
+// TaskDeleteBefore removes tasks received before the given time
+func (db *Database) TaskDeleteBefore(before time.Time) error {
+	//create table if needed
+	if err := db.TaskCreateTable(); err != nil {
+		return err
+	}
+
+	_, err := db.Db.Exec(`DELETE FROM tasks WHERE received < ?;`, before.UTC().Format(time.RFC3339Nano))
+	return err
+}
+
+// DeadLetter struct is a queued message the controller rejected
+type DeadLetter struct {
+	ID         int       `json:"id"`
+	PostString string    `json:"post_string"`
+	PostURI    string    `json:"post_uri"`
+	Priority   int       `json:"priority"`
+	Error      string    `json:"error"`
+	StatusCode int       `json:"status_code"`
+	Rejected   time.Time `json:"rejected"`
+}
+
+// DeadLetterCreateTable method to create the dead_letter table if not exist
+// dead_letter keeps the newest messages the controller rejected, for inspection and requeueing
+func (db *Database) DeadLetterCreateTable() error {
+	stmtStr := `CREATE TABLE IF NOT EXISTS dead_letter(
+				post_string TEXT,
+				post_uri TEXT,
+				priority INTEGER NOT NULL DEFAULT 10,
+				expires INTEGER,
+				error TEXT,
+				status_code INTEGER,
+				rejected TEXT,
+				rowid INTEGER PRIMARY KEY ASC);`
+
+	_, err := db.Db.Exec(stmtStr)
+	return err
+}
+
+// MessageQueueDeadLetter moves a message from the message_queue table to the dead_letter table
+// The oldest dead letters beyond limit are dropped and counted (see DeadLetterDropped)
+// INPUT rowID (int) - row id of the message in message_queue
+// INPUT reason (string) - error the controller rejected the message with
+// INPUT statusCode (int) - http status of the rejection (0 if none)
+// INPUT limit (int) - number of dead letters kept
+func (db *Database) MessageQueueDeadLetter(rowID int, reason string, statusCode int, limit int) error {
+	//create tables if needed
+	if err := db.MessageQueueCreateTable(); err != nil {
+		return err
+	}
+	if err := db.DeadLetterCreateTable(); err != nil {
+		return err
+	}
+
+	tx, err := db.Db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	rejected := time.Now().UTC().Format(time.RFC3339Nano)
+	if _, err := tx.Exec(`INSERT INTO dead_letter(post_string, post_uri, priority, expires, error, status_code, rejected)
+				SELECT post_string, post_uri, priority, expires, ?, ?, ? FROM message_queue WHERE rowid=?;`, reason, statusCode, rejected, rowID); err != nil {
+		return err
+	}
+	if _, err := tx.Exec(`DELETE FROM message_queue WHERE rowid=?;`, rowID); err != nil {
+		return err
+	}
+
+	// make room, counting what is dropped
+	result, err := tx.Exec(`DELETE FROM dead_letter WHERE rowid IN (SELECT rowid FROM dead_letter ORDER BY rowid DESC LIMIT -1 OFFSET ?);`, limit)
+	if err != nil {
+		return err
+	}
+	if n, err := result.RowsAffected(); err != nil {
+		return err
+	} else if n > 0 {
+		if _, err := tx.Exec(`UPDATE message_queue_stats SET value = value + ? WHERE name='dead_letter_dropped';`, n); err != nil {
+			return err
+		}
+	}
+
+	return tx.Commit()
+}
+
+// DeadLetterDropped returns the number of dead letters dropped to keep the dead_letter table within its limit
+func (db *Database) DeadLetterDropped() (int64, error) {
+	return db.messageQueueStat("dead_letter_dropped")
+}
+
+// DeadLetterSelect returns rejected messages, oldest first
+// INPUT ids ([]int) - dead letters to return; all if empty
+// INPUT uri (string) - only return messages for this post uri; all if empty
+func (db *Database) DeadLetterSelect(ids []int, uri string) (letters []DeadLetter, err error) {
+	//create table if needed
+	if err := db.DeadLetterCreateTable(); err != nil {
+		return letters, err
+	}
+
+	where, args := deadLetterFilter(ids, uri)
+	rows, err := db.Db.Query(`SELECT rowid, post_string, post_uri, priority, error, status_code, rejected
+				FROM dead_letter`+where+`
+				ORDER BY rowid;`, args...)
+	if err != nil {
+		return letters, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var letter DeadLetter
+		var rejected string
+		if err := rows.Scan(&letter.ID, &letter.PostString, &letter.PostURI, &letter.Priority, &letter.Error, &letter.StatusCode, &rejected); err != nil {
+			return letters, err
+		}
+		letter.Rejected, _ = time.Parse(time.RFC3339Nano, rejected)
+		letters = append(letters, letter)
+	}
+	return letters, rows.Err()
+}
+
+// DeadLetterRequeue moves rejected messages back into the message_queue table
+// Messages keep the expiry they were queued with (expired messages are dropped by the next MessageQueueExpire)
+// INPUT ids ([]int) - dead letters to requeue; all if empty
+// INPUT uri (string) - only requeue messages for this post uri; all if empty
+// Returns number of messages requeued
+func (db *Database) DeadLetterRequeue(ids []int, uri string) (int64, error) {
+	//create tables if needed
+	if err := db.MessageQueueCreateTable(); err != nil {
+		return 0, err
+	}
+	if err := db.DeadLetterCreateTable(); err != nil {
+		return 0, err
+	}
+
+	tx, err := db.Db.Begin()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	where, args := deadLetterFilter(ids, uri)
+	result, err := tx.Exec(`INSERT INTO message_queue(post_string, post_uri, priority, expires)
+				SELECT post_string, post_uri, priority, expires FROM dead_letter`+where+` ORDER BY rowid;`, args...)
+	if err != nil {
+		return 0, err
+	}
+	n, err := result.RowsAffected()
+	if err != nil {
+		return 0, err
+	}
+	if _, err := tx.Exec(`DELETE FROM dead_letter`+where+`;`, args...); err != nil {
+		return 0, err
+	}
+
+	return n, tx.Commit()
+}
+
+// DeadLetterPurge deletes rejected messages
+// INPUT ids ([]int) - dead letters to delete; all if empty
+// INPUT uri (string) - only delete messages for this post uri; all if empty
+// Returns number of messages deleted
+func (db *Database) DeadLetterPurge(ids []int, uri string) (int64, error) {
+	//create table if needed
+	if err := db.DeadLetterCreateTable(); err != nil {
+		return 0, err
+	}
+
+	where, args := deadLetterFilter(ids, uri)
+	result, err := db.Db.Exec(`DELETE FROM dead_letter`+where+`;`, args...)
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected()
+}
+
+// DeadLetterDepth returns the number of messages in the dead_letter table
+func (db *Database) DeadLetterDepth() (int, error) {
+	//create table if needed
+	if err := db.DeadLetterCreateTable(); err != nil {
+		return 0, err
+	}
+
+	var depth int
+	err := db.Db.QueryRow(`SELECT COUNT(*) FROM dead_letter;`).Scan(&depth)
+	return depth, err
+}
+
+// deadLetterFilter builds the WHERE clause selecting dead letters by id and post uri
+func deadLetterFilter(ids []int, uri string) (string, []interface{}) {
+	var conditions []string
+	var args []interface{}
+
+	if len(ids) > 0 {
+		conditions = append(conditions, "rowid IN (?"+strings.Repeat(",?", len(ids)-1)+")")
+		for _, id := range ids {
+			args = append(args, id)
+		}
+	}
+	if uri != "" {
+		conditions = append(conditions, "post_uri=?")
+		args = append(args, uri)
+	}
+
+	if len(conditions) == 0 {
+		return "", args
+	}
+	return " WHERE " + strings.Join(conditions, " AND "), args
+}
+
+// ClearAgentData deletes the queued messages, dead letters, plugin states and received tasks of the agent
+// Used when a copied identity is dropped so data collected under it is not sent for the new agent
+func (db *Database) ClearAgentData() error {
+	//create tables if needed
+	for _, create := range []func() error{db.MessageQueueCreateTable, db.DeadLetterCreateTable, db.PluginCreateTable, db.TaskCreateTable} {
+		if err := create(); err != nil {
+			return err
+		}
+	}
+
+	tx, err := db.Db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	for _, table := range []string{"message_queue", "dead_letter", "plugins", "tasks"} {
+		if _, err := tx.Exec(`DELETE FROM ` + table + `;`); err != nil {
+			return err
+		}
+	}
+
+	return tx.Commit()
+}
@@ -0,0 +1,87 @@
+package client
+
+import (
+	"database/sql"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestDeadLetterFilter(t *testing.T) {
+	tests := []struct {
+		name   string
+		ids    []int
+		uri    string
+		clause string
+		args   []interface{}
+	}{
+		{"all", nil, "", "", nil},
+		{"one id", []int{7}, "", " WHERE rowid IN (?)", []interface{}{7}},
+		{"ids", []int{1, 2, 3}, "", " WHERE rowid IN (?,?,?)", []interface{}{1, 2, 3}},
+		{"uri", nil, "/core/message/", " WHERE post_uri=?", []interface{}{"/core/message/"}},
+		{"ids and uri", []int{4, 5}, "/core/message/", " WHERE rowid IN (?,?) AND post_uri=?", []interface{}{4, 5, "/core/message/"}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			clause, args := deadLetterFilter(test.ids, test.uri)
+			if clause != test.clause {
+				t.Errorf("clause = %q, want %q", clause, test.clause)
+			}
+			if !reflect.DeepEqual(args, test.args) {
+				t.Errorf("args = %v, want %v", args, test.args)
+			}
+		})
+	}
+}
+
+func TestDeadLetterRequeueKeepsExpiry(t *testing.T) {
+	db := Database{Name: filepath.Join(t.TempDir(), "ghost.db")}
+	if err := db.Init(); err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	if err := db.MessageQueueInsertPriority("expiring", TaskResultURI, PriorityHigh, time.Hour); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.MessageQueueInsert("kept", TaskResultURI); err != nil {
+		t.Fatal(err)
+	}
+	expiry := func() map[string]sql.NullInt64 {
+		rows, err := db.Db.Query(`SELECT post_string, expires FROM message_queue;`)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer rows.Close()
+		expires := make(map[string]sql.NullInt64)
+		for rows.Next() {
+			var message string
+			var expiry sql.NullInt64
+			if err := rows.Scan(&message, &expiry); err != nil {
+				t.Fatal(err)
+			}
+			expires[message] = expiry
+		}
+		return expires
+	}
+	queued := expiry()
+
+	_, rowIds, err := db.MessageQueueSelectURI(TaskResultURI, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, rowID := range rowIds {
+		if err := db.MessageQueueDeadLetter(rowID, "rejected", 400, 10); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if n, err := db.DeadLetterRequeue(nil, ""); err != nil || n != 2 {
+		t.Fatalf("DeadLetterRequeue = %v, %v, want 2 messages", n, err)
+	}
+
+	if requeued := expiry(); !reflect.DeepEqual(requeued, queued) {
+		t.Errorf("requeued expiry = %v, want %v", requeued, queued)
+	}
+}
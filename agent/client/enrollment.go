@@ -0,0 +1,82 @@
+// Package client enrollment tokens proving a host may register with the controller
+package client
+
+import (
+	"errors"
+	"ghost/agent/comms"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// EnrollmentTokenEnv is the environment variable an enrollment token can be passed in
+const EnrollmentTokenEnv = "GHOST_ENROLLMENT_TOKEN"
+
+// DefaultEnrollmentTokenFile is the token file read when no EnrollmentTokenFile is configured (relative to the install directory)
+const DefaultEnrollmentTokenFile = "enrollment.token"
+
+// EnrollmentToken returns the token sent with the registration message and the file it was read from (if any)
+// The token is taken from the GHOST_ENROLLMENT_TOKEN environment variable, the token file or the configuration, in that order
+func (client *Client) EnrollmentToken() (string, string, error) {
+	if token := strings.TrimSpace(os.Getenv(EnrollmentTokenEnv)); token != "" {
+		return token, "", nil
+	}
+
+	path := client.enrollmentTokenPath()
+	content, err := ioutil.ReadFile(path)
+	if err == nil {
+		if token := strings.TrimSpace(string(content)); token != "" {
+			return token, path, nil
+		}
+	} else if !os.IsNotExist(err) || client.Config.EnrollmentTokenFile != "" {
+		// a configured token file has to exist
+		return "", "", errors.New("unable to read enrollment token: " + err.Error())
+	}
+
+	return strings.TrimSpace(client.Config.EnrollmentToken), "", nil
+}
+
+// enrollmentTokenPath returns the path of the token file
+func (client *Client) enrollmentTokenPath() string {
+	path := client.Config.EnrollmentTokenFile
+	if path == "" {
+		path = DefaultEnrollmentTokenFile
+	}
+	if !filepath.IsAbs(path) {
+		path = filepath.Join(client.InstallDir, path)
+	}
+	return path
+}
+
+// IsEnrollmentRejected reports whether the controller refused a registration because of its enrollment token
+func IsEnrollmentRejected(err error) bool {
+	var statusErr *comms.StatusError
+	return errors.As(err, &statusErr) && (statusErr.StatusCode == http.StatusUnauthorized || statusErr.StatusCode == http.StatusForbidden)
+}
+
+// WipeFile overwrites a file with zeros before removing it
+func WipeFile(path string) error {
+	info, err := os.Stat(path)
+	if err != nil {
+		return err
+	}
+
+	file, err := os.OpenFile(path, os.O_WRONLY, 0)
+	if err != nil {
+		return err
+	}
+	_, err = file.Write(make([]byte, info.Size()))
+	if err == nil {
+		err = file.Sync()
+	}
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+
+	return os.Remove(path)
+}
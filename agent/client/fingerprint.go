@@ -0,0 +1,164 @@
+// Package client host fingerprints detecting cloned installs
+package client
+
+import (
+	"encoding/json"
+	"net"
+	"sort"
+	"strings"
+	"time"
+)
+
+// CloneURI is the controller endpoint clone reports are queued for
+const CloneURI = "/core/clone/"
+
+// Clone policies, applied when the key store was created on another host
+const (
+	ClonePolicyReport       = "report"       // keep the identity and report the clone to the controller (default)
+	ClonePolicyReinitialize = "reinitialize" // drop the copied identity and register as a new agent
+)
+
+// HostFingerprint struct identifies the host a key store was created on
+// Components that cannot be read on a host are left empty and not compared
+type HostFingerprint struct {
+	MachineID string   `json:"machine_id"`
+	MACs      []string `json:"macs"` // globally administered MAC addresses, sorted
+	BootDisk  string   `json:"boot_disk"`
+}
+
+// CloneReport struct is queued for the controller when a clone is detected
+type CloneReport struct {
+	UUID     string          `json:"uuid"`
+	Policy   string          `json:"policy"`
+	Recorded HostFingerprint `json:"recorded"`
+	Current  HostFingerprint `json:"current"`
+	Detected time.Time       `json:"detected"`
+}
+
+// CollectHostFingerprint reads the machine id, MAC addresses and boot disk UUID of this host
+func CollectHostFingerprint() HostFingerprint {
+	var fingerprint HostFingerprint
+	fingerprint.MachineID, _ = machineID()
+	fingerprint.BootDisk, _ = bootDiskID()
+
+	ifaces, _ := net.Interfaces()
+	for _, iface := range ifaces {
+		mac := iface.HardwareAddr
+		// skip loopback and locally administered (virtual, randomized) addresses
+		if iface.Flags&net.FlagLoopback != 0 || len(mac) == 0 || mac[0]&0x02 != 0 {
+			continue
+		}
+		fingerprint.MACs = append(fingerprint.MACs, mac.String())
+	}
+	sort.Strings(fingerprint.MACs)
+
+	return fingerprint
+}
+
+// SameHost reports whether two fingerprints were taken on the same host
+// Machine ids and boot disks must match and at least one MAC address must be shared
+func (f HostFingerprint) SameHost(other HostFingerprint) bool {
+	if f.MachineID != "" && other.MachineID != "" && !strings.EqualFold(f.MachineID, other.MachineID) {
+		return false
+	}
+	if f.BootDisk != "" && other.BootDisk != "" && !strings.EqualFold(f.BootDisk, other.BootDisk) {
+		return false
+	}
+	if len(f.MACs) == 0 || len(other.MACs) == 0 {
+		return true
+	}
+	for _, mac := range f.MACs {
+		for _, otherMAC := range other.MACs {
+			if mac == otherMAC {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// CheckClone compares the host with the fingerprint recorded in the key store and applies the ClonePolicy on a mismatch
+// Returns true if the copied identity was dropped and the agent must initialize again
+func (client *Client) CheckClone() bool {
+	current := CollectHostFingerprint()
+
+	stored, err := client.LocalDb.KeyStoreSelect("HostFingerprint")
+	if err != nil {
+		client.Log.Error("Unable to read host fingerprint: %v", err)
+		return false
+	}
+
+	// stores written by older agents (or just imported) are adopted by this host
+	var recorded HostFingerprint
+	if stored == "" || json.Unmarshal([]byte(stored), &recorded) != nil {
+		client.recordHostFingerprint(current)
+		return false
+	}
+
+	if recorded.SameHost(current) {
+		// follow hardware changes such as added network cards
+		if currentBytes, _ := json.Marshal(current); string(currentBytes) != stored {
+			client.recordHostFingerprint(current)
+		}
+		return false
+	}
+
+	policy := strings.ToLower(client.GetConfig().ClonePolicy)
+	if policy != ClonePolicyReinitialize {
+		policy = ClonePolicyReport
+	}
+	client.Log.Error("Key store was created on another host (recorded %+v, current %+v). Clone policy: %s", recorded, current, policy)
+
+	if policy == ClonePolicyReinitialize {
+		client.Log.Info("Discarding copied identity and the data queued under it...")
+		if err := client.LocalDb.ClearAgentData(); err != nil {
+			client.Log.Error("Unable to clear data of the copied identity: %v", err)
+		}
+		if _, err := client.LocalDb.KeyStoreDelete("CloneReported"); err != nil {
+			client.Log.Error("Unable to clear clone report: %v", err)
+		}
+		return true
+	}
+
+	client.CloneDetected = true
+	if client.Offline {
+		return false
+	}
+
+	// report each clone once -- the fingerprint of the host it was reported on is remembered
+	currentBytes, _ := json.Marshal(current)
+	if reported, _ := client.LocalDb.KeyStoreSelect("CloneReported"); reported == string(currentBytes) {
+		client.Log.Debug("Clone has already been reported to the controller")
+		return false
+	}
+
+	uuid, _ := client.LocalDb.KeyStoreSelect("UUID")
+	report, err := json.Marshal(CloneReport{
+		UUID:     uuid,
+		Policy:   policy,
+		Recorded: recorded,
+		Current:  current,
+		Detected: time.Now().UTC(),
+	})
+	if err == nil {
+		err = client.LocalDb.MessageQueueInsertPriority(string(report), CloneURI, PriorityHigh, 0)
+	}
+	if err == nil {
+		err = client.LocalDb.KeyStoreInsert("CloneReported", string(currentBytes))
+	}
+	if err != nil {
+		client.Log.Error("Unable to queue clone report: %v", err)
+	}
+	return false
+}
+
+// recordHostFingerprint stores the fingerprint of the host the key store belongs to
+func (client *Client) recordHostFingerprint(fingerprint HostFingerprint) {
+	fingerprintBytes, err := json.Marshal(fingerprint)
+	if err == nil {
+		err = client.LocalDb.KeyStoreInsert("HostFingerprint", string(fingerprintBytes))
+	}
+	if err != nil {
+		client.Log.Error("Unable to record host fingerprint: %v", err)
+	}
+}
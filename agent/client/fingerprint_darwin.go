@@ -0,0 +1,39 @@
+package client
+
+import (
+	"errors"
+	"os/exec"
+	"strings"
+)
+
+// machineID reads the platform UUID of the Mac
+func machineID() (string, error) {
+	out, err := exec.Command("ioreg", "-rd1", "-c", "IOPlatformExpertDevice").Output()
+	if err != nil {
+		return "", err
+	}
+	for _, line := range strings.Split(string(out), "\n") {
+		// "IOPlatformUUID" = "XXXXXXXX-XXXX-XXXX-XXXX-XXXXXXXXXXXX"
+		if strings.Contains(line, `"IOPlatformUUID"`) {
+			if parts := strings.SplitN(line, "=", 2); len(parts) == 2 {
+				return strings.Trim(strings.TrimSpace(parts[1]), `"`), nil
+			}
+		}
+	}
+	return "", errors.New("no platform UUID found")
+}
+
+// bootDiskID returns the volume UUID of the boot volume
+func bootDiskID() (string, error) {
+	out, err := exec.Command("diskutil", "info", "/").Output()
+	if err != nil {
+		return "", err
+	}
+	for _, line := range strings.Split(string(out), "\n") {
+		line = strings.TrimSpace(line)
+		if strings.HasPrefix(line, "Volume UUID:") {
+			return strings.TrimSpace(strings.TrimPrefix(line, "Volume UUID:")), nil
+		}
+	}
+	return "", errors.New("no volume UUID found")
+}
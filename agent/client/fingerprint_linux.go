@@ -0,0 +1,60 @@
+package client
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/shirou/gopsutil/disk"
+)
+
+// machineID reads the systemd / dbus machine id
+func machineID() (string, error) {
+	for _, path := range []string{"/etc/machine-id", "/var/lib/dbus/machine-id"} {
+		content, err := ioutil.ReadFile(path)
+		if err == nil && strings.TrimSpace(string(content)) != "" {
+			return strings.TrimSpace(string(content)), nil
+		}
+	}
+	return "", errors.New("no machine id found")
+}
+
+// bootDiskID returns the file system UUID of the device mounted at /
+func bootDiskID() (string, error) {
+	partitions, err := disk.Partitions(false)
+	if err != nil {
+		return "", err
+	}
+
+	var device string
+	for _, partition := range partitions {
+		if partition.Mountpoint == "/" {
+			device = partition.Device
+		}
+	}
+	if device == "" {
+		return "", errors.New("root file system not found")
+	}
+	device, err = filepath.EvalSymlinks(device)
+	if err != nil {
+		return "", err
+	}
+
+	// /dev/disk/by-uuid links each file system UUID to its device
+	links, err := ioutil.ReadDir("/dev/disk/by-uuid")
+	if err != nil {
+		return "", err
+	}
+	for _, link := range links {
+		if link.Mode()&os.ModeSymlink == 0 {
+			continue
+		}
+		target, err := filepath.EvalSymlinks(filepath.Join("/dev/disk/by-uuid", link.Name()))
+		if err == nil && target == device {
+			return link.Name(), nil
+		}
+	}
+	return "", errors.New("no UUID found for " + device)
+}
@@ -0,0 +1,34 @@
+package client
+
+import "testing"
+
+func TestHostFingerprintSameHost(t *testing.T) {
+	host := HostFingerprint{MachineID: "4c4c4544-0042", MACs: []string{"00:1a:2b:3c:4d:5e", "00:1a:2b:3c:4d:5f"}, BootDisk: "WD-1234"}
+
+	tests := []struct {
+		name  string
+		other HostFingerprint
+		want  bool
+	}{
+		{"identical", host, true},
+		{"machine id case", HostFingerprint{MachineID: "4C4C4544-0042", MACs: host.MACs, BootDisk: host.BootDisk}, true},
+		{"network card added", HostFingerprint{MachineID: host.MachineID, MACs: []string{"00:1a:2b:3c:4d:5e", "00:99:99:99:99:99"}, BootDisk: host.BootDisk}, true},
+		{"no MACs", HostFingerprint{MachineID: host.MachineID, BootDisk: host.BootDisk}, true},
+		{"machine id unknown", HostFingerprint{MACs: host.MACs, BootDisk: host.BootDisk}, true},
+		{"empty", HostFingerprint{}, true},
+		{"different machine id", HostFingerprint{MachineID: "4c4c4544-0043", MACs: host.MACs, BootDisk: host.BootDisk}, false},
+		{"different boot disk", HostFingerprint{MachineID: host.MachineID, MACs: host.MACs, BootDisk: "WD-9999"}, false},
+		{"no shared MAC", HostFingerprint{MachineID: host.MachineID, MACs: []string{"00:99:99:99:99:99"}, BootDisk: host.BootDisk}, false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if got := host.SameHost(test.other); got != test.want {
+				t.Errorf("SameHost(%+v) = %v, want %v", test.other, got, test.want)
+			}
+			if got := test.other.SameHost(host); got != test.want {
+				t.Errorf("reversed SameHost(%+v) = %v, want %v", test.other, got, test.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,39 @@
+package client
+
+import (
+	"os"
+	"strconv"
+
+	"golang.org/x/sys/windows"
+	"golang.org/x/sys/windows/registry"
+)
+
+// machineID reads the MachineGuid created when Windows is installed
+func machineID() (string, error) {
+	key, err := registry.OpenKey(registry.LOCAL_MACHINE, `SOFTWARE\Microsoft\Cryptography`, registry.QUERY_VALUE|registry.WOW64_64KEY)
+	if err != nil {
+		return "", err
+	}
+	defer key.Close()
+
+	guid, _, err := key.GetStringValue("MachineGuid")
+	return guid, err
+}
+
+// bootDiskID returns the volume serial number of the system drive
+func bootDiskID() (string, error) {
+	drive := os.Getenv("SystemDrive")
+	if drive == "" {
+		drive = "C:"
+	}
+	root, err := windows.UTF16PtrFromString(drive + `\`)
+	if err != nil {
+		return "", err
+	}
+
+	var serial uint32
+	if err := windows.GetVolumeInformation(root, nil, 0, &serial, nil, nil, nil, 0); err != nil {
+		return "", err
+	}
+	return strconv.FormatUint(uint64(serial), 16), nil
+}
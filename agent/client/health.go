@@ -0,0 +1,111 @@
+// Package client health report sent with every check-in
+package client
+
+import (
+	"os"
+	"time"
+
+	"github.com/shirou/gopsutil/process"
+)
+
+// HealthReport struct describes the state of the agent to the controller
+type HealthReport struct {
+	Version              string         `json:"version"`
+	Uptime               int64          `json:"uptime"` // seconds since the agent started
+	BinaryHash           string         `json:"binary_hash"`
+	ConfigHash           string         `json:"config_hash"`
+	QueueDepth           int            `json:"queue_depth"`
+	QueueDropped         int64          `json:"queue_dropped"`          // messages dropped by the rolling queue since the database was created
+	QueueDroppedPriority int64          `json:"queue_dropped_priority"` // of those, messages above normal priority
+	QueueDeadLetters     int            `json:"queue_dead_letters"`     // rejected messages waiting in the dead_letter table
+	DeadLettersDropped   int64          `json:"dead_letters_dropped"`   // rejected messages dropped from a full dead_letter table
+	QueueExpired         int64          `json:"queue_expired"`          // messages that expired before they were delivered
+	Plugins              []PluginHealth `json:"plugins"`
+	RSS                  uint64         `json:"rss"`         // resident memory of the agent process in bytes
+	CPUPercent           float64        `json:"cpu_percent"` // CPU use of the agent process since the previous report
+	LastError            string         `json:"last_error,omitempty"`
+	LastErrorTime        *time.Time     `json:"last_error_time,omitempty"`
+	CloneDetected        bool           `json:"clone_detected,omitempty"` // the key store was created on another host
+}
+
+// PluginHealth struct summarizes the status of a configured plugin
+type PluginHealth struct {
+	UUID          string    `json:"plugin_uuid"`
+	Name          string    `json:"name"`
+	Status        string    `json:"status"`
+	StatusMessage string    `json:"status_message"`
+	LastStart     time.Time `json:"last_start"`
+	LastExit      time.Time `json:"last_exit"`
+}
+
+// HealthReport collects the agent's current health
+// Values that cannot be read are left empty rather than failing the report
+func (client *Client) HealthReport() HealthReport {
+	config := client.GetConfig()
+
+	report := HealthReport{
+		Version:       client.Version,
+		Uptime:        int64(time.Since(client.Started).Seconds()),
+		BinaryHash:    client.BinaryHash,
+		ConfigHash:    client.GetConfigHash(),
+		Plugins:       []PluginHealth{},
+		CloneDetected: client.CloneDetected,
+	}
+
+	// message queue
+	var err error
+	if report.QueueDepth, err = client.LocalDb.MessageQueueDepth(); err != nil {
+		client.Log.Debug("Unable to read message queue depth: %v", err)
+	}
+	if report.QueueDropped, err = client.LocalDb.MessageQueueDropped(); err != nil {
+		client.Log.Debug("Unable to read dropped message count: %v", err)
+	}
+	if report.QueueDroppedPriority, err = client.LocalDb.MessageQueueDroppedPriority(); err != nil {
+		client.Log.Debug("Unable to read dropped priority message count: %v", err)
+	}
+	if report.QueueExpired, err = client.LocalDb.MessageQueueExpired(); err != nil {
+		client.Log.Debug("Unable to read expired message count: %v", err)
+	}
+	if report.QueueDeadLetters, err = client.LocalDb.DeadLetterDepth(); err != nil {
+		client.Log.Debug("Unable to read dead letter count: %v", err)
+	}
+	if report.DeadLettersDropped, err = client.LocalDb.DeadLetterDropped(); err != nil {
+		client.Log.Debug("Unable to read dropped dead letter count: %v", err)
+	}
+
+	// configured plugins
+	for _, plugin := range config.Plugins {
+		p, err := client.LocalDb.PluginSelectUUID(plugin.UUID)
+		if err != nil {
+			client.Log.Debug("Unable to read status of plugin %v(%v): %v", plugin.Name, plugin.UUID, err)
+			continue
+		}
+		report.Plugins = append(report.Plugins, PluginHealth{
+			UUID:          plugin.UUID,
+			Name:          plugin.Name,
+			Status:        p.Status,
+			StatusMessage: p.StatusMessage,
+			LastStart:     p.LastStart,
+			LastExit:      p.LastExit,
+		})
+	}
+
+	// agent process
+	if client.self == nil {
+		client.self = &process.Process{Pid: int32(os.Getpid())}
+	}
+	if memory, err := client.self.MemoryInfo(); err == nil {
+		report.RSS = memory.RSS
+	}
+	if percent, err := client.self.Percent(0); err == nil {
+		report.CPUPercent = percent
+	}
+
+	// last logged error
+	if lastError, lastTime := client.Log.LastError(); lastError != "" {
+		report.LastError = lastError
+		report.LastErrorTime = &lastTime
+	}
+
+	return report
+}
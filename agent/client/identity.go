@@ -0,0 +1,243 @@
+// Package client export and import of the agent identity
+package client
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"ghost/agent/comms"
+	"io"
+	"time"
+
+	"golang.org/x/crypto/pbkdf2"
+)
+
+// identity bundle format, version and key derivation settings
+const (
+	identityBundleFormat     = "ghost-identity"
+	identityBundleVersion    = 1
+	identityBundleKDF        = "pbkdf2-sha256"
+	identityBundleIterations = 600000
+)
+
+// MinIdentityPassphrase is the shortest passphrase an identity bundle can be exported with
+const MinIdentityPassphrase = 12
+
+// Identity struct holds everything that makes an agent known to the controller
+type Identity struct {
+	UUID              string            `json:"uuid"`
+	PublicKey         string            `json:"public_key"`
+	PrivateKey        string            `json:"private_key"`
+	PreviousKey       string            `json:"previous_key,omitempty"`
+	CertName          string            `json:"cert_name"`
+	ClientCertificate string            `json:"client_certificate,omitempty"`
+	Inventory         map[string]string `json:"inventory"` // inventory entries of the key store by key
+	Exported          time.Time         `json:"exported"`
+}
+
+// identityBundle struct is the passphrase encrypted envelope an Identity is exported in
+type identityBundle struct {
+	Format     string `json:"format"`
+	Version    int    `json:"version"`
+	KDF        string `json:"kdf"`
+	Iterations int    `json:"iterations"`
+	Salt       []byte `json:"salt"`
+	Nonce      []byte `json:"nonce"`
+	Ciphertext []byte `json:"ciphertext"` // AES-256-GCM sealed json Identity
+}
+
+// ExportIdentity reads the agent identity from the key store and returns it as a passphrase encrypted bundle
+// The local database must be open and the key store unlocked (see EncryptKeyStore)
+func (client *Client) ExportIdentity(passphrase string) ([]byte, error) {
+	if len(passphrase) < MinIdentityPassphrase {
+		return nil, errors.New("passphrase is too short")
+	}
+
+	identity := Identity{Inventory: make(map[string]string), Exported: time.Now().UTC()}
+	fields := map[string]*string{
+		"UUID":              &identity.UUID,
+		"PublicKey":         &identity.PublicKey,
+		"PrivateKey":        &identity.PrivateKey,
+		"PreviousKey":       &identity.PreviousKey,
+		"CertName":          &identity.CertName,
+		"ClientCertificate": &identity.ClientCertificate,
+	}
+	for key, field := range fields {
+		value, err := client.LocalDb.KeyStoreSelect(key)
+		if err != nil {
+			return nil, err
+		}
+		*field = value
+	}
+	if identity.UUID == "" || identity.PrivateKey == "" {
+		return nil, errors.New("agent has not registered with the controller yet")
+	}
+
+	for _, key := range inventoryKeys {
+		value, err := client.LocalDb.KeyStoreSelect(key)
+		if err != nil {
+			return nil, err
+		}
+		identity.Inventory[key] = value
+	}
+
+	plain, err := json.Marshal(identity)
+	if err != nil {
+		return nil, err
+	}
+
+	bundle := identityBundle{
+		Format:     identityBundleFormat,
+		Version:    identityBundleVersion,
+		KDF:        identityBundleKDF,
+		Iterations: identityBundleIterations,
+		Salt:       make([]byte, 16),
+	}
+	if _, err := io.ReadFull(rand.Reader, bundle.Salt); err != nil {
+		return nil, err
+	}
+
+	gcm, err := bundle.cipher(passphrase)
+	if err != nil {
+		return nil, err
+	}
+	bundle.Nonce = make([]byte, gcm.NonceSize())
+	if _, err := io.ReadFull(rand.Reader, bundle.Nonce); err != nil {
+		return nil, err
+	}
+	bundle.Ciphertext = gcm.Seal(nil, bundle.Nonce, plain, bundle.additionalData())
+
+	return json.MarshalIndent(bundle, "", "  ")
+}
+
+// ImportIdentity restores an exported identity into the key store so the next Bootstrap resumes as that agent
+// An agent that already has a different identity is only replaced when force is set.
+// The local database must be open and the key store unlocked (see EncryptKeyStore)
+func (client *Client) ImportIdentity(bundleBytes []byte, passphrase string, force bool) (Identity, error) {
+	var identity Identity
+
+	var bundle identityBundle
+	if err := json.Unmarshal(bundleBytes, &bundle); err != nil {
+		return identity, errors.New("unable to parse identity bundle: " + err.Error())
+	}
+	if bundle.Format != identityBundleFormat || bundle.Version != identityBundleVersion || bundle.KDF != identityBundleKDF {
+		return identity, errors.New("unsupported identity bundle")
+	}
+	if bundle.Iterations < 1 || bundle.Iterations > 10*identityBundleIterations {
+		return identity, errors.New("identity bundle has an invalid iteration count")
+	}
+
+	gcm, err := bundle.cipher(passphrase)
+	if err != nil {
+		return identity, err
+	}
+	if len(bundle.Nonce) != gcm.NonceSize() {
+		return identity, errors.New("identity bundle has an invalid nonce")
+	}
+	plain, err := gcm.Open(nil, bundle.Nonce, bundle.Ciphertext, bundle.additionalData())
+	if err != nil {
+		return identity, errors.New("unable to decrypt identity bundle: wrong passphrase?")
+	}
+	if err := json.Unmarshal(plain, &identity); err != nil {
+		return identity, errors.New("unable to parse identity: " + err.Error())
+	}
+	if identity.UUID == "" || identity.PrivateKey == "" || identity.PublicKey == "" {
+		return identity, errors.New("identity bundle is incomplete")
+	}
+	if err := checkKeyPair(identity.PrivateKey, identity.PublicKey); err != nil {
+		return identity, err
+	}
+
+	// never silently replace another registered agent
+	currentUUID, err := client.LocalDb.KeyStoreSelect("UUID")
+	if err != nil {
+		return identity, err
+	}
+	if currentUUID != "" && currentUUID != identity.UUID && !force {
+		return identity, errors.New("agent is already registered as " + currentUUID)
+	}
+
+	values := map[string]string{
+		"UUID":              identity.UUID,
+		"PublicKey":         identity.PublicKey,
+		"PrivateKey":        identity.PrivateKey,
+		"PreviousKey":       identity.PreviousKey,
+		"CertName":          identity.CertName,
+		"ClientCertificate": identity.ClientCertificate,
+		"InstallDir":        client.InstallDir,
+		"IsInitialized":     "true",
+	}
+	for _, key := range inventoryKeys {
+		values[key] = identity.Inventory[key]
+	}
+
+	// entries KeyStoreReadIn expects in a fresh key store
+	values["LocalDbName"] = client.LocalDbName
+	if values["Interfaces"] == "" {
+		values["Interfaces"] = "[]"
+	}
+	if localPort, err := client.LocalDb.KeyStoreSelect("LocalPort"); err != nil || localPort == "" {
+		values["LocalPort"] = "0"
+	}
+
+	// all or nothing, a half written identity would mix two agents
+	if err := client.LocalDb.KeyStoreInsertValues(values); err != nil {
+		return identity, err
+	}
+
+	// the restored identity is adopted by this host at the next start (see CheckClone)
+	for _, key := range []string{"HostFingerprint", "CloneReported"} {
+		if _, err := client.LocalDb.KeyStoreDelete(key); err != nil {
+			return identity, err
+		}
+	}
+
+	client.Log.Info("Imported identity of agent %s exported at %v", identity.UUID, identity.Exported)
+	return identity, nil
+}
+
+// checkKeyPair makes sure a pem public key belongs to a pem private key
+func checkKeyPair(privateKey, publicKey string) error {
+	key, err := comms.ParsePrivateKey(privateKey)
+	if err != nil {
+		return errors.New("unable to parse private key: " + err.Error())
+	}
+	der, err := x509.MarshalPKIXPublicKey(key.Public())
+	if err != nil {
+		return err
+	}
+
+	block, _ := pem.Decode([]byte(publicKey))
+	if block == nil || !bytes.Equal(block.Bytes, der) {
+		return errors.New("public key does not belong to the private key")
+	}
+	return nil
+}
+
+// cipher returns the AES-GCM cipher keyed with the passphrase
+func (bundle *identityBundle) cipher(passphrase string) (cipher.AEAD, error) {
+	key := pbkdf2.Key([]byte(passphrase), bundle.Salt, bundle.Iterations, 32, sha256.New)
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// additionalData returns the bundle header authenticated with the ciphertext
+func (bundle *identityBundle) additionalData() []byte {
+	header, _ := json.Marshal(struct {
+		Format     string `json:"format"`
+		Version    int    `json:"version"`
+		KDF        string `json:"kdf"`
+		Iterations int    `json:"iterations"`
+		Salt       []byte `json:"salt"`
+	}{bundle.Format, bundle.Version, bundle.KDF, bundle.Iterations, bundle.Salt})
+	return header
+}
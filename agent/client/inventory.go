@@ -0,0 +1,104 @@
+// Package client periodic inventory of host information
+package client
+
+import (
+	"encoding/json"
+	"sort"
+	"strings"
+	"time"
+)
+
+// DefaultInventoryInterval is how often host information and inventory documents are collected again when no InventoryInterval is configured
+const DefaultInventoryInterval = time.Hour
+
+// InventoryURI is the controller endpoint inventory updates are queued for
+const InventoryURI = "/core/inventory/"
+
+// inventoryKeys maps the facts reported to the controller to their key_store keys
+var inventoryKeys = map[string]string{
+	"hostname":     "Hostname",
+	"domain":       "Domain",
+	"fqdn":         "FQND",
+	"architecture": "Architecture",
+	"os_version":   "OSVersion",
+	"interfaces":   "Interfaces",
+}
+
+// InventoryInterval returns how often host information should be collected
+func (client *Client) InventoryInterval() time.Duration {
+	if seconds := client.GetConfig().InventoryInterval; seconds > 0 {
+		return time.Second * time.Duration(seconds)
+	}
+	return DefaultInventoryInterval
+}
+
+// Inventory returns the host facts reported to the controller
+func (client *Client) Inventory() map[string]string {
+	client.hostMutex.RLock()
+	defer client.hostMutex.RUnlock()
+
+	interfaces, _ := json.Marshal(client.Interfaces)
+
+	return map[string]string{
+		"hostname":     client.Hostname,
+		"domain":       client.Domain,
+		"fqdn":         client.FQDN,
+		"architecture": client.Architecture,
+		"os_version":   client.OSVersion,
+		"interfaces":   string(interfaces),
+	}
+}
+
+// RefreshInventory collects host information again and compares it with the values in the key store
+// If anything changed the changed facts are updated in the key store and an inventory update is queued for the controller
+// Returns the current facts and the names of the facts that changed
+func (client *Client) RefreshInventory() (map[string]string, []string, error) {
+	client.inventoryMutex.Lock()
+	defer client.inventoryMutex.Unlock()
+
+	client.CollectHostInfo()
+	facts := client.Inventory()
+
+	// diff against the stored facts
+	var changed []string
+	for fact, key := range inventoryKeys {
+		stored, err := client.LocalDb.KeyStoreSelect(key)
+		if err != nil {
+			return facts, nil, err
+		}
+		if stored != facts[fact] {
+			changed = append(changed, fact)
+		}
+	}
+	if len(changed) == 0 {
+		return facts, nil, nil
+	}
+	sort.Strings(changed)
+	client.Log.Info("Host information changed: %s", strings.Join(changed, ", "))
+
+	// only the facts are written, the rest of the key store is left alone
+	for _, fact := range changed {
+		if err := client.LocalDb.KeyStoreInsert(inventoryKeys[fact], facts[fact]); err != nil {
+			return facts, changed, err
+		}
+	}
+
+	// report the change
+	if !client.Offline {
+		update := make(map[string]string)
+		for fact, value := range facts {
+			update[fact] = value
+		}
+		update["changed"] = strings.Join(changed, ",")
+
+		msgBytes, err := json.Marshal(update)
+		if err != nil {
+			return facts, changed, err
+		}
+		if err := client.LocalDb.MessageQueueInsert(string(msgBytes), InventoryURI); err != nil {
+			return facts, changed, err
+		}
+	}
+
+	return facts, changed, nil
+}
@@ -0,0 +1,361 @@
+// Package client structured host inventory documents
+package client
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/shirou/gopsutil/cpu"
+	"github.com/shirou/gopsutil/disk"
+	"github.com/shirou/gopsutil/host"
+	"github.com/shirou/gopsutil/mem"
+	psnet "github.com/shirou/gopsutil/net"
+	"github.com/shirou/gopsutil/process"
+)
+
+// InventoryDocumentURI is the controller endpoint inventory documents are queued for
+const InventoryDocumentURI = "/core/inventorydocument/"
+
+// errNoPackageDatabase is returned when no supported package database is found
+var errNoPackageDatabase = errors.New("no supported package database found")
+
+// InventoryDocument struct holds the facts of one inventory type (cpu, memory, disks ...)
+// Volatile values such as free space are left out so a document only changes when the host does
+type InventoryDocument struct {
+	Type      string      `json:"type"`
+	Hash      string      `json:"hash"` // sha256 of the json encoded data
+	Collected time.Time   `json:"collected"`
+	Data      interface{} `json:"data"`
+}
+
+// CPUInventory struct describes the processors of the host
+type CPUInventory struct {
+	Model         string `json:"model"`
+	Vendor        string `json:"vendor"`
+	PhysicalCores int    `json:"physical_cores"`
+	LogicalCores  int    `json:"logical_cores"`
+}
+
+// MemoryInventory struct describes the memory of the host
+type MemoryInventory struct {
+	Total     uint64 `json:"total"`
+	SwapTotal uint64 `json:"swap_total"`
+}
+
+// DiskInventory struct describes a mounted file system
+type DiskInventory struct {
+	Device     string `json:"device"`
+	Mountpoint string `json:"mountpoint"`
+	FSType     string `json:"fstype"`
+	Total      uint64 `json:"total"`
+}
+
+// HostInventory struct describes the operating system of the host
+type HostInventory struct {
+	BootTime             time.Time `json:"boot_time"`
+	OS                   string    `json:"os"`
+	Platform             string    `json:"platform"`
+	PlatformFamily       string    `json:"platform_family"`
+	PlatformVersion      string    `json:"platform_version"`
+	KernelVersion        string    `json:"kernel_version"`
+	KernelArch           string    `json:"kernel_arch"`
+	VirtualizationSystem string    `json:"virtualization_system"`
+	VirtualizationRole   string    `json:"virtualization_role"`
+	HostID               string    `json:"host_id"`
+}
+
+// UserInventory struct describes a logged in user session
+type UserInventory struct {
+	User     string    `json:"user"`
+	Terminal string    `json:"terminal"`
+	Host     string    `json:"host"`
+	Started  time.Time `json:"started"`
+}
+
+// PackageInventory struct describes an installed package
+type PackageInventory struct {
+	Name    string `json:"name"`
+	Version string `json:"version"`
+	Arch    string `json:"arch"`
+	Source  string `json:"source"` // package database, e.g. "dpkg" or "rpm"
+}
+
+// SocketInventory struct describes a listening socket
+type SocketInventory struct {
+	Protocol string `json:"protocol"` // tcp, tcp6, udp or udp6
+	Address  string `json:"address"`
+	Port     uint32 `json:"port"`
+	Process  string `json:"process"`
+}
+
+// inventoryCollectors collect the data of each inventory document type
+var inventoryCollectors = map[string]func() (interface{}, error){
+	"cpu":       collectCPUInventory,
+	"memory":    collectMemoryInventory,
+	"disks":     collectDiskInventory,
+	"host":      collectHostInventory,
+	"users":     collectUserInventory,
+	"packages":  collectPackageInventory,
+	"listening": collectSocketInventory,
+}
+
+// CollectInventoryDocuments collects every inventory document type
+// Types that cannot be collected on this host are logged and left out
+func (client *Client) CollectInventoryDocuments() []InventoryDocument {
+	var docs []InventoryDocument
+
+	for _, docType := range inventoryDocumentTypes() {
+		data, err := inventoryCollectors[docType]()
+		if err != nil {
+			client.Log.Debug("Unable to collect %s inventory: %v", docType, err)
+			continue
+		}
+
+		dataBytes, err := json.Marshal(data)
+		if err != nil {
+			client.Log.Error("Unable to serialize %s inventory: %v", docType, err)
+			continue
+		}
+		sum := sha256.Sum256(dataBytes)
+
+		docs = append(docs, InventoryDocument{
+			Type:      docType,
+			Hash:      hex.EncodeToString(sum[:]),
+			Collected: time.Now().UTC(),
+			Data:      data,
+		})
+	}
+	return docs
+}
+
+// RefreshInventoryDocuments collects the inventory documents and queues the ones that changed since they were last sent
+// Returns the types of the documents queued
+func (client *Client) RefreshInventoryDocuments() ([]string, error) {
+	client.inventoryMutex.Lock()
+	defer client.inventoryMutex.Unlock()
+
+	var changed []string
+	for _, doc := range client.CollectInventoryDocuments() {
+		// the hash of the last document sent of each type is kept in the key store
+		key := "InventoryHash." + doc.Type
+		lastHash, err := client.LocalDb.KeyStoreSelect(key)
+		if err != nil {
+			return changed, err
+		}
+		if lastHash == doc.Hash {
+			continue
+		}
+
+		if !client.Offline {
+			msgBytes, err := json.Marshal(doc)
+			if err != nil {
+				return changed, err
+			}
+			if err := client.LocalDb.MessageQueueInsert(string(msgBytes), InventoryDocumentURI); err != nil {
+				return changed, err
+			}
+		}
+		if err := client.LocalDb.KeyStoreInsert(key, doc.Hash); err != nil {
+			return changed, err
+		}
+		changed = append(changed, doc.Type)
+	}
+
+	if len(changed) > 0 {
+		client.Log.Info("Inventory changed: %s", strings.Join(changed, ", "))
+	}
+	return changed, nil
+}
+
+// inventoryDocumentTypes returns the inventory document types in a stable order
+func inventoryDocumentTypes() []string {
+	var types []string
+	for docType := range inventoryCollectors {
+		types = append(types, docType)
+	}
+	sort.Strings(types)
+	return types
+}
+
+// collectCPUInventory describes the processors
+func collectCPUInventory() (interface{}, error) {
+	infos, err := cpu.Info()
+	if err != nil {
+		return nil, err
+	}
+
+	inv := CPUInventory{}
+	if len(infos) > 0 {
+		inv.Model = infos[0].ModelName
+		inv.Vendor = infos[0].VendorID
+	}
+	inv.PhysicalCores, _ = cpu.Counts(false)
+	inv.LogicalCores, err = cpu.Counts(true)
+
+	return inv, err
+}
+
+// collectMemoryInventory describes memory and swap
+func collectMemoryInventory() (interface{}, error) {
+	virtual, err := mem.VirtualMemory()
+	if err != nil {
+		return nil, err
+	}
+
+	inv := MemoryInventory{Total: virtual.Total}
+	if swap, err := mem.SwapMemory(); err == nil {
+		inv.SwapTotal = swap.Total
+	}
+	return inv, nil
+}
+
+// collectDiskInventory describes the mounted physical file systems
+func collectDiskInventory() (interface{}, error) {
+	partitions, err := disk.Partitions(false)
+	if err != nil {
+		return nil, err
+	}
+
+	inv := []DiskInventory{}
+	for _, partition := range partitions {
+		entry := DiskInventory{Device: partition.Device, Mountpoint: partition.Mountpoint, FSType: partition.Fstype}
+		if usage, err := disk.Usage(partition.Mountpoint); err == nil {
+			entry.Total = usage.Total
+		}
+		inv = append(inv, entry)
+	}
+
+	sort.Slice(inv, func(i, j int) bool { return inv[i].Mountpoint < inv[j].Mountpoint })
+	return inv, nil
+}
+
+// collectHostInventory describes the operating system
+func collectHostInventory() (interface{}, error) {
+	info, err := host.Info()
+	if err != nil {
+		return nil, err
+	}
+
+	return HostInventory{
+		BootTime:             time.Unix(int64(info.BootTime), 0).UTC(),
+		OS:                   info.OS,
+		Platform:             info.Platform,
+		PlatformFamily:       info.PlatformFamily,
+		PlatformVersion:      info.PlatformVersion,
+		KernelVersion:        info.KernelVersion,
+		KernelArch:           info.KernelArch,
+		VirtualizationSystem: info.VirtualizationSystem,
+		VirtualizationRole:   info.VirtualizationRole,
+		HostID:               info.HostID,
+	}, nil
+}
+
+// collectUserInventory describes the logged in user sessions
+func collectUserInventory() (interface{}, error) {
+	users, err := host.Users()
+	if err != nil {
+		return nil, err
+	}
+
+	inv := []UserInventory{}
+	for _, user := range users {
+		inv = append(inv, UserInventory{
+			User:     user.User,
+			Terminal: user.Terminal,
+			Host:     user.Host,
+			Started:  time.Unix(int64(user.Started), 0).UTC(),
+		})
+	}
+
+	sort.Slice(inv, func(i, j int) bool {
+		return inv[i].User+inv[i].Terminal < inv[j].User+inv[j].Terminal
+	})
+	return inv, nil
+}
+
+// collectPackageInventory describes the installed packages
+func collectPackageInventory() (interface{}, error) {
+	packages, err := installedPackages()
+	if err != nil {
+		return nil, err
+	}
+
+	sort.Slice(packages, func(i, j int) bool {
+		if packages[i].Name != packages[j].Name {
+			return packages[i].Name < packages[j].Name
+		}
+		return packages[i].Arch < packages[j].Arch
+	})
+	return packages, nil
+}
+
+// collectSocketInventory describes the listening tcp sockets and bound udp sockets
+func collectSocketInventory() (interface{}, error) {
+	conns, err := psnet.Connections("inet")
+	if err != nil {
+		return nil, err
+	}
+
+	// process names by pid
+	names := make(map[int32]string)
+
+	seen := make(map[SocketInventory]bool)
+	inv := []SocketInventory{}
+	for _, conn := range conns {
+		protocol := socketProtocol(conn)
+		if protocol == "" {
+			continue
+		}
+
+		// tcp sockets in LISTEN state and udp sockets without a peer
+		if strings.HasPrefix(protocol, "tcp") && conn.Status != "LISTEN" {
+			continue
+		}
+		if strings.HasPrefix(protocol, "udp") && conn.Raddr.Port != 0 {
+			continue
+		}
+
+		name, ok := names[conn.Pid]
+		if !ok && conn.Pid > 0 {
+			if proc, err := process.NewProcess(conn.Pid); err == nil {
+				name, _ = proc.Name()
+			}
+			names[conn.Pid] = name
+		}
+
+		socket := SocketInventory{Protocol: protocol, Address: conn.Laddr.IP, Port: conn.Laddr.Port, Process: name}
+		if !seen[socket] {
+			seen[socket] = true
+			inv = append(inv, socket)
+		}
+	}
+
+	sort.Slice(inv, func(i, j int) bool {
+		return fmt.Sprintf("%s %05d %s", inv[i].Protocol, inv[i].Port, inv[i].Address) < fmt.Sprintf("%s %05d %s", inv[j].Protocol, inv[j].Port, inv[j].Address)
+	})
+	return inv, nil
+}
+
+// socketProtocol names the protocol of a connection ("" if neither tcp nor udp)
+func socketProtocol(conn psnet.ConnectionStat) string {
+	var protocol string
+	switch conn.Type {
+	case 1: // SOCK_STREAM
+		protocol = "tcp"
+	case 2: // SOCK_DGRAM
+		protocol = "udp"
+	default:
+		return ""
+	}
+
+	if strings.Contains(conn.Laddr.IP, ":") {
+		protocol += "6"
+	}
+	return protocol
+}
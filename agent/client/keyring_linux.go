@@ -0,0 +1,37 @@
+package client
+
+import (
+	"encoding/base64"
+	"errors"
+
+	"golang.org/x/sys/unix"
+)
+
+// readKeyringKey reads a base64 key encryption key from a "user" key in the user keyring
+func readKeyringKey(description string) ([]byte, error) {
+	id, err := unix.KeyctlSearch(unix.KEY_SPEC_USER_KEYRING, "user", description, 0)
+	if err != nil {
+		return nil, errors.New("unable to find key " + description + " in the user keyring: " + err.Error())
+	}
+
+	buf := make([]byte, 256)
+	n, err := unix.KeyctlBuffer(unix.KEYCTL_READ, id, buf, 0)
+	if err != nil {
+		return nil, errors.New("unable to read key " + description + " from the user keyring: " + err.Error())
+	}
+	if n > len(buf) {
+		return nil, errors.New("key " + description + " in the user keyring is too long")
+	}
+
+	kek, err := parseKeyEncryptionKey(string(buf[:n]))
+	if err != nil {
+		return nil, errors.New("key " + description + ": " + err.Error())
+	}
+	return kek, nil
+}
+
+// writeKeyringKey adds (or replaces) a base64 key encryption key as a "user" key in the user keyring
+func writeKeyringKey(description string, kek []byte) error {
+	_, err := unix.AddKey("user", description, []byte(base64.StdEncoding.EncodeToString(kek)), unix.KEY_SPEC_USER_KEYRING)
+	return err
+}
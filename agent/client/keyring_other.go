@@ -0,0 +1,20 @@
+//go:build !linux
+
+package client
+
+import "errors"
+
+// errNoKeyring is returned when the key encryption key source is the Linux kernel keyring
+var errNoKeyring = errors.New("the kernel keyring key source is only supported on Linux")
+
+// readKeyringKey reads the key encryption key from the kernel keyring
+// The kernel keyring is only available on Linux
+func readKeyringKey(description string) ([]byte, error) {
+	return nil, errNoKeyring
+}
+
+// writeKeyringKey adds a key encryption key to the kernel keyring
+// The kernel keyring is only available on Linux
+func writeKeyringKey(description string, kek []byte) error {
+	return errNoKeyring
+}
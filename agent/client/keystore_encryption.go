@@ -0,0 +1,371 @@
+// Package client at-rest encryption of sensitive key store entries
+package client
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+)
+
+// Sources of the key store's key encryption key (KEK)
+const (
+	KeySourceFile    = "file"    // root-only key file, created on first use (default)
+	KeySourceEnv     = "env"     // GHOST_KEYSTORE_KEY environment variable
+	KeySourceKeyring = "keyring" // "ghost:keystore" user key in the Linux kernel keyring
+)
+
+// KeyStoreKeyEnv is the environment variable the key encryption key is passed in (base64, 32 bytes)
+const KeyStoreKeyEnv = "GHOST_KEYSTORE_KEY"
+
+// KeyStoreNewKeyEnv passes the replacement key encryption key to --rekey-store for the env and keyring sources
+const KeyStoreNewKeyEnv = "GHOST_KEYSTORE_NEW_KEY"
+
+// DefaultKeyStoreKeyFile is the key file used when no KeyStoreKeyFile is configured (relative to the install directory)
+const DefaultKeyStoreKeyFile = "keystore.key"
+
+// KeyStoreKeyringDescription is the description of the key encryption key in the kernel keyring
+const KeyStoreKeyringDescription = "ghost:keystore"
+
+// encryptedPrefix marks encrypted key store values: enc:v1:<base64 of AES-256-GCM nonce and sealed value>
+const encryptedPrefix = "enc:v1:"
+
+// sensitiveKeys are the key store entries encrypted at rest
+var sensitiveKeys = map[string]bool{
+	"PrivateKey":  true,
+	"PreviousKey": true,
+}
+
+// SetKeyEncryptionKey sets the key sensitive key store entries are encrypted with
+// Entries already stored in plain text stay readable and are encrypted when next written
+func (db *Database) SetKeyEncryptionKey(kek []byte) {
+	db.kek = kek
+}
+
+// EncryptKeyStore loads the key encryption key from the configured source and encrypts
+// sensitive entries still stored in plain text (stores written by older agents)
+func (client *Client) EncryptKeyStore() error {
+	kek, err := client.loadKeyEncryptionKey()
+	if err != nil {
+		return err
+	}
+	client.LocalDb.SetKeyEncryptionKey(kek)
+
+	// reading every entry makes sure the key matches the store
+	var migrated int
+	for key := range sensitiveKeys {
+		raw, err := client.LocalDb.KeyStoreSelectRaw(key)
+		if err != nil {
+			return err
+		}
+		if raw == "" {
+			continue
+		}
+		if isSealed(raw) {
+			if _, err := openKeyStoreValue(kek, key, raw); err != nil {
+				return err
+			}
+			continue
+		}
+		if err := client.LocalDb.KeyStoreInsert(key, raw); err != nil {
+			return err
+		}
+		migrated++
+	}
+
+	// plain text values may linger in free pages of the database file
+	if migrated > 0 {
+		if err := client.LocalDb.Vacuum(); err != nil {
+			client.Log.Error("Unable to vacuum local database after encrypting key store: %v", err)
+		}
+		client.Log.Info("Encrypted %d key store entries", migrated)
+	}
+	return nil
+}
+
+// RekeyStore re-encrypts the sensitive key store entries with a new key encryption key
+// The file source generates the new key; the env and keyring sources take it from GHOST_KEYSTORE_NEW_KEY.
+// The agent must not be running
+func (client *Client) RekeyStore() error {
+	if err := client.OpenLocalDb(); err != nil {
+		return err
+	}
+	defer client.LocalDb.Close()
+
+	if err := client.EncryptKeyStore(); err != nil {
+		return err
+	}
+
+	source := client.keyStoreKeySource()
+	var newKEK []byte
+	var err error
+	if source == KeySourceFile {
+		newKEK, err = newKeyEncryptionKey()
+	} else {
+		newKEK, err = parseKeyEncryptionKey(os.Getenv(KeyStoreNewKeyEnv))
+		if err != nil {
+			err = errors.New(KeyStoreNewKeyEnv + ": " + err.Error())
+		}
+	}
+	if err != nil {
+		return err
+	}
+
+	// decrypt everything before anything is written
+	values := make(map[string]string)
+	for key := range sensitiveKeys {
+		value, err := client.LocalDb.KeyStoreSelect(key)
+		if err != nil {
+			return err
+		}
+		if value == "" {
+			continue
+		}
+		if values[key], err = sealKeyStoreValue(newKEK, key, value); err != nil {
+			return err
+		}
+	}
+
+	switch source {
+	case KeySourceFile:
+		// the new key is staged next to the old one until the store is committed, see loadKeyEncryptionKey
+		path := client.keyStoreKeyPath()
+		if err := writeKeyFile(path+".new", newKEK); err != nil {
+			return err
+		}
+		if err := client.LocalDb.KeyStoreUpdateRaw(values); err != nil {
+			os.Remove(path + ".new")
+			return err
+		}
+		if err := os.Rename(path+".new", path); err != nil {
+			return err
+		}
+	case KeySourceEnv:
+		if err := client.LocalDb.KeyStoreUpdateRaw(values); err != nil {
+			return err
+		}
+		client.Log.Info("Key store rekeyed. Start the agent with %s set to the new key", KeyStoreKeyEnv)
+	case KeySourceKeyring:
+		if err := client.LocalDb.KeyStoreUpdateRaw(values); err != nil {
+			return err
+		}
+		if err := writeKeyringKey(KeyStoreKeyringDescription, newKEK); err != nil {
+			return errors.New("key store was rekeyed but the new key could not be added to the keyring: " + err.Error())
+		}
+		client.Log.Info("Key store rekeyed. Update the provisioning of the %q keyring key", KeyStoreKeyringDescription)
+	}
+
+	client.LocalDb.SetKeyEncryptionKey(newKEK)
+	client.Log.Info("Re-encrypted %d key store entries", len(values))
+	return nil
+}
+
+// OpenLocalDb opens the agent's database in the install directory
+func (client *Client) OpenLocalDb() error {
+	client.LocalDbName = filepath.Join(client.InstallDir, "ghost.db") //TODO: Make generic
+	client.LocalDb = Database{Name: client.LocalDbName}
+	return client.LocalDb.Init()
+}
+
+// keyStoreKeySource returns the configured key encryption key source
+func (client *Client) keyStoreKeySource() string {
+	source := strings.ToLower(client.GetConfig().KeyStoreKeySource)
+	if source == "" {
+		source = KeySourceFile
+	}
+	return source
+}
+
+// keyStoreKeyPath returns the path of the key file
+func (client *Client) keyStoreKeyPath() string {
+	path := client.GetConfig().KeyStoreKeyFile
+	if path == "" {
+		path = DefaultKeyStoreKeyFile
+	}
+	if !filepath.IsAbs(path) {
+		path = filepath.Join(client.InstallDir, path)
+	}
+	return path
+}
+
+// loadKeyEncryptionKey reads the key encryption key from the configured source
+// A missing key file is created unless the store already holds encrypted entries
+func (client *Client) loadKeyEncryptionKey() ([]byte, error) {
+	switch client.keyStoreKeySource() {
+	case KeySourceEnv:
+		kek, err := parseKeyEncryptionKey(os.Getenv(KeyStoreKeyEnv))
+		if err != nil {
+			return nil, errors.New(KeyStoreKeyEnv + ": " + err.Error())
+		}
+		// plugins started by the agent must not inherit the key
+		os.Unsetenv(KeyStoreKeyEnv)
+		return kek, nil
+	case KeySourceKeyring:
+		return readKeyringKey(KeyStoreKeyringDescription)
+	case KeySourceFile:
+	default:
+		return nil, errors.New("unknown KeyStoreKeySource " + client.GetConfig().KeyStoreKeySource)
+	}
+
+	path := client.keyStoreKeyPath()
+
+	// finish a rekey interrupted after the store was committed
+	if staged, err := readKeyFile(path + ".new"); err == nil {
+		raw, err := client.LocalDb.KeyStoreSelectRaw("PrivateKey")
+		if err != nil {
+			return nil, err
+		}
+		if _, err := openKeyStoreValue(staged, "PrivateKey", raw); isSealed(raw) && err == nil {
+			client.Log.Info("Completing interrupted key store rekey...")
+			if err := os.Rename(path+".new", path); err != nil {
+				return nil, err
+			}
+			return staged, nil
+		}
+		os.Remove(path + ".new")
+	}
+
+	kek, err := readKeyFile(path)
+	if err == nil || !os.IsNotExist(err) {
+		return kek, err
+	}
+
+	// a lost key file cannot be replaced once entries are encrypted
+	for key := range sensitiveKeys {
+		raw, err := client.LocalDb.KeyStoreSelectRaw(key)
+		if err != nil {
+			return nil, err
+		}
+		if isSealed(raw) {
+			return nil, errors.New("key store is encrypted but key file " + path + " does not exist")
+		}
+	}
+
+	if kek, err = newKeyEncryptionKey(); err != nil {
+		return nil, err
+	}
+	client.Log.Info("Creating key store key file %s", path)
+	return kek, writeKeyFile(path, kek)
+}
+
+// readKeyFile reads a base64 key encryption key from a file only its owner can access
+func readKeyFile(path string) ([]byte, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+	if runtime.GOOS != "windows" && info.Mode().Perm()&0077 != 0 {
+		return nil, errors.New("key file " + path + " must only be accessible by its owner")
+	}
+
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	kek, err := parseKeyEncryptionKey(string(content))
+	if err != nil {
+		return nil, errors.New("key file " + path + ": " + err.Error())
+	}
+	return kek, nil
+}
+
+// writeKeyFile writes a key encryption key to a file only its owner can access
+func writeKeyFile(path string, kek []byte) error {
+	tmp := path + ".part"
+	file, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	_, err = file.WriteString(base64.StdEncoding.EncodeToString(kek) + "\n")
+	if err == nil {
+		err = file.Sync()
+	}
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// newKeyEncryptionKey returns a random 256 bit key
+func newKeyEncryptionKey() ([]byte, error) {
+	kek := make([]byte, 32)
+	if _, err := io.ReadFull(rand.Reader, kek); err != nil {
+		return nil, err
+	}
+	return kek, nil
+}
+
+// parseKeyEncryptionKey decodes a base64 256 bit key
+func parseKeyEncryptionKey(encoded string) ([]byte, error) {
+	encoded = strings.TrimSpace(encoded)
+	if encoded == "" {
+		return nil, errors.New("no key encryption key set")
+	}
+	kek, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil {
+		return nil, errors.New("key encryption key is not valid base64")
+	}
+	if len(kek) != 32 {
+		return nil, errors.New("key encryption key must be 32 bytes")
+	}
+	return kek, nil
+}
+
+// isSealed reports whether a key store value is encrypted
+func isSealed(value string) bool {
+	return strings.HasPrefix(value, encryptedPrefix)
+}
+
+// sealKeyStoreValue encrypts a key store value with AES-256-GCM
+// The key name is authenticated with the value so sealed values cannot be swapped between keys
+func sealKeyStoreValue(kek []byte, key, value string) (string, error) {
+	gcm, err := newKeyStoreCipher(kek)
+	if err != nil {
+		return "", err
+	}
+
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return "", err
+	}
+	sealed := gcm.Seal(nonce, nonce, []byte(value), []byte(key))
+	return encryptedPrefix + base64.StdEncoding.EncodeToString(sealed), nil
+}
+
+// openKeyStoreValue decrypts a value sealed by sealKeyStoreValue
+func openKeyStoreValue(kek []byte, key, value string) (string, error) {
+	gcm, err := newKeyStoreCipher(kek)
+	if err != nil {
+		return "", err
+	}
+
+	sealed, err := base64.StdEncoding.DecodeString(strings.TrimPrefix(value, encryptedPrefix))
+	if err != nil || len(sealed) < gcm.NonceSize() {
+		return "", errors.New("key store entry " + key + " is not a valid encrypted value")
+	}
+	plain, err := gcm.Open(nil, sealed[:gcm.NonceSize()], sealed[gcm.NonceSize():], []byte(key))
+	if err != nil {
+		return "", errors.New("unable to decrypt key store entry " + key + ": wrong key encryption key?")
+	}
+	return string(plain), nil
+}
+
+// newKeyStoreCipher returns the AES-GCM cipher of a key encryption key
+func newKeyStoreCipher(kek []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(kek)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
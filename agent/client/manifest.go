@@ -0,0 +1,193 @@
+// Package client signed update manifests
+package client
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"ghost/agent/comms"
+	"runtime"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ArtifactResource is the manifest kind of plugin resource files
+const ArtifactResource = "resource"
+
+// Manifest struct lists the artifacts (binaries, configurations and resource files) the controller may push to agents
+// Manifests are signed with the update signing key (or the controller's certificate if none is configured)
+type Manifest struct {
+	Version   int64      `json:"version"` // increases with every published manifest -- older manifests are refused
+	Expires   time.Time  `json:"expires"`
+	Artifacts []Artifact `json:"artifacts"`
+}
+
+// Artifact struct describes a single file covered by a manifest
+type Artifact struct {
+	Kind    string `json:"kind"` // UpdateBinary, UpdateConfig or ArtifactResource
+	SHA256  string `json:"sha256"`
+	OS      string `json:"os,omitempty"`      // target GOOS (required for binaries)
+	Arch    string `json:"arch,omitempty"`    // target GOARCH (required for binaries)
+	Version string `json:"version,omitempty"` // version of the artifact (e.g. agent version of a binary)
+}
+
+// signedManifest struct is the envelope a manifest is delivered in
+// The signature covers the exact bytes of Manifest
+type signedManifest struct {
+	Manifest  string `json:"manifest"`
+	Signature string `json:"signature"`           // base64 encoded
+	Algorithm string `json:"algorithm,omitempty"` // signature algorithm, RS256 if empty
+}
+
+// Covers reports whether the manifest lists an artifact of the given kind and hash for this platform
+// Binaries must name the OS and architecture they target; other artifacts may leave them empty to cover every platform
+func (m Manifest) Covers(kind, hash string) bool {
+	for _, artifact := range m.Artifacts {
+		if artifact.Kind != kind || !strings.EqualFold(artifact.SHA256, hash) {
+			continue
+		}
+		if artifact.Kind == UpdateBinary && (artifact.OS == "" || artifact.Arch == "") {
+			continue
+		}
+		if artifact.OS != "" && artifact.OS != runtime.GOOS {
+			continue
+		}
+		if artifact.Arch != "" && artifact.Arch != runtime.GOARCH {
+			continue
+		}
+		return true
+	}
+	return false
+}
+
+// VerifyArtifact checks that an artifact is covered by a valid signed manifest before it is downloaded
+// Binaries must also name the running OS and architecture as their target
+func (client *Client) VerifyArtifact(kind, hash string) error {
+	manifest, err := client.GetManifest()
+	if err != nil {
+		return errors.New("no valid update manifest: " + err.Error())
+	}
+
+	if !manifest.Covers(kind, hash) {
+		return fmt.Errorf("%s %s is not covered by update manifest version %v", kind, hash, manifest.Version)
+	}
+
+	return nil
+}
+
+// GetManifest retrieves the current update manifest from the controller
+// The last accepted manifest is used if the controller's manifest cannot be retrieved or is not valid
+func (client *Client) GetManifest() (Manifest, error) {
+	fetchErr := errors.New("offline")
+	if !client.Offline {
+		var resp string
+		resp, fetchErr = client.Sender.Send([]byte(""), "/core/manifest/")
+		if fetchErr == nil {
+			manifest, err := client.acceptManifest(resp)
+			if err == nil {
+				return manifest, nil
+			}
+			fetchErr = err
+		}
+		client.Log.Error("Unable to get update manifest from controller: %v", fetchErr)
+	}
+
+	// fall back to the last accepted manifest
+	stored, err := client.LocalDb.KeyStoreSelect("UpdateManifest")
+	if err != nil {
+		return Manifest{}, err
+	}
+	if stored == "" {
+		return Manifest{}, fetchErr
+	}
+
+	return client.parseManifest(stored)
+}
+
+// acceptManifest verifies a manifest envelope received from the controller and stores it as the last accepted manifest
+func (client *Client) acceptManifest(envelope string) (Manifest, error) {
+	manifest, err := client.parseManifest(envelope)
+	if err != nil {
+		return manifest, err
+	}
+
+	// refuse replays of older manifests
+	storedVersion, err := client.LocalDb.KeyStoreSelect("UpdateManifestVersion")
+	if err != nil {
+		return manifest, err
+	}
+	if storedVersion != "" {
+		lastVersion, err := strconv.ParseInt(storedVersion, 10, 64)
+		if err == nil && manifest.Version < lastVersion {
+			return manifest, fmt.Errorf("manifest version %v is older than accepted version %v", manifest.Version, lastVersion)
+		}
+	}
+
+	if err := client.LocalDb.KeyStoreInsert("UpdateManifest", envelope); err != nil {
+		return manifest, err
+	}
+	if err := client.LocalDb.KeyStoreInsert("UpdateManifestVersion", strconv.FormatInt(manifest.Version, 10)); err != nil {
+		return manifest, err
+	}
+
+	return manifest, nil
+}
+
+// parseManifest verifies the signature and expiry of a manifest envelope and returns the manifest
+func (client *Client) parseManifest(envelope string) (Manifest, error) {
+	var manifest Manifest
+
+	var signed signedManifest
+	if err := json.Unmarshal([]byte(envelope), &signed); err != nil {
+		return manifest, errors.New("unable to parse manifest envelope: " + err.Error())
+	}
+
+	sigBytes, err := base64.StdEncoding.DecodeString(signed.Signature)
+	if err != nil {
+		return manifest, errors.New("unable to decode manifest signature: " + err.Error())
+	}
+
+	// verify against the update signing key, falling back to the controller certificate
+	config := client.GetConfig()
+	signingKey := config.UpdateSigningKey
+	if signingKey == "" {
+		signingKey = config.ServerCertificate
+	}
+	if err := verifySignature(signingKey, signed.Algorithm, []byte(signed.Manifest), sigBytes); err != nil {
+		return manifest, errors.New("manifest signature is not valid: " + err.Error())
+	}
+
+	if err := json.Unmarshal([]byte(signed.Manifest), &manifest); err != nil {
+		return manifest, errors.New("unable to parse manifest: " + err.Error())
+	}
+
+	if time.Now().After(manifest.Expires) {
+		return manifest, fmt.Errorf("manifest version %v expired at %v", manifest.Version, manifest.Expires)
+	}
+
+	return manifest, nil
+}
+
+// verifySignature checks a signature of data made with algorithm (RS256 if empty)
+// keyPEM may hold a certificate, a PKIX public key or a PKCS #1 public key
+func verifySignature(keyPEM, algorithm string, data, signature []byte) error {
+	publicKey, err := comms.ParsePublicKey(keyPEM)
+	if err != nil {
+		return errors.New("unable to parse signing key: " + err.Error())
+	}
+
+	return comms.Verify(publicKey, algorithm, data, signature)
+}
+
+// VerifySHA256 checks downloaded content against the hash it was requested by
+func VerifySHA256(content []byte, hash string) error {
+	sum := sha256.Sum256(content)
+	if got := hex.EncodeToString(sum[:]); !strings.EqualFold(got, hash) {
+		return fmt.Errorf("mismatched hashes: wanted: %s got: %s", hash, got)
+	}
+	return nil
+}
@@ -0,0 +1,129 @@
+package client
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"ghost/agent/comms"
+	"runtime"
+	"testing"
+	"time"
+)
+
+func TestManifestCovers(t *testing.T) {
+	manifest := Manifest{Artifacts: []Artifact{
+		{Kind: UpdateBinary, SHA256: "aaaa", OS: runtime.GOOS, Arch: runtime.GOARCH},
+		{Kind: UpdateBinary, SHA256: "bbbb", OS: "plan9", Arch: runtime.GOARCH},
+		{Kind: UpdateBinary, SHA256: "cccc", OS: runtime.GOOS, Arch: "mips"},
+		{Kind: UpdateBinary, SHA256: "dddd"},
+		{Kind: UpdateBinary, SHA256: "eeee", OS: runtime.GOOS},
+		{Kind: UpdateConfig, SHA256: "ffff"},
+		{Kind: ArtifactResource, SHA256: "1111", OS: "plan9"},
+	}}
+
+	tests := []struct {
+		name string
+		kind string
+		hash string
+		want bool
+	}{
+		{"binary for this platform", UpdateBinary, "aaaa", true},
+		{"hash case", UpdateBinary, "AAAA", true},
+		{"binary for another OS", UpdateBinary, "bbbb", false},
+		{"binary for another architecture", UpdateBinary, "cccc", false},
+		{"binary without platform", UpdateBinary, "dddd", false},
+		{"binary without architecture", UpdateBinary, "eeee", false},
+		{"config for every platform", UpdateConfig, "ffff", true},
+		{"resource for another OS", ArtifactResource, "1111", false},
+		{"wrong kind", UpdateConfig, "aaaa", false},
+		{"not listed", UpdateBinary, "9999", false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if got := manifest.Covers(test.kind, test.hash); got != test.want {
+				t.Errorf("Covers(%s, %s) = %v, want %v", test.kind, test.hash, got, test.want)
+			}
+		})
+	}
+}
+
+// signManifestEnvelope signs a manifest with key and returns the envelope the controller would send
+func signManifestEnvelope(t *testing.T, key *rsa.PrivateKey, manifest Manifest) signedManifest {
+	manifestBytes, err := json.Marshal(manifest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	hashed := sha256.Sum256(manifestBytes)
+	signature, err := rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256, hashed[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	return signedManifest{Manifest: string(manifestBytes), Signature: base64.StdEncoding.EncodeToString(signature)}
+}
+
+func TestParseManifest(t *testing.T) {
+	signingKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	otherKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	publicBytes, err := x509.MarshalPKIXPublicKey(&signingKey.PublicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	client := &Client{Config: Config{UpdateSigningKey: string(pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: publicBytes}))}}
+
+	valid := Manifest{Version: 3, Expires: time.Now().Add(time.Hour), Artifacts: []Artifact{{Kind: UpdateConfig, SHA256: "ffff"}}}
+	expired := valid
+	expired.Expires = time.Now().Add(-time.Minute)
+
+	tampered := signManifestEnvelope(t, signingKey, valid)
+	tampered.Manifest = `{"version":4` + tampered.Manifest[len(`{"version":3`):]
+
+	wrongAlgorithm := signManifestEnvelope(t, signingKey, valid)
+	wrongAlgorithm.Algorithm = comms.AlgPS256
+
+	tests := []struct {
+		name     string
+		envelope signedManifest
+		wantErr  bool
+	}{
+		{"valid", signManifestEnvelope(t, signingKey, valid), false},
+		{"expired", signManifestEnvelope(t, signingKey, expired), true},
+		{"signed with another key", signManifestEnvelope(t, otherKey, valid), true},
+		{"tampered", tampered, true},
+		{"wrong algorithm", wrongAlgorithm, true},
+		{"unsigned", signedManifest{Manifest: tampered.Manifest}, true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			envelope, err := json.Marshal(test.envelope)
+			if err != nil {
+				t.Fatal(err)
+			}
+			manifest, err := client.parseManifest(string(envelope))
+			if (err != nil) != test.wantErr {
+				t.Fatalf("parseManifest error = %v, want error %v", err, test.wantErr)
+			}
+			if err == nil && (manifest.Version != valid.Version || !manifest.Covers(UpdateConfig, "ffff")) {
+				t.Errorf("parseManifest = %+v, want %+v", manifest, valid)
+			}
+		})
+	}
+}
+
+func TestParseManifestNotJSON(t *testing.T) {
+	if _, err := (&Client{}).parseManifest("not a manifest"); err == nil {
+		t.Error("parseManifest accepted a malformed envelope")
+	}
+}
@@ -0,0 +1,114 @@
+package client
+
+import (
+	"bufio"
+	"os"
+	"os/exec"
+	"strings"
+)
+
+// location of the dpkg status database
+const dpkgStatusPath = "/var/lib/dpkg/status"
+
+// location of the rpm database
+const rpmDbPath = "/var/lib/rpm"
+
+// installedPackages lists the packages in the dpkg and rpm databases
+func installedPackages() ([]PackageInventory, error) {
+	packages := []PackageInventory{}
+	found := false
+
+	if _, err := os.Stat(dpkgStatusPath); err == nil {
+		dpkg, err := dpkgPackages(dpkgStatusPath)
+		if err != nil {
+			return nil, err
+		}
+		packages = append(packages, dpkg...)
+		found = true
+	}
+
+	if _, err := os.Stat(rpmDbPath); err == nil {
+		if rpm, err := rpmPackages(); err == nil {
+			packages = append(packages, rpm...)
+			found = true
+		} else if !found {
+			return nil, err
+		}
+	}
+
+	if !found {
+		return nil, errNoPackageDatabase
+	}
+	return packages, nil
+}
+
+// dpkgPackages parses the installed packages from a dpkg status file
+func dpkgPackages(path string) ([]PackageInventory, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	var packages []PackageInventory
+	var pkg PackageInventory
+	installed := false
+
+	// records are separated by blank lines
+	flush := func() {
+		if pkg.Name != "" && installed {
+			pkg.Source = "dpkg"
+			packages = append(packages, pkg)
+		}
+		pkg = PackageInventory{}
+		installed = false
+	}
+
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if line == "" {
+			flush()
+			continue
+		}
+
+		field := strings.SplitN(line, ":", 2)
+		if len(field) != 2 || strings.HasPrefix(line, " ") {
+			continue // continuation lines
+		}
+		value := strings.TrimSpace(field[1])
+
+		switch field[0] {
+		case "Package":
+			pkg.Name = value
+		case "Version":
+			pkg.Version = value
+		case "Architecture":
+			pkg.Arch = value
+		case "Status":
+			installed = strings.HasSuffix(value, " installed")
+		}
+	}
+	flush()
+
+	return packages, scanner.Err()
+}
+
+// rpmPackages lists the installed packages with the rpm command
+func rpmPackages() ([]PackageInventory, error) {
+	out, err := exec.Command("rpm", "-qa", "--queryformat", "%{NAME}\\t%{VERSION}-%{RELEASE}\\t%{ARCH}\\n").Output()
+	if err != nil {
+		return nil, err
+	}
+
+	var packages []PackageInventory
+	for _, line := range strings.Split(string(out), "\n") {
+		field := strings.Split(line, "\t")
+		if len(field) != 3 || field[0] == "" || strings.HasPrefix(field[0], "gpg-pubkey") {
+			continue
+		}
+		packages = append(packages, PackageInventory{Name: field[0], Version: field[1], Arch: field[2], Source: "rpm"})
+	}
+	return packages, nil
+}
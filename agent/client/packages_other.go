@@ -0,0 +1,9 @@
+//go:build !linux
+
+package client
+
+// installedPackages lists installed packages
+// Package databases are only read on Linux
+func installedPackages() ([]PackageInventory, error) {
+	return nil, errNoPackageDatabase
+}
@@ -1,18 +1,23 @@
 package client
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
 	"io/ioutil"
 	"os"
 	"os/exec"
 	"path/filepath"
+	"reflect"
 	"strings"
 	"time"
 
 	ps "github.com/mitchellh/go-ps"
 )
 
+// pluginLogTTL is how long queued plugin output waits for delivery before it is dropped
+const pluginLogTTL = time.Hour * 24 * 7
+
 // Plugin struct
 type Plugin struct {
 	Name             string         `yaml:"Name" json:"name"`
@@ -89,7 +94,8 @@ func (p Plugin) QueuePluginLog(client *Client) error {
 			return err
 		}
 
-		if err := client.LocalDb.MessageQueueInsert(string(msgBytes), "/core/pluginlog/"); err != nil {
+		// routine output gives way to status changes and reports when the queue is full
+		if err := client.LocalDb.MessageQueueInsertPriority(string(msgBytes), "/core/pluginlog/", PriorityLow, pluginLogTTL); err != nil {
 			return err
 		}
 	}
@@ -132,9 +138,65 @@ func (p Plugin) IsRunning(client *Client) (bool, error) {
 	return true, nil
 }
 
+// Kill terminates the plugin's process if it is running
+// The process is only killed if its name matches the one stored in the database
+// The plugin struct only needs the UUID member set as this method check the key_store for other values
+func (p Plugin) Kill(client *Client) error {
+	// get stored plugin from database
+	storedPlugin, err := client.LocalDb.PluginSelectUUID(p.UUID)
+	if err != nil {
+		return err
+	}
+	if storedPlugin.ProcessID == 0 {
+		return nil
+	}
+
+	// get process
+	proc, _ := ps.FindProcess(storedPlugin.ProcessID)
+
+	// if a process was returned ... kill it
+	// but only if process name matches the one stored in the database
+	if proc == nil || proc.Executable() != storedPlugin.ProcessName {
+		return nil
+	}
+
+	// get real process using the os package
+	process, err := os.FindProcess(proc.Pid())
+	if err != nil {
+		return err
+	}
+
+	// resume first in case the process is suspended by a throttle
+	ResumeProcess(proc.Pid())
+	return process.Kill()
+}
+
+// SameDefinition reports whether two plugins have the same configuration
+// Runtime members (status, process information, etc.) are ignored
+func (p Plugin) SameDefinition(other Plugin) bool {
+	return reflect.DeepEqual(p.definition(), other.definition())
+}
+
+// definition returns a copy of the plugin with only the members set from configuration
+func (p Plugin) definition() Plugin {
+	return Plugin{
+		Name:             p.Name,
+		Mode:             p.Mode,
+		LaunchFrequency:  p.LaunchFrequency,
+		UUID:             p.UUID,
+		WorkingDirectory: p.WorkingDirectory,
+		Command:          p.Command,
+		Args:             p.Args,
+		ResourceFiles:    p.ResourceFiles,
+		CPULimit:         p.CPULimit,
+		RetryFailure:     p.RetryFailure,
+	}
+}
+
 // VerifyHashes checks hashes for all resource files associated with a plugin
 // Returns true if all resources files for a plugin are verify
-func (p Plugin) VerifyHashes(client *Client) bool {
+// Downloads of missing resource files are abandoned if ctx is cancelled
+func (p Plugin) VerifyHashes(ctx context.Context, client *Client) bool {
 	// get working directory
 	wd := filepath.Join(client.InstallDir, p.WorkingDirectory)
 
@@ -144,6 +206,9 @@ func (p Plugin) VerifyHashes(client *Client) bool {
 		return false
 	}
 
+	// resource files in use by this plugin -- referenced blobs are kept by the blob store's garbage collection
+	refs := make(map[string]string)
+
 	// process each resource file
 	for _, resourceFile := range p.ResourceFiles {
 		resourcePath := filepath.Join(wd, resourceFile.Path)
@@ -155,17 +220,10 @@ func (p Plugin) VerifyHashes(client *Client) bool {
 
 		// check hash
 		if strings.ToLower(hash) != strings.ToLower(resourceFile.Hash) {
-			// if offline, return false
-			if client.Offline {
-				client.Log.Error("Mismatched hashes: name: %s wanted: %s got: %s", resourcePath, resourceFile.Hash, hash)
-				return false
-			}
-
-			// attempt to get correct file from server
-			client.Log.Info("Resource file %s hash on disk does not match configuration. Downloading update...", resourcePath)
-			fileBytes, err := client.Sender.GetResource(strings.ToLower(resourceFile.Hash))
-			if err != nil {
-				client.Log.Error("Unable to retrieve new resource file: %s", err)
+			// get correct file from the blob store (downloading it only if no other plugin or version already has)
+			client.Log.Info("Resource file %s hash on disk does not match configuration. Updating from blob store...", resourcePath)
+			if _, err := client.EnsureBlob(ctx, resourceFile.Hash); err != nil {
+				client.Log.Error("Unable to retrieve new resource file %s: %s", resourcePath, err)
 				return false
 			}
 
@@ -176,8 +234,8 @@ func (p Plugin) VerifyHashes(client *Client) bool {
 				return false
 			}
 
-			// write new file to disk
-			if err := ioutil.WriteFile(resourcePath, fileBytes, 0755); err != nil {
+			// copy new file into the working directory
+			if err := client.CopyBlob(resourceFile.Hash, resourcePath); err != nil {
 				client.Log.Error("Unable to write resource file to disk: %s", err)
 				return false
 			}
@@ -195,28 +253,37 @@ func (p Plugin) VerifyHashes(client *Client) bool {
 				client.Log.Error("Mismatched hashes: name: %s wanted: %s got: %s", resourcePath, resourceFile.Hash, newHash)
 				return false
 			}
+		} else if err := client.AddBlob(resourcePath, resourceFile.Hash); err != nil {
+			// keep a copy of files from before the blob store so they can be restored without a download
+			client.Log.Error("Unable to add resource file %s to blob store: %s", resourcePath, err)
 		}
 
+		refs[resourceFile.Path] = resourceFile.Hash
 		client.Log.Debug("Resource file hash verified: %s %s", resourceFile.Path, hash)
 	}
 
+	if err := client.LocalDb.BlobRefReplace(p.UUID, refs); err != nil {
+		client.Log.Error("Unable to record blob references of plugin %v(%v): %s", p.Name, p.UUID, err)
+	}
+
 	// made it -- all file are verified
 	return true
 }
 
 // LaunchBinary method launches a plugin binary
 // Should be executed from seperate goroutine to prevent blocking
-// INPUT ch is an channel used to indicate when the plugin has been launched
+// INPUT ctx is the agent's run context. If cancelled the plugin is released (left running) rather than waited on
+// ch is an channel used to indicate when the plugin has been launched
 // client is client object passed by pointer
 // manager is the PID of the current plugin manager.  It's needed for plugin management resuming
-func (p Plugin) LaunchBinary(ch chan int, client *Client, manager int) {
+func (p Plugin) LaunchBinary(ctx context.Context, ch chan int, client *Client, manager int) {
 	var err error
 	//defer channgel send to ensure function won't block in case of error
 	defer func() { ch <- 0 }()
 
 	// verify hashes from configuration file
 	if !client.Debug {
-		if !p.VerifyHashes(client) {
+		if !p.VerifyHashes(ctx, client) {
 			p.SetError(client, "unable to verify hashes")
 			return
 		}
@@ -271,25 +338,31 @@ func (p Plugin) LaunchBinary(ch chan int, client *Client, manager int) {
 	}
 
 	// throttle process
-	quit := make(chan int)
-	if p.CPULimit > 0 {
-		go MonitorCpu(quit, cmd.Process.Pid, p.CPULimit)
+	stopThrottle := p.startThrottle(cmd.Process.Pid)
+
+	// wait for process to exit in the background so agent shutdown can be observed
+	var errMsg []byte
+	exited := make(chan error, 1)
+	go func() {
+		// Uncomment these lines to log all output from plugin
+		errMsg, _ = ioutil.ReadAll(stderr)
+		// client.Log.Debug("Stderr: %s", errMsg)
+		// slurp, _ := ioutil.ReadAll(stdout)
+		// client.Log.Debug("Stdout: %s", slurp)
+		exited <- cmd.Wait()
+	}()
+
+	select {
+	case err = <-exited:
+	case <-ctx.Done():
+		// agent is shutting down -- leave the plugin running for the next manager to resume
+		stopThrottle()
+		p.release(client)
+		return
 	}
 
-	// Uncomment these lines to log all output from plugin
-	errMsg, _ := ioutil.ReadAll(stderr)
-	// client.Log.Debug("Stderr: %s", errMsg)
-	// slurp, _ := ioutil.ReadAll(stdout)
-	// client.Log.Debug("Stdout: %s", slurp)
-
-	// wait for process to exit
-
-	err = cmd.Wait()
-
-	// stop throttling by sending message to queue
-	if p.CPULimit > 0 {
-		quit <- 0
-	}
+	// stop throttling
+	stopThrottle()
 
 	// check for errors and update status
 	if err != nil {
@@ -308,14 +381,15 @@ func (p Plugin) LaunchBinary(ch chan int, client *Client, manager int) {
 
 // ResumePlugin takes back control over a plugin that was left running when agent exited and started again
 // Should be executed from seperate goroutine to prevent blocking
-// INPUT ch is an channel used to indicate when the plugin has been resumed
+// INPUT ctx is the agent's run context. If cancelled the plugin is released (left running) again
+// ch is an channel used to indicate when the plugin has been resumed
 // client is client object passed by pointer
 // manager is the PID of agent's current plugin manager.  It's needed for plugin management resuming
 
 //This function resumes monitoring the plugin process until the process exits
 //However, it can't tell if the plugin was successful or not since it no longer has
 //access to the exec.Command structure
-func (p Plugin) ResumePlugin(ch chan int, client *Client, manager int) {
+func (p Plugin) ResumePlugin(ctx context.Context, ch chan int, client *Client, manager int) {
 	var err error
 	//defer channgel send to ensure function won't block in case of error
 	defer func() { ch <- 0 }()
@@ -342,10 +416,7 @@ func (p Plugin) ResumePlugin(ch chan int, client *Client, manager int) {
 	ch <- 0
 
 	// throttle process
-	quit := make(chan int)
-	if p.CPULimit > 0 {
-		go MonitorCpu(quit, p.ProcessID, p.CPULimit)
-	}
+	stopThrottle := p.startThrottle(p.ProcessID)
 
 	// wait for process to exit
 	// Need to store the current PID because IsRunning will still return true if the plugin exits and then the plugin_manager restarts it
@@ -362,19 +433,23 @@ func (p Plugin) ResumePlugin(ch chan int, client *Client, manager int) {
 			client.Log.Error("%v", err)
 			break
 		}
-		if isRunning && currentPID == p.ProcessID {
-			time.Sleep(time.Second * 30) //check again in 30 seconds
-		} else {
+		if !isRunning || currentPID != p.ProcessID {
 			break
 		}
+
+		//check again in 30 seconds
+		if !client.Sleep(ctx, time.Second*30) {
+			// agent is shutting down -- leave the plugin running for the next manager to resume
+			stopThrottle()
+			p.release(client)
+			return
+		}
 	}
 
 	//Once we get here, the plugin with PID 'currentPID' is no longer running and we can stop monitoring it
 
-	// stop throttling by sending message to queue
-	if p.CPULimit > 0 {
-		quit <- 0
-	}
+	// stop throttling
+	stopThrottle()
 
 	//We can't mark this as complete because we don't know the status after we do a resume
 
@@ -387,3 +462,41 @@ func (p Plugin) ResumePlugin(ch chan int, client *Client, manager int) {
 	p.Status = "exited after monitoring resumed"
 	p.QueuePluginLog(client)
 }
+
+// startThrottle starts CPU throttling of the plugin process if the plugin has a CPU limit
+// Returns a function that stops throttling and blocks until the monitor has exited,
+// guaranteeing the throttle is no longer suspending the process
+func (p Plugin) startThrottle(pid int) func() {
+	quit := make(chan int)
+	done := make(chan struct{})
+
+	if p.CPULimit > 0 {
+		go func() {
+			defer close(done)
+			MonitorCpu(quit, pid, p.CPULimit)
+		}()
+	} else {
+		close(done)
+	}
+
+	return func() {
+		close(quit)
+		<-done
+	}
+}
+
+// release hands a still running plugin back to the system when the agent shuts down
+// The process is resumed in case it was suspended and the plugins table records how it was left
+// so the next plugin manager can resume managing it
+func (p Plugin) release(client *Client) {
+	if err := ResumeProcess(p.ProcessID); err != nil {
+		client.Log.Error("Unable to resume plugin %v(%v) PID %v: %v", p.Name, p.UUID, p.ProcessID, err)
+	}
+
+	client.Log.Info("Releasing plugin %v(%v) PID %v at agent shutdown", p.Name, p.UUID, p.ProcessID)
+	p.Status = "running"
+	p.StatusMessage = "left running at agent shutdown"
+	if err := p.UpdateStatus(client); err != nil {
+		client.Log.Error("Unable to record plugin status for %v(%v): %v", p.Name, p.UUID, err)
+	}
+}
@@ -0,0 +1,260 @@
+// Package client update health tracking and rollback
+package client
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"time"
+)
+
+// Update kinds
+const (
+	UpdateBinary = "binary"
+	UpdateConfig = "config"
+)
+
+// DefaultUpdateHealthWindow is the time an update has to prove itself healthy when none is configured
+const DefaultUpdateHealthWindow = time.Minute * 5
+
+// Update struct describes a binary or configuration update that has not yet proven itself healthy
+type Update struct {
+	Kind         string    `json:"kind"`          // UpdateBinary or UpdateConfig
+	Hash         string    `json:"hash"`          // sha256 of the new file
+	PreviousHash string    `json:"previous_hash"` // sha256 of the backup file
+	Path         string    `json:"path"`          // file being updated
+	BackupPath   string    `json:"backup_path"`   // copy of the last known good file
+	Started      time.Time `json:"started"`
+	Deadline     time.Time `json:"deadline"` // rolled back if not healthy by this time
+}
+
+// BeginUpdate records a pending update before the file at path is replaced with a file hashing to newHash
+// The current file is backed up to <path>.bak if it is the last known good file (or no backup exists yet)
+func (db *Database) BeginUpdate(kind, path, newHash string, window time.Duration) error {
+	backupPath := path + ".bak"
+
+	currentHash, err := FileSHA256(path)
+	if err != nil {
+		return err
+	}
+
+	// only replace the backup with a file that is known to work
+	lastKnownGood, err := db.KeyStoreSelect("LastKnownGood." + kind)
+	if err != nil {
+		return err
+	}
+	if _, err := os.Stat(backupPath); os.IsNotExist(err) || strings.EqualFold(currentHash, lastKnownGood) {
+		if err := CopyFile(path, backupPath); err != nil {
+			return errors.New("unable to back up " + path + ": " + err.Error())
+		}
+	}
+
+	previousHash, err := FileSHA256(backupPath)
+	if err != nil {
+		return err
+	}
+
+	now := time.Now().UTC()
+	update := Update{
+		Kind:         kind,
+		Hash:         strings.ToLower(newHash),
+		PreviousHash: previousHash,
+		Path:         path,
+		BackupPath:   backupPath,
+		Started:      now,
+		Deadline:     now.Add(window),
+	}
+
+	updateBytes, err := json.Marshal(update)
+	if err != nil {
+		return err
+	}
+	return db.KeyStoreInsert("PendingUpdate."+kind, string(updateBytes))
+}
+
+// PendingUpdates returns all updates that have not yet been confirmed healthy
+func (db *Database) PendingUpdates() ([]Update, error) {
+	var updates []Update
+
+	keys, err := db.KeyStoreGetSubkeys("PendingUpdate.")
+	if err != nil {
+		return updates, err
+	}
+
+	for _, key := range keys {
+		data, err := db.KeyStoreSelect(key)
+		if err != nil {
+			return updates, err
+		}
+
+		var update Update
+		if err := json.Unmarshal([]byte(data), &update); err != nil {
+			return updates, errors.New("unable to parse " + key + ": " + err.Error())
+		}
+		updates = append(updates, update)
+	}
+
+	return updates, nil
+}
+
+// UpdateFailed reports whether an update to hash was previously rolled back
+// Failed updates are not applied again until the controller asks for a different file
+func (db *Database) UpdateFailed(kind, hash string) (bool, error) {
+	failedHash, err := db.KeyStoreSelect("FailedUpdate." + kind)
+	if err != nil {
+		return false, err
+	}
+	return failedHash != "" && strings.EqualFold(failedHash, hash), nil
+}
+
+// RollbackUpdate restores the last known good file of a failed update
+// The failed file is kept as <path>.failed, its hash is recorded so it is not applied again
+// and a report is queued for the controller
+func (db *Database) RollbackUpdate(update Update, reason string) error {
+	// keep the failed file for investigation
+	failedPath := update.Path + ".failed"
+	os.Remove(failedPath)
+	if err := os.Rename(update.Path, failedPath); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	// restore the backup (keeping the backup itself in place)
+	if err := CopyFile(update.BackupPath, update.Path); err != nil {
+		return errors.New("unable to restore " + update.Path + ": " + err.Error())
+	}
+
+	if err := db.KeyStoreInsert("FailedUpdate."+update.Kind, update.Hash); err != nil {
+		return err
+	}
+	if _, err := db.KeyStoreDelete("PendingUpdate." + update.Kind); err != nil {
+		return err
+	}
+
+	// report rollback to the controller
+	report := map[string]string{
+		"event":         "rollback",
+		"kind":          update.Kind,
+		"failed_hash":   update.Hash,
+		"restored_hash": update.PreviousHash,
+		"reason":        reason,
+		"started":       update.Started.Format(time.RFC3339Nano),
+		"timestamp":     time.Now().UTC().Format(time.RFC3339Nano),
+	}
+	reportBytes, err := json.Marshal(report)
+	if err != nil {
+		return err
+	}
+	return db.MessageQueueInsertPriority(string(reportBytes), "/core/agentlog/", PriorityHigh, 0)
+}
+
+// MarkHealthy records the running binary and configuration as last known good and confirms pending updates to them
+// Called once the agent has bootstrapped, checked in with the controller and is writing heartbeats
+func (client *Client) MarkHealthy() {
+	running := map[string]string{
+		UpdateBinary: client.BinaryHash,
+		UpdateConfig: client.GetConfigHash(),
+	}
+
+	for kind, hash := range running {
+		// nothing to do if already recorded by this process
+		if client.healthy[kind] == hash {
+			continue
+		}
+
+		if err := client.LocalDb.KeyStoreInsert("LastKnownGood."+kind, hash); err != nil {
+			client.Log.Error("Unable to record last known good %s: %v", kind, err)
+			continue
+		}
+
+		// confirm pending update
+		pending, err := client.LocalDb.KeyStoreSelect("PendingUpdate." + kind)
+		if err != nil {
+			client.Log.Error("Unable to read pending %s update: %v", kind, err)
+			continue
+		}
+		var update Update
+		if pending != "" && json.Unmarshal([]byte(pending), &update) == nil && strings.EqualFold(update.Hash, hash) {
+			client.LocalDb.KeyStoreDelete("PendingUpdate." + kind)
+			client.Log.Info("Client %s update to %s is healthy", kind, hash)
+		}
+
+		if client.healthy == nil {
+			client.healthy = make(map[string]string)
+		}
+		client.healthy[kind] = hash
+	}
+}
+
+// BeginConfigUpdate records a pending configuration update before the configuration file is overwritten
+// The update is rolled back by the nanny if the agent is not healthy within the configured UpdateHealthWindow
+func (client *Client) BeginConfigUpdate(newHash string) error {
+	window := DefaultUpdateHealthWindow
+	if seconds := client.GetConfig().UpdateHealthWindow; seconds > 0 {
+		window = time.Second * time.Duration(seconds)
+	}
+
+	return client.LocalDb.BeginUpdate(UpdateConfig, client.ConfigPath, newHash, window)
+}
+
+// BinaryUpdateFailed reports whether the configured binary was previously rolled back
+func (client *Client) BinaryUpdateFailed() bool {
+	failed, err := client.LocalDb.UpdateFailed(UpdateBinary, client.GetConfig().BinaryHash)
+	if err != nil {
+		client.Log.Error("Unable to read failed updates: %v", err)
+	}
+	if failed {
+		client.Log.Warn("Configured client binary %s was rolled back after failing. Waiting for a different binary...", client.GetConfig().BinaryHash)
+	}
+	return failed
+}
+
+// ConfigUpdateFailed reports whether a configuration was previously rolled back
+func (client *Client) ConfigUpdateFailed(hash string) bool {
+	failed, err := client.LocalDb.UpdateFailed(UpdateConfig, hash)
+	if err != nil {
+		client.Log.Error("Unable to read failed updates: %v", err)
+	}
+	if failed {
+		client.Log.Warn("Required configuration %s was rolled back after failing. Waiting for a different configuration...", hash)
+	}
+	return failed
+}
+
+// String returns a short description of the update for logging
+func (u Update) String() string {
+	return fmt.Sprintf("%s update %s -> %s", u.Kind, u.PreviousHash, u.Hash)
+}
+
+// CopyFile copies src to dst through a temporary file so dst is never left partially written
+func CopyFile(src, dst string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	info, err := in.Stat()
+	if err != nil {
+		return err
+	}
+
+	tmp := dst + ".tmp"
+	out, err := os.OpenFile(tmp, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, info.Mode())
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		os.Remove(tmp)
+		return err
+	}
+	if err := out.Close(); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+
+	return os.Rename(tmp, dst)
+}
@@ -0,0 +1,189 @@
+// Package client controller initiated key rotation
+package client
+
+import (
+	"bytes"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"ghost/agent/comms"
+	"strings"
+)
+
+// RotateKeysURI is the controller endpoint new key pairs are posted to
+const RotateKeysURI = "/core/rotate/"
+
+// RotateKeys replaces the agent's key pair
+// The new public key is signed with the current key and posted to the controller (the request itself is signed with the current key).
+// The agent only switches to the new key once the controller acknowledges it. The current key is kept as PreviousKey
+// and used again if the controller refuses the new key, until the first signed exchange with the new key succeeds
+// A rotation the controller never confirms has to be undone with RollbackKeys before the next one
+// Returns the new public key
+func (client *Client) RotateKeys() (string, error) {
+	client.keyMutex.Lock()
+	defer client.keyMutex.Unlock()
+
+	if client.PreviousKey != "" {
+		return "", errors.New("previous key rotation has not been confirmed by the controller yet (roll it back first)")
+	}
+
+	// RSA agents move to the configured key type once the controller verifies its algorithm
+	keyType := client.GetConfig().KeyType
+	if !client.Sender.AcceptsAlgorithm(keyTypeAlgorithm(keyType)) {
+		client.Log.Info("Controller does not accept %s signatures. Rotating to a new RSA key", keyType)
+		keyType = KeyTypeRSA
+	}
+
+	publicKey, privateKey, err := GenerateKeyPair(keyType)
+	if err != nil {
+		return "", err
+	}
+
+	// request a client certificate for the new key at the same time
+	csr, err := createCSR(privateKey, client.UUID, []string{client.hostFQDN()})
+	if err != nil {
+		return "", err
+	}
+
+	signature, algorithm := client.Sender.SignData([]byte(publicKey))
+	message := map[string]string{
+		"public_key":                     publicKey,
+		"public_key_signature":           base64.StdEncoding.EncodeToString(signature),
+		"public_key_signature_algorithm": algorithm,
+		"csr":                            csr,
+	}
+	jsonStr, err := json.Marshal(message)
+	if err != nil {
+		return "", err
+	}
+
+	resp, err := client.Sender.Send(jsonStr, RotateKeysURI)
+	if err != nil {
+		return "", errors.New("unable to post new public key: " + err.Error())
+	}
+
+	respMap := make(map[string]string)
+	if err := json.Unmarshal([]byte(resp), &respMap); err != nil {
+		return "", errors.New("unable to parse key rotation response: " + err.Error())
+	}
+	if respMap["status"] != "rotated" {
+		return "", errors.New("controller did not acknowledge the new key: " + respMap["status"])
+	}
+
+	// a certificate for the old key cannot be presented with the new one
+	certPEM := respMap["client_certificate"]
+	if certPEM != "" {
+		cert, err := parseClientCertificate(certPEM)
+		block, _ := pem.Decode([]byte(publicKey))
+		if err != nil || block == nil || !bytes.Equal(block.Bytes, cert.RawSubjectPublicKeyInfo) {
+			client.Log.Error("Client certificate issued with the new key is not valid. A new one will be requested")
+			certPEM = ""
+		}
+	}
+
+	// keep the old key until the new one is confirmed
+	// (stored together so a crash cannot leave the new private key without the old one)
+	err = client.LocalDb.KeyStoreInsertValues(map[string]string{
+		"PreviousKey":       client.PrivateKey,
+		"PrivateKey":        privateKey,
+		"PublicKey":         publicKey,
+		"ClientCertificate": certPEM,
+	})
+	if err != nil {
+		return "", err
+	}
+
+	// switch
+	client.PreviousKey = client.PrivateKey
+	client.PrivateKey = privateKey
+	client.PublicKey = publicKey
+	client.ClientCertificate = certPEM
+	if err := client.Sender.SetClientKey(privateKey, publicKey, certPEM); err != nil {
+		return "", err
+	}
+
+	client.Log.Info("Switched to new key pair. Waiting for the controller to accept it...")
+	return publicKey, nil
+}
+
+// keyTypeAlgorithm returns the signature algorithm keys of a type are signed with (RS256 for RSA)
+func keyTypeAlgorithm(keyType string) string {
+	switch strings.ToLower(keyType) {
+	case KeyTypeECDSA:
+		return comms.AlgES256
+	case KeyTypeEd25519:
+		return comms.AlgEdDSA
+	}
+	return comms.AlgRS256
+}
+
+// RollbackKeys switches back to the key pair replaced by a rotation the controller has not confirmed,
+// e.g. when the controller keeps refusing the new key. The client certificate issued for the new key is dropped
+// (a new one is requested for the restored key)
+// Returns the restored public key
+func (client *Client) RollbackKeys() (string, error) {
+	client.keyMutex.Lock()
+	defer client.keyMutex.Unlock()
+
+	if client.PreviousKey == "" {
+		return "", errors.New("no unconfirmed key rotation to roll back")
+	}
+
+	publicKey, err := publicKeyPEM(client.PreviousKey)
+	if err != nil {
+		return "", err
+	}
+
+	err = client.LocalDb.KeyStoreInsertValues(map[string]string{
+		"PreviousKey":       "",
+		"PrivateKey":        client.PreviousKey,
+		"PublicKey":         publicKey,
+		"CertName":          "",
+		"ClientCertificate": "",
+	})
+	if err != nil {
+		return "", err
+	}
+
+	client.PrivateKey = client.PreviousKey
+	client.PublicKey = publicKey
+	client.PreviousKey = ""
+	client.CertName = ""
+	client.ClientCertificate = ""
+	if err := client.Sender.RollbackClientKey(publicKey); err != nil {
+		return "", err
+	}
+
+	client.Log.Info("Rolled back to the previous key pair")
+	return publicKey, nil
+}
+
+// publicKeyPEM returns the pem public key of a pem private key
+func publicKeyPEM(privateKey string) (string, error) {
+	key, err := comms.ParsePrivateKey(privateKey)
+	if err != nil {
+		return "", errors.New("unable to parse private key: " + err.Error())
+	}
+
+	der, err := x509.MarshalPKIXPublicKey(key.Public())
+	if err != nil {
+		return "", errors.New("unable to create public key: " + err.Error())
+	}
+
+	return string(pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der})), nil
+}
+
+// keyConfirmed forgets the previous key once the controller has accepted a rotated key
+// Called by the sender (once it is unlocked)
+func (client *Client) keyConfirmed() {
+	client.keyMutex.Lock()
+	defer client.keyMutex.Unlock()
+
+	client.PreviousKey = ""
+	if err := client.LocalDb.KeyStoreInsert("PreviousKey", ""); err != nil {
+		client.Log.Error("Unable to remove previous key: %v", err)
+	}
+	client.Log.Info("Controller accepted the new key pair")
+}
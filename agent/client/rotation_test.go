@@ -0,0 +1,65 @@
+package client
+
+import (
+	"ghost/agent/comms"
+	"ghost/agent/logger"
+	"path/filepath"
+	"testing"
+)
+
+func TestRollbackKeys(t *testing.T) {
+	for _, keyType := range []string{KeyTypeRSA, KeyTypeECDSA, KeyTypeEd25519} {
+		t.Run(keyType, func(t *testing.T) {
+			previousPublic, previous, err := GenerateKeyPair(keyType)
+			if err != nil {
+				t.Fatal(err)
+			}
+			_, current, err := GenerateKeyPair(KeyTypeRSA)
+			if err != nil {
+				t.Fatal(err)
+			}
+			installDir := t.TempDir()
+
+			client := &Client{
+				PrivateKey:        current,
+				PreviousKey:       previous,
+				CertName:          "agent",
+				ClientCertificate: "certificate for the rotated key",
+				LocalDb:           Database{Name: filepath.Join(installDir, "ghost.db")},
+				Log:               logger.Logger{Filename: filepath.Join(installDir, "test.log"), Level: "ERROR"},
+				Sender:            comms.Sender{ControllerURL: "https://controller.invalid", ClientPrivateKey: current, PreviousKey: previous},
+			}
+			if err := client.LocalDb.Init(); err != nil {
+				t.Fatal(err)
+			}
+			defer client.LocalDb.Close()
+
+			publicKey, err := client.RollbackKeys()
+			if err != nil {
+				t.Fatalf("RollbackKeys: %v", err)
+			}
+			if publicKey != previousPublic {
+				t.Errorf("public key %q, want %q", publicKey, previousPublic)
+			}
+
+			if client.PrivateKey != previous || client.PublicKey != publicKey || client.PreviousKey != "" || client.ClientCertificate != "" {
+				t.Error("client did not switch back to the previous key pair")
+			}
+			if client.Sender.ClientPrivateKey != previous || client.Sender.PreviousKey != "" || client.Sender.ClientCertificate != "" {
+				t.Error("sender did not switch back to the previous key")
+			}
+
+			stored := map[string]string{"PrivateKey": previous, "PublicKey": publicKey, "PreviousKey": "", "ClientCertificate": "", "CertName": ""}
+			for key, value := range stored {
+				if got, err := client.LocalDb.KeyStoreSelect(key); err != nil || got != value {
+					t.Errorf("key store %s = %q (%v), want %q", key, got, err, value)
+				}
+			}
+
+			// nothing left to roll back
+			if _, err := client.RollbackKeys(); err == nil {
+				t.Error("second RollbackKeys succeeded")
+			}
+		})
+	}
+}
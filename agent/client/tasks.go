@@ -0,0 +1,334 @@
+// Package client tasks queued by the controller in check-in responses
+package client
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"ghost/agent/comms"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Task types the controller can queue for the agent
+const (
+	TaskRunPlugin   = "run_plugin"    // args: plugin_uuid
+	TaskKillPlugin  = "kill_plugin"   // args: plugin_uuid (persistent plugins are restarted)
+	TaskInventory   = "inventory"     // re-collect and report host information
+	TaskUploadFile  = "upload_file"   // args: path (relative to the install directory unless absolute)
+	TaskRotateKeys  = "rotate_keys"   // replace the client key pair; args: rollback ("true" to undo an unconfirmed rotation)
+	TaskSetLogLevel = "set_log_level" // args: level (until the next configuration reload)
+)
+
+// TaskResultURI is the controller endpoint task results are queued for
+const TaskResultURI = "/core/taskresult/"
+
+// received tasks are remembered this long so a resent task is not run twice
+const taskRetention = time.Hour * 24 * 30
+
+// largest file an upload_file task will send
+const maxUploadSize = 5 * 1024 * 1024
+
+// log levels that can be set by a set_log_level task
+var taskLogLevels = []string{"DEBUG", "INFO", "WARN", "ERROR"}
+
+// CheckinResponse struct is the controller's reply to a check-in message
+type CheckinResponse struct {
+	RequiredConfig string `json:"required_config"`
+	Tasks          []Task `json:"tasks"`
+}
+
+// Task struct is a single action queued by the controller
+type Task struct {
+	ID   string            `json:"task_id"`
+	Type string            `json:"type"`
+	Args map[string]string `json:"args"`
+}
+
+// TaskResult struct is sent back to the controller once a task has run
+type TaskResult struct {
+	TaskID    string            `json:"task_id"`
+	Type      string            `json:"type"`
+	Status    string            `json:"status"` // "complete" or "error"
+	Message   string            `json:"message"`
+	Output    map[string]string `json:"output,omitempty"`
+	Completed time.Time         `json:"completed"`
+}
+
+// Checkin sends a check-in message carrying the agent's health report to the controller and parses the reply
+// Controllers that do not accept signed check-ins are sent a basic get request
+func (client *Client) Checkin() (CheckinResponse, error) {
+	var reply CheckinResponse
+	uri := fmt.Sprintf("/core/hello/%s/", client.UUID)
+
+	report, err := json.Marshal(client.HealthReport())
+	if err != nil {
+		return reply, err
+	}
+
+	resp, err := client.Sender.Send(report, uri)
+	var statusErr *comms.StatusError
+	if errors.As(err, &statusErr) && (statusErr.StatusCode == http.StatusNotFound || statusErr.StatusCode == http.StatusMethodNotAllowed) {
+		client.Log.Debug("Controller does not accept health reports. Sending basic check-in...")
+		resp, err = client.Sender.Get(uri)
+	}
+	if err != nil {
+		return reply, err
+	}
+
+	// log return message (debug only)
+	client.Log.Debug("Check-in reply from server %v: %v", client.Version, resp)
+
+	// parse response
+	if err := json.Unmarshal([]byte(resp), &reply); err != nil {
+		return reply, &comms.DecodeError{What: "parse check-in response", Err: err}
+	}
+	return reply, nil
+}
+
+// String returns a description of the task for logging
+func (task Task) String() string {
+	return fmt.Sprintf("%s(%s)", task.Type, task.ID)
+}
+
+// IsPluginTask reports whether the task has to be run by the plugin manager
+func (task Task) IsPluginTask() bool {
+	return task.Type == TaskRunPlugin || task.Type == TaskKillPlugin
+}
+
+// StopsPlugin reports whether the task kills a plugin
+func (task Task) StopsPlugin() bool {
+	return task.Type == TaskKillPlugin
+}
+
+// RunTasks runs the tasks of a check-in response, skipping tasks that have already been received
+// Plugin tasks are handed to the plugin manager through PluginTasks; every other task runs before RunTasks returns.
+// Each task's result is queued for the controller
+func (client *Client) RunTasks(tasks []Task) {
+	for _, task := range tasks {
+		if task.ID == "" {
+			client.Log.Error("Ignoring task %s without an ID", task.Type)
+			continue
+		}
+
+		// tasks are run at most once -- the controller may resend a task until its result arrives
+		if isNew, err := client.LocalDb.TaskBegin(task.ID, task.Type); err != nil {
+			client.Log.Error("Unable to record task %v: %v", task, err)
+			continue
+		} else if !isNew {
+			client.Log.Debug("Task %v already received", task)
+			continue
+		}
+		client.Log.Info("Running task %v", task)
+
+		if task.IsPluginTask() {
+			select {
+			case client.PluginTasks <- task:
+			default:
+				client.CompleteTask(task, nil, errors.New("plugin manager is not accepting tasks"))
+			}
+			continue
+		}
+
+		output, err := client.runTask(task)
+		client.CompleteTask(task, output, err)
+	}
+
+	// forget old tasks
+	if err := client.LocalDb.TaskDeleteBefore(time.Now().Add(-taskRetention)); err != nil {
+		client.Log.Error("Unable to remove old tasks: %v", err)
+	}
+}
+
+// CompleteTask records the outcome of a task and queues its result for the controller
+func (client *Client) CompleteTask(task Task, output map[string]string, err error) error {
+	result := TaskResult{
+		TaskID:    task.ID,
+		Type:      task.Type,
+		Status:    "complete",
+		Message:   "complete",
+		Output:    output,
+		Completed: time.Now().UTC(),
+	}
+	if err != nil {
+		client.Log.Error("Task %v failed: %v", task, err)
+		result.Status = "error"
+		result.Message = err.Error()
+	} else {
+		client.Log.Info("Task %v complete", task)
+	}
+
+	if err := client.LocalDb.TaskUpdateStatus(task.ID, result.Status); err != nil {
+		return err
+	}
+
+	if client.Offline {
+		return nil
+	}
+
+	msgBytes, err := json.Marshal(result)
+	if err != nil {
+		return err
+	}
+	// the controller stops waiting for results once the task is forgotten
+	return client.LocalDb.MessageQueueInsertPriority(string(msgBytes), TaskResultURI, PriorityHigh, taskRetention)
+}
+
+// ReleaseTask forgets a received task that was never run (e.g. the agent shut down before the plugin manager took it)
+// The controller resends tasks until their result arrives, so the task is run after the next check-in
+func (client *Client) ReleaseTask(task Task) {
+	if err := client.LocalDb.TaskForget(task.ID); err != nil {
+		client.Log.Error("Unable to release task %v: %v", task, err)
+		return
+	}
+	client.Log.Info("Task %v was not run and will be taken again when the controller resends it", task)
+}
+
+// ReleasePluginTasks releases plugin tasks handed to PluginTasks that the plugin manager did not take
+// Call once the plugin manager and check-in manager have stopped
+func (client *Client) ReleasePluginTasks() {
+	for {
+		select {
+		case task := <-client.PluginTasks:
+			client.ReleaseTask(task)
+		default:
+			return
+		}
+	}
+}
+
+// runTask runs a task that does not involve the plugin manager
+func (client *Client) runTask(task Task) (map[string]string, error) {
+	switch task.Type {
+	case TaskInventory:
+		return client.runInventory()
+	case TaskUploadFile:
+		return client.uploadFile(task.Args["path"])
+	case TaskRotateKeys:
+		rotate := client.RotateKeys
+		if task.Args["rollback"] == "true" {
+			rotate = client.RollbackKeys
+		}
+		publicKey, err := rotate()
+		if err != nil {
+			return nil, err
+		}
+		return map[string]string{"public_key": publicKey}, nil
+	case TaskSetLogLevel:
+		return nil, client.setLogLevel(task.Args["level"])
+	default:
+		return nil, errors.New("unknown task type " + task.Type)
+	}
+}
+
+// runInventory collects host information again (reporting any change) and returns it
+func (client *Client) runInventory() (map[string]string, error) {
+	facts, changed, err := client.RefreshInventory()
+	if err != nil {
+		return nil, err
+	}
+
+	documents, err := client.RefreshInventoryDocuments()
+	if err != nil {
+		return nil, err
+	}
+
+	facts["changed"] = strings.Join(changed, ",")
+	facts["changed_documents"] = strings.Join(documents, ",")
+	facts["version"] = client.Version
+	return facts, nil
+}
+
+// uploadFile reads a file from the install directory to return to the controller
+// Relative paths are resolved against the install directory
+func (client *Client) uploadFile(path string) (map[string]string, error) {
+	if path == "" {
+		return nil, errors.New("no path given")
+	}
+	if !filepath.IsAbs(path) {
+		path = filepath.Join(client.InstallDir, path)
+	}
+
+	path, err := client.uploadPath(path)
+	if err != nil {
+		return nil, err
+	}
+
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+	if info.IsDir() {
+		return nil, errors.New(path + " is a directory")
+	}
+	if info.Size() > maxUploadSize {
+		return nil, fmt.Errorf("%s is larger than the upload limit of %v bytes", path, maxUploadSize)
+	}
+
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	sum := sha256.Sum256(content)
+
+	return map[string]string{
+		"path":    path,
+		"size":    strconv.Itoa(len(content)),
+		"sha256":  hex.EncodeToString(sum[:]),
+		"content": base64.StdEncoding.EncodeToString(content),
+	}, nil
+}
+
+// uploadPath resolves symbolic links in path and checks the file may be uploaded
+// Only files in the install directory can be uploaded, except for the local database and the key store key file
+func (client *Client) uploadPath(path string) (string, error) {
+	resolved, err := filepath.EvalSymlinks(path)
+	if err != nil {
+		return "", err
+	}
+	installDir, err := filepath.EvalSymlinks(client.InstallDir)
+	if err != nil {
+		return "", err
+	}
+	if !inDirectory(installDir, resolved) {
+		return "", errors.New(path + " is outside the install directory")
+	}
+
+	// database files include the journal and write ahead log next to the database
+	refused := []string{client.LocalDb.Name, client.keyStoreKeyPath()}
+	for _, secret := range refused {
+		if resolvedSecret, err := filepath.EvalSymlinks(secret); err == nil {
+			secret = resolvedSecret
+		}
+		if strings.HasPrefix(resolved, filepath.Clean(secret)) {
+			return "", errors.New(path + " holds agent secrets and cannot be uploaded")
+		}
+	}
+	return resolved, nil
+}
+
+// inDirectory reports whether path is inside dir (both absolute and clean)
+func inDirectory(dir, path string) bool {
+	rel, err := filepath.Rel(dir, path)
+	return err == nil && rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator))
+}
+
+// setLogLevel changes the log level until the configuration is next reloaded
+func (client *Client) setLogLevel(level string) error {
+	level = strings.ToUpper(strings.TrimSpace(level))
+	for _, known := range taskLogLevels {
+		if level == known {
+			client.Log.SetLevel(level)
+			return nil
+		}
+	}
+	return errors.New("unknown log level " + level)
+}
@@ -0,0 +1,82 @@
+package client
+
+import (
+	"encoding/base64"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestUploadFile(t *testing.T) {
+	installDir := t.TempDir()
+	outside := t.TempDir()
+
+	files := map[string]string{
+		filepath.Join(installDir, "ghost.log"):           "log",
+		filepath.Join(installDir, "plugins", "out.txt"):  "plugin output",
+		filepath.Join(installDir, "ghost.db"):            "database",
+		filepath.Join(installDir, "ghost.db-wal"):        "write ahead log",
+		filepath.Join(installDir, "keystore.key"):        "key encryption key",
+		filepath.Join(outside, "secret"):                 "secret",
+		filepath.Join(installDir, "plugins", "..", "up"): "up",
+	}
+	for path, content := range files {
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(path, []byte(content), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	links := map[string]string{
+		filepath.Join(installDir, "escape"):   filepath.Join(outside, "secret"),
+		filepath.Join(installDir, "database"): filepath.Join(installDir, "ghost.db"),
+		filepath.Join(installDir, "log"):      filepath.Join(installDir, "ghost.log"),
+	}
+	for link, target := range links {
+		if err := os.Symlink(target, link); err != nil {
+			t.Skipf("symbolic links not supported: %v", err)
+		}
+	}
+
+	client := &Client{InstallDir: installDir, LocalDb: Database{Name: filepath.Join(installDir, "ghost.db")}}
+
+	tests := []struct {
+		name    string
+		path    string
+		content string
+		wantErr bool
+	}{
+		{"relative", "ghost.log", "log", false},
+		{"absolute", filepath.Join(installDir, "plugins", "out.txt"), "plugin output", false},
+		{"link inside install directory", "log", "log", false},
+		{"parent references inside install directory", "plugins/../up", "up", false},
+		{"outside install directory", filepath.Join(outside, "secret"), "", true},
+		{"relative escape", filepath.Join("..", filepath.Base(outside), "secret"), "", true},
+		{"link out of install directory", "escape", "", true},
+		{"database", "ghost.db", "", true},
+		{"database write ahead log", "ghost.db-wal", "", true},
+		{"link to database", "database", "", true},
+		{"key store key file", "keystore.key", "", true},
+		{"directory", "plugins", "", true},
+		{"missing", "missing.txt", "", true},
+		{"empty", "", "", true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			result, err := client.uploadFile(test.path)
+			if (err != nil) != test.wantErr {
+				t.Fatalf("uploadFile(%q) error = %v, want error %v", test.path, err, test.wantErr)
+			}
+			if err != nil {
+				return
+			}
+			content, _ := base64.StdEncoding.DecodeString(result["content"])
+			if string(content) != test.content {
+				t.Errorf("uploaded %q, want %q", content, test.content)
+			}
+		})
+	}
+}
@@ -2,19 +2,14 @@
 package comms
 
 import (
-	"crypto"
-	"crypto/rand"
-	"crypto/rsa"
-	"crypto/sha256"
+	"bytes"
+	"context"
 	"crypto/tls"
-	"crypto/x509"
 	"encoding/base64"
 	"encoding/json"
-	"encoding/pem"
 	"errors"
 	"fmt"
 	"ghost/agent/logger"
-	"io/ioutil"
 	"net/http"
 	"net/url"
 	"strings"
@@ -27,18 +22,30 @@ const userAgent = "GHOSTClient/1.0" //TODO: Make configurable
 
 // Sender struct for sending messages to the controller
 type Sender struct {
-	ControllerURL     string //Active URL used to contact controller
-	Proxy             string //Active Proxy used
-	ServerCertificate string //pem string of the ser
-	ClientUUID        string
-	ClientPrivateKey  string
-	ClientPublicKey   string
-	Log               *logger.Logger
-	uri               string //uri to access on the controller
-	message           []byte //Byte array of message to send controller. Caller should serialize json data
-	httpClient        *http.Client
-	transport         *http.Transport
-	mutex             *sync.Mutex
+	ControllerURL      string   //Active URL used to contact controller
+	Proxy              string   //Active Proxy used
+	ServerCertificate  string   //pem string of the ser
+	TLSCABundle        string   //path to pem CA bundle used to verify the controller (system roots if empty)
+	TLSPinMode         string   //PinNone, PinCertificate or PinSPKI
+	TLSPinnedKeys      []string //additional base64 sha256 SPKI pins (PinSPKI only)
+	ClientUUID         string
+	ClientPrivateKey   string
+	ClientPublicKey    string
+	SignatureAlgorithm string      //preferred signature algorithm of RSA keys (AlgRS256 or AlgPS256); other key types have a single algorithm
+	PreviousKey        string      //pem private key replaced by a key rotation, used if the controller refuses the new key until a signed exchange with it succeeds
+	KeyConfirmed       func()      //called (after the sender is unlocked) once the controller has accepted a rotated key
+	ClientCertificate  string      //pem client certificate presented to the controller for mutual TLS
+	RetryPolicy        RetryPolicy //backoff and circuit breaker settings
+	Log                *logger.Logger
+	uri                string       //uri to access on the controller
+	message            []byte       //Byte array of message to send controller. Caller should serialize json data
+	requestEncoding    string       //content encoding the active controller accepts for request bodies
+	acceptedAlgorithms *algSet      //signature algorithms the active controller verifies
+	signers            *signerCache //parsed private keys
+	breakers           *breakers
+	httpClient         *http.Client
+	transport          *http.Transport
+	mutex              *sync.Mutex
 }
 
 // Init method for intializing sender values for first use
@@ -46,18 +53,105 @@ func (s *Sender) Init() error {
 	//create sender mutex
 	s.mutex = &sync.Mutex{}
 
+	//create circuit breakers
+	s.breakers = newBreakers(s.RetryPolicy)
+
+	//create signing key cache and accepted signature algorithms
+	s.signers = &signerCache{}
+	s.acceptedAlgorithms = &algSet{}
+
+	return s.build()
+}
+
+// Reconfigure replaces the connection settings (ControllerURL, Proxy, ServerCertificate, TLS verification, RetryPolicy and SignatureAlgorithm) with those of cfg
+// and rebuilds the http client. Safe to call while other goroutines are using the sender
+func (s *Sender) Reconfigure(cfg Sender) error {
+	// initialize if needed
+	if s.mutex == nil {
+		s.mutex = &sync.Mutex{}
+	}
+
+	// get mutex lock
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	s.ControllerURL = cfg.ControllerURL
+	s.Proxy = cfg.Proxy
+	s.ServerCertificate = cfg.ServerCertificate
+	s.TLSCABundle = cfg.TLSCABundle
+	s.TLSPinMode = cfg.TLSPinMode
+	s.TLSPinnedKeys = cfg.TLSPinnedKeys
+	s.RetryPolicy = cfg.RetryPolicy
+	s.SignatureAlgorithm = cfg.SignatureAlgorithm
+	if s.breakers == nil {
+		s.breakers = newBreakers(s.RetryPolicy)
+	} else {
+		s.breakers.setPolicy(s.RetryPolicy)
+	}
+
+	return s.build()
+}
+
+// SetClientCertificate replaces the client certificate presented for mutual TLS and rebuilds the http client
+func (s *Sender) SetClientCertificate(certPEM string) error {
+	// initialize if needed
+	if s.mutex == nil {
+		s.mutex = &sync.Mutex{}
+	}
+
+	// get mutex lock
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	s.ClientCertificate = certPEM
+
+	return s.build()
+}
+
+// GetRetryPolicy returns the retry settings of the sender. Safe to call while the sender is being reconfigured
+func (s *Sender) GetRetryPolicy() RetryPolicy {
+	if s.mutex == nil {
+		return s.RetryPolicy
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.RetryPolicy
+}
+
+// build creates the transport and http client from the current sender settings
+func (s *Sender) build() error {
 	//make sure URL can be set
 	if s.ControllerURL == "" {
 		return errors.New("cannot initialize sender: URL not set")
 	}
 
+	//verify controller certificates
+	tlsConfig, err := s.tlsConfig()
+	if err != nil {
+		return errors.New("cannot initialize sender: " + err.Error())
+	}
+
+	//present the client certificate if one has been issued
+	if s.ClientCertificate != "" {
+		cert, err := tls.X509KeyPair([]byte(s.ClientCertificate), []byte(s.ClientPrivateKey))
+		if err != nil {
+			// connect without mutual TLS rather than not at all -- a new certificate will be requested
+			s.Log.Error("Unable to load client certificate: %v", err)
+		} else {
+			tlsConfig.GetClientCertificate = func(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+				return &cert, nil
+			}
+		}
+	}
+
 	//create transport
 	s.transport = &http.Transport{
 		MaxIdleConns:       1,
 		IdleConnTimeout:    1 * time.Second,
 		DisableKeepAlives:  true,
 		DisableCompression: true, //compression is handled manually
-		TLSClientConfig:    &tls.Config{InsecureSkipVerify: true},
+		TLSClientConfig:    tlsConfig,
 		ProxyConnectHeader: http.Header{"User-Agent": []string{userAgent}},
 	}
 
@@ -91,12 +185,38 @@ func (s *Sender) Init() error {
 // INPUT : uri (string), URI only, base URL will be prepended
 // OUPUT : response message
 func (s *Sender) Send(message []byte, uri string) (string, error) {
+	return s.SendContext(context.Background(), message, uri)
+}
 
+// SendContext sends a message to the controller like Send
+// The request is abandoned if the context is cancelled or its deadline passes
+func (s *Sender) SendContext(ctx context.Context, message []byte, uri string) (string, error) {
 	// initialize if needed
 	if s.httpClient == nil {
 		s.Init()
 	}
 
+	// fail fast while the active endpoint's circuit is open
+	endpoint := endpointKey(s.ControllerURL, s.Proxy)
+	if !s.breakers.allow(endpoint) {
+		return "", &NetworkError{URL: s.ControllerURL, Err: ErrCircuitOpen}
+	}
+
+	resp, err := s.sendContext(ctx, message, uri)
+	s.breakers.record(endpoint, err)
+	return resp, err
+}
+
+// sendContext signs and sends a message, verifying the response
+func (s *Sender) sendContext(ctx context.Context, message []byte, uri string) (string, error) {
+	// the key confirmation callback locks the client's key state, so it runs once the sender is unlocked
+	confirmed := false
+	defer func() {
+		if confirmed && s.KeyConfirmed != nil {
+			s.KeyConfirmed()
+		}
+	}()
+
 	// get mutex lock
 	s.mutex.Lock()
 	defer s.mutex.Unlock()
@@ -105,9 +225,31 @@ func (s *Sender) Send(message []byte, uri string) (string, error) {
 	s.message = message
 	s.uri = uri
 
+	resp, err := s.post(ctx, s.ClientPrivateKey)
+
+	// a rotated key is only relied on once the controller has accepted it
+	if s.PreviousKey != "" {
+		var statusErr *StatusError
+		if errors.As(err, &statusErr) && (statusErr.StatusCode == http.StatusUnauthorized || statusErr.StatusCode == http.StatusForbidden) {
+			s.Log.Error("Controller refused rotated key (%v). Signing with previous key...", err)
+			return s.post(ctx, s.PreviousKey)
+		} else if err == nil {
+			s.PreviousKey = ""
+			confirmed = true
+		}
+	}
+
+	return resp, err
+}
+
+// post sends the current message signed with the given private key, verifying the response
+// The sender must be locked
+func (s *Sender) post(ctx context.Context, privateKey string) (string, error) {
 	// Create a payload map with json string and signed request
 	payload := make(map[string]string)
-	payload[signature] = base64.StdEncoding.EncodeToString(s.SignData(s.message))
+	sig, algorithm := s.signDataWith(privateKey, s.message)
+	payload[signature] = base64.StdEncoding.EncodeToString(sig)
+	payload[signatureAlgorithmField] = algorithm
 	payload["jsonString"] = string(s.message)
 
 	//serialize payload structure
@@ -127,10 +269,15 @@ func (s *Sender) Send(message []byte, uri string) (string, error) {
 
 	// create request object
 	url := fmt.Sprintf("%s/%s/", strings.Trim(s.ControllerURL, "/"), strings.Trim(s.uri, "/"))
-	req, _ := http.NewRequest("POST", url, strings.NewReader(string(payloadJSON)))
+	body, contentEncoding := s.encodeBody(payloadJSON)
+	req, _ := http.NewRequestWithContext(ctx, "POST", url, bytes.NewReader(body))
 
 	// set headers
 	req.Header.Set("Content-Type", "application/json;charset=UTF-8")
+	if contentEncoding != "" {
+		req.Header.Set("Content-Encoding", contentEncoding)
+	}
+	setAcceptEncoding(req)
 	if s.ClientUUID != "" {
 		req.Header.Set("client-uuid", s.ClientUUID)
 	} else {
@@ -140,38 +287,35 @@ func (s *Sender) Send(message []byte, uri string) (string, error) {
 	// make request
 	resp, err := s.httpClient.Do(req)
 	if err != nil {
-		return "", errors.New("NETWORK ERROR: " + err.Error())
+		return "", &NetworkError{URL: url, Err: err}
 	}
 	defer resp.Body.Close()
+	s.learnEncoding(resp)
+	s.learnAlgorithms(resp)
 
 	// read and parse response
-	bodyBytes, err := ioutil.ReadAll(resp.Body)
+	bodyBytes, err := readBody(resp)
 	if err != nil {
-		return "", errors.New("Unable to read body response: " + err.Error())
+		return "", &DecodeError{What: "read body response", Err: err}
 	}
 
 	// check for bad status
-	if resp.StatusCode != 200 {
-		return "", errors.New("Received bad status: " + resp.Status)
+	if resp.StatusCode != http.StatusOK {
+		return "", newStatusError(resp, bodyBytes)
 	}
 
 	payloadMap := make(map[string]string)
 	if err := json.Unmarshal(bodyBytes, &payloadMap); err != nil {
-		return "", errors.New("Unable to unmarshal payload map: " + err.Error())
-	}
-
-	// check status code
-	if resp.StatusCode != http.StatusOK {
-		err = errors.New(resp.Status)
+		return "", &DecodeError{What: "unmarshal payload map", Err: err}
 	}
 
 	// verify request
-	if s.VerifyResponse(payloadMap["jsonString"], payloadMap["SIGNATURE"]) {
-		return string(payloadMap["jsonString"]), err
+	if s.VerifyResponse(payloadMap["jsonString"], payloadMap["SIGNATURE"], payloadMap[signatureAlgorithmField]) {
+		return string(payloadMap["jsonString"]), nil
 	}
 
 	// Default to returning unverified
-	return "", errors.New("unable to verify response signature")
+	return "", &SignatureError{URI: s.uri}
 }
 
 // GetResource retrieves a resource file from the control server
@@ -190,13 +334,13 @@ func (s *Sender) GetResource(resourceHash string) ([]byte, error) {
 	// parse response string into map
 	respMap := make(map[string]string)
 	if err := json.Unmarshal([]byte(respString), &respMap); err != nil {
-		return []byte(""), err
+		return []byte(""), &DecodeError{What: "unmarshal resource", Err: err}
 	}
 
 	// base64 decode content
 	content, err := base64.StdEncoding.DecodeString(respMap["content"])
 	if err != nil {
-		return []byte(""), err
+		return []byte(""), &DecodeError{What: "decode resource content", Err: err}
 	}
 
 	return content, nil
@@ -204,27 +348,18 @@ func (s *Sender) GetResource(resourceHash string) ([]byte, error) {
 }
 
 // VerifyResponse method verifies if the message has been signed by the server
-func (s *Sender) VerifyResponse(respStr string, signature string) bool {
+// The controller certificate may hold an RSA, ECDSA P-256 or Ed25519 key. Responses without an algorithm are RS256
+func (s *Sender) VerifyResponse(respStr string, signature string, algorithm string) bool {
 	// Get byte arrays for the signature and reponse string
 	sigBytes, _ := base64.StdEncoding.DecodeString(signature)
 
-	// take hash response bytes
-	respBytes := []byte(respStr)
-	hashed := sha256.Sum256(respBytes)
-
-	// construct certifacte
-	block, _ := pem.Decode([]byte(s.ServerCertificate))
-	if block == nil {
-		s.Log.Fatal("Failed to decode PEM block of controller certificate")
-	}
-
-	cert, err := x509.ParseCertificate(block.Bytes)
+	// public key of the controller certificate
+	serverKey, err := ParsePublicKey(s.ServerCertificate)
 	if err != nil {
-		s.Log.Fatal("Failed to parse controller certifact: %v", err)
+		s.Log.Fatal("Failed to parse controller certificate: %v", err)
 	}
 
-	rsaPubKey, _ := cert.PublicKey.(*rsa.PublicKey)
-	err = rsa.VerifyPKCS1v15(rsaPubKey, crypto.SHA256, hashed[:], sigBytes)
+	err = Verify(serverKey, algorithm, []byte(respStr), sigBytes)
 	if err != nil {
 		s.Log.Error("Error from signature verification: %s\n", err)
 		return false
@@ -233,28 +368,84 @@ func (s *Sender) VerifyResponse(respStr string, signature string) bool {
 	return true
 }
 
-// SignData method returns signature for inputed data
-func (s *Sender) SignData(data []byte) []byte {
-	//hash data
-	hashed := sha256.Sum256(data)
+// SignData method returns signature for inputed data and the algorithm it was made with
+// Safe to call while other goroutines are using the sender
+func (s *Sender) SignData(data []byte) ([]byte, string) {
+	// initialize if needed
+	if s.mutex == nil {
+		s.mutex = &sync.Mutex{}
+	}
 
-	//parse private key
-	block, _ := pem.Decode([]byte(s.ClientPrivateKey))
-	if block == nil {
-		s.Log.Fatal("Failed to decode PEM block of controller certificate")
+	// get mutex lock
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	return s.signDataWith(s.ClientPrivateKey, data)
+}
+
+// SetClientKey switches the key pair (and the client certificate issued for it) used for all further requests
+// The replaced private key is kept as PreviousKey until the controller accepts the new one
+func (s *Sender) SetClientKey(privateKey, publicKey, certPEM string) error {
+	// initialize if needed
+	if s.mutex == nil {
+		s.mutex = &sync.Mutex{}
 	}
 
-	rsaPrivateKey, err := x509.ParsePKCS1PrivateKey(block.Bytes)
+	// get mutex lock
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	s.PreviousKey = s.ClientPrivateKey
+	s.ClientPrivateKey = privateKey
+	s.ClientPublicKey = publicKey
+	s.ClientCertificate = certPEM
+
+	return s.build()
+}
+
+// RollbackClientKey switches back to PreviousKey after a key rotation the controller has not accepted
+// publicKey is the public key of PreviousKey; the client certificate issued for the rotated key is dropped
+func (s *Sender) RollbackClientKey(publicKey string) error {
+	// initialize if needed
+	if s.mutex == nil {
+		s.mutex = &sync.Mutex{}
+	}
+
+	// get mutex lock
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if s.PreviousKey == "" {
+		return errors.New("no previous key to roll back to")
+	}
+
+	s.ClientPrivateKey = s.PreviousKey
+	s.ClientPublicKey = publicKey
+	s.PreviousKey = ""
+	s.ClientCertificate = ""
+
+	return s.build()
+}
+
+// signDataWith returns the signature of data made with a pem private key and the algorithm it was made with
+func (s *Sender) signDataWith(privateKey string, data []byte) ([]byte, string) {
+	//parse private key
+	key, err := s.signers.get(privateKey)
 	if err != nil {
 		s.Log.Fatal("Unable to parse private key: %v", err)
 	}
 
-	signature, err := rsa.SignPKCS1v15(rand.Reader, rsaPrivateKey, crypto.SHA256, hashed[:])
+	algorithm, err := s.signingAlgorithm(key)
+	if err != nil {
+		s.Log.Fatal("Unable to sign with private key: %v", err)
+	}
+
+	signature, err := Sign(key, algorithm, data)
 	if err != nil {
 		s.Log.Fatal("Error from signing: %s\n", err)
 	}
 
-	return signature
+	return signature, algorithm
 }
 
 // UpdateConnection test controller URLs and proxies round robin until one works or all fail
@@ -273,30 +464,37 @@ func (s *Sender) UpdateConnection(proxyList, controllerList []string) bool {
 
 		// test with default Proxy first
 		s.Log.Debug("Testing Controller URL %v with Proxy %v", s.ControllerURL, s.Proxy)
-		if s.TestConnection() {
+		err := s.tryEndpoint()
+		if err == nil {
 			s.Log.Info("Updating network sender to use controller URL: %v and Proxy: %v", s.ControllerURL, s.Proxy)
 			return true
 		}
+		s.Log.Debug("Controller URL %v with Proxy %v failed: %v", s.ControllerURL, s.Proxy, err)
 
 		// test with no Proxy if not default
 		if s.Proxy != "" && strings.ToLower(s.Proxy) != "none" {
 			s.Proxy = ""
 			s.Log.Debug("Testing Controller URL %v with No Proxy", s.ControllerURL)
-			if s.TestConnection() {
+			if err = s.tryEndpoint(); err == nil {
 				s.Log.Info("Updating network sender to use controller URL: %v and No Proxy", s.ControllerURL)
 				return true
 			}
+			s.Log.Debug("Controller URL %v with No Proxy failed: %v", s.ControllerURL, err)
 		}
 
 		// run through the Proxy list
 		for _, Proxy := range proxyList {
 			s.Proxy = Proxy
 			s.Log.Debug("Testing Controller URL %v with Proxy %v", s.ControllerURL, s.Proxy)
-			if s.TestConnection() {
+			if err = s.tryEndpoint(); err == nil {
 				s.Log.Info("Updating network sender to use controller URL: %v and Proxy: %v", s.ControllerURL, s.Proxy)
 				return true
 			}
+			s.Log.Debug("Controller URL %v with Proxy %v failed: %v", s.ControllerURL, s.Proxy, err)
 		}
+
+		// report why this controller could not be used (last attempt)
+		s.Log.Error("Unable to connect to controller %v: %v", ControllerURL, describeConnectionError(err))
 	}
 
 	// nothing worked set back to old settings and return
@@ -308,6 +506,28 @@ func (s *Sender) UpdateConnection(proxyList, controllerList []string) bool {
 // TestConnection checks if the current Sender settings can connect to controller
 // Returns true if connection is successful
 func (s *Sender) TestConnection() bool {
+	err := s.testConnection()
+	if err != nil {
+		s.Log.Debug("%v", err)
+	}
+	return err == nil
+}
+
+// tryEndpoint tests the current Sender settings unless the endpoint's circuit is open, recording the result
+func (s *Sender) tryEndpoint() error {
+	endpoint := endpointKey(s.ControllerURL, s.Proxy)
+	if !s.breakers.allow(endpoint) {
+		return &NetworkError{URL: s.ControllerURL, Err: ErrCircuitOpen}
+	}
+
+	err := s.testConnection()
+	s.breakers.record(endpoint, err)
+	return err
+}
+
+// testConnection checks if the current Sender settings can connect to controller
+// Returns the reason the connection failed
+func (s *Sender) testConnection() error {
 
 	//set Proxy
 	if s.Proxy != "" && strings.ToLower(s.Proxy) != "none" {
@@ -327,27 +547,31 @@ func (s *Sender) TestConnection() bool {
 
 	//set user-agent string
 	req.Header.Set("User-Agent", userAgent)
+	setAcceptEncoding(req)
 
 	//make request
 	resp, err := s.httpClient.Do(req)
 	if err != nil {
-		s.Log.Debug("NETWORK ERROR: %v", err) // DEBUG
-		return false
+		return &NetworkError{URL: req.URL.String(), Err: err}
 	}
 	defer resp.Body.Close()
+	s.learnEncoding(resp)
+	s.learnAlgorithms(resp)
 
 	//read and parse response
-	body, _ := ioutil.ReadAll(resp.Body)
+	body, _ := readBody(resp)
 	var respMap map[string]string
 	if err := json.Unmarshal(body, &respMap); err != nil {
-		s.Log.Debug("Invalid Response (unable to deserialize)")
-		return false
+		if resp.StatusCode != http.StatusOK {
+			return newStatusError(resp, body)
+		}
+		return &DecodeError{What: "deserialize connection test response", Err: err}
 	}
 
 	if respMap["status"] == "success" {
-		return true
+		return nil
 	}
-	return false
+	return errors.New("connection test did not succeed: status " + respMap["status"])
 }
 
 // Get sends a basic unauthenticated get request
@@ -356,12 +580,25 @@ func (s *Sender) TestConnection() bool {
 // OUTPUT : response message
 // OUTPUT : error; including non-200 responses
 func (s *Sender) Get(uri string) (string, error) {
-
 	// initialize if needed
 	if s.httpClient == nil {
 		s.Init()
 	}
 
+	// fail fast while the active endpoint's circuit is open
+	endpoint := endpointKey(s.ControllerURL, s.Proxy)
+	if !s.breakers.allow(endpoint) {
+		return "", &NetworkError{URL: s.ControllerURL, Err: ErrCircuitOpen}
+	}
+
+	resp, err := s.get(uri)
+	s.breakers.record(endpoint, err)
+	return resp, err
+}
+
+// get sends a basic unauthenticated get request and verifies the response
+func (s *Sender) get(uri string) (string, error) {
+
 	// get mutex lock
 	s.mutex.Lock()
 	defer s.mutex.Unlock()
@@ -387,40 +624,38 @@ func (s *Sender) Get(uri string) (string, error) {
 
 	//set user-agent string
 	req.Header.Set("User-Agent", userAgent)
+	setAcceptEncoding(req)
 
 	//make request
 	resp, err := s.httpClient.Do(req)
 	if err != nil {
-		return "", errors.New("NETWORK ERROR: " + err.Error())
+		return "", &NetworkError{URL: url, Err: err}
 	}
 	defer resp.Body.Close()
+	s.learnEncoding(resp)
+	s.learnAlgorithms(resp)
 
 	// read and parse response
-	bodyBytes, err := ioutil.ReadAll(resp.Body)
+	bodyBytes, err := readBody(resp)
 	if err != nil {
-		return "", errors.New("Unable to read body response: " + err.Error())
+		return "", &DecodeError{What: "read body response", Err: err}
 	}
 
 	// check for bad status
-	if resp.StatusCode != 200 {
-		return "", errors.New("Received bad status: " + resp.Status)
+	if resp.StatusCode != http.StatusOK {
+		return "", newStatusError(resp, bodyBytes)
 	}
 
 	payloadMap := make(map[string]string)
 	if err := json.Unmarshal(bodyBytes, &payloadMap); err != nil {
-		return "", errors.New("Unable to unmarshal payload map: " + err.Error())
-	}
-
-	// check status code
-	if resp.StatusCode != http.StatusOK {
-		err = errors.New(resp.Status)
+		return "", &DecodeError{What: "unmarshal payload map", Err: err}
 	}
 
 	// verify request
-	if s.VerifyResponse(payloadMap["jsonString"], payloadMap["SIGNATURE"]) {
-		return string(payloadMap["jsonString"]), err
+	if s.VerifyResponse(payloadMap["jsonString"], payloadMap["SIGNATURE"], payloadMap[signatureAlgorithmField]) {
+		return string(payloadMap["jsonString"]), nil
 	}
 
 	// Default to returning unverified
-	return "", errors.New("unable to verify response signature")
+	return "", &SignatureError{URI: s.uri}
 }
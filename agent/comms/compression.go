@@ -0,0 +1,81 @@
+// Package comms negotiated payload compression
+package comms
+
+import (
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strings"
+)
+
+// content encodings supported by the agent
+const encodingGzip = "gzip"
+
+// acceptEncodingHeader is set by controllers that accept compressed request bodies
+// Old controllers never set it so requests to them are sent uncompressed
+const acceptEncodingHeader = "X-Ghost-Accept-Encoding"
+
+// request bodies smaller than this are not worth compressing
+const minCompressSize = 1024
+
+// setAcceptEncoding asks the controller to compress its response
+// The transport's automatic decompression is disabled so the agent handles (and negotiates) encodings itself
+func setAcceptEncoding(req *http.Request) {
+	req.Header.Set("Accept-Encoding", encodingGzip)
+}
+
+// encodeBody compresses a request body if the active controller has said it accepts compressed requests
+// Returns the body to send and its content encoding ("" if not compressed)
+func (s *Sender) encodeBody(body []byte) ([]byte, string) {
+	if s.requestEncoding != encodingGzip || len(body) < minCompressSize {
+		return body, ""
+	}
+
+	var buf bytes.Buffer
+	writer := gzip.NewWriter(&buf)
+	if _, err := writer.Write(body); err != nil {
+		return body, ""
+	}
+	if err := writer.Close(); err != nil {
+		return body, ""
+	}
+
+	// send as is if compression does not help
+	if buf.Len() >= len(body) {
+		return body, ""
+	}
+	return buf.Bytes(), encodingGzip
+}
+
+// learnEncoding records whether the controller accepts compressed request bodies
+func (s *Sender) learnEncoding(resp *http.Response) {
+	s.requestEncoding = ""
+	for _, encoding := range strings.Split(resp.Header.Get(acceptEncodingHeader), ",") {
+		if strings.EqualFold(strings.TrimSpace(encoding), encodingGzip) {
+			s.requestEncoding = encodingGzip
+		}
+	}
+}
+
+// readBody reads a response body, decompressing it according to its content encoding
+func readBody(resp *http.Response) ([]byte, error) {
+	var reader io.Reader = resp.Body
+
+	switch encoding := strings.ToLower(resp.Header.Get("Content-Encoding")); encoding {
+	case "", "identity":
+	case encodingGzip:
+		gzipReader, err := gzip.NewReader(resp.Body)
+		if err != nil {
+			return nil, &DecodeError{What: "decompress response", Err: err}
+		}
+		defer gzipReader.Close()
+		reader = gzipReader
+	default:
+		return nil, &DecodeError{What: "decode response", Err: errors.New("unsupported content encoding " + encoding)}
+	}
+
+	return ioutil.ReadAll(reader)
+}
@@ -0,0 +1,226 @@
+// Package comms streaming, resumable resource downloads
+package comms
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ErrDownloadNotSupported is returned by DownloadResource when the controller has no streaming download endpoint
+// Callers should fall back to GetResource
+var ErrDownloadNotSupported = errors.New("controller does not support streaming downloads")
+
+// number of times an interrupted download is resumed before giving up
+const downloadAttempts = 5
+
+// a download is abandoned (and later resumed) if no data is received for this long
+const downloadStallTimeout = time.Second * 60
+
+// download struct tracks a resource file being streamed to disk
+type download struct {
+	hash     string // expected sha256
+	partPath string // partial file
+	perm     os.FileMode
+	hasher   hash.Hash // sha256 of the first hashed bytes of partPath
+	hashed   int64
+}
+
+// DownloadResource streams a resource file from the control server to path
+// The file is written to <path>.part and hashed as it arrives. It is only renamed into place once the sha256 matches.
+// Interrupted downloads are resumed with HTTP range requests, including partial files left by earlier calls
+// INPUT: resourceHash (string), sha256 of the resource file to retrieve
+// INPUT: path (string), destination file
+// INPUT: perm (os.FileMode), permissions of the destination file
+func (s *Sender) DownloadResource(ctx context.Context, resourceHash, path string, perm os.FileMode) error {
+	d := download{hash: strings.ToLower(resourceHash), partPath: path + ".part", perm: perm}
+
+	var err error
+	for attempt := 1; attempt <= downloadAttempts; attempt++ {
+		if err = s.downloadPart(ctx, &d); err == nil {
+			break
+		}
+		if errors.Is(err, ErrDownloadNotSupported) || ctx.Err() != nil {
+			return err
+		}
+		s.Log.Debug("Download of %s interrupted (attempt %v of %v): %v", d.hash, attempt, downloadAttempts, err)
+
+		// give the connection a moment to recover before resuming
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(time.Second * time.Duration(2*attempt)):
+		}
+	}
+	if err != nil {
+		return err
+	}
+
+	// verify the complete file before it is used
+	if sum := hex.EncodeToString(d.hasher.Sum(nil)); sum != d.hash {
+		os.Remove(d.partPath)
+		return fmt.Errorf("mismatched hashes: wanted: %s got: %s", d.hash, sum)
+	}
+
+	return os.Rename(d.partPath, path)
+}
+
+// downloadPart requests the remainder of a resource file and appends it to the partial file
+// Returns nil once the controller has sent the whole file
+func (s *Sender) downloadPart(ctx context.Context, d *download) error {
+	// resume from the end of any partial file
+	var offset int64
+	if info, err := os.Stat(d.partPath); err == nil {
+		offset = info.Size()
+	}
+
+	// hash what is already on disk (e.g. left by an earlier run or a failed write)
+	if d.hasher == nil || d.hashed != offset {
+		if err := d.rehash(); err != nil {
+			return err
+		}
+		offset = d.hashed
+	}
+
+	// abandon the request if the transfer stalls
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	stall := time.AfterFunc(downloadStallTimeout, cancel)
+	defer stall.Stop()
+
+	resp, err := s.requestDownload(ctx, d.hash, offset)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	flags := os.O_CREATE | os.O_WRONLY
+	switch resp.StatusCode {
+	case http.StatusPartialContent:
+		flags |= os.O_APPEND
+		s.Log.Debug("Resuming download of %s at byte %v", d.hash, offset)
+	case http.StatusOK:
+		// range not honoured (or nothing to resume) -- start over
+		flags |= os.O_TRUNC
+		d.hasher = sha256.New()
+		d.hashed = 0
+	case http.StatusRequestedRangeNotSatisfiable:
+		// the partial file is already complete (or is not a prefix of the resource)
+		if hex.EncodeToString(d.hasher.Sum(nil)) == d.hash {
+			return nil
+		}
+		os.Remove(d.partPath)
+		return errors.New("partial download is not valid")
+	case http.StatusNotFound, http.StatusMethodNotAllowed, http.StatusNotImplemented:
+		return ErrDownloadNotSupported
+	default:
+		return newStatusError(resp, nil)
+	}
+
+	file, err := os.OpenFile(d.partPath, flags, d.perm)
+	if err != nil {
+		return err
+	}
+
+	// stream to disk and hash, resetting the stall timer as data arrives
+	n, err := io.Copy(io.MultiWriter(file, d.hasher), &stallReader{reader: resp.Body, stall: stall})
+	d.hashed += n
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+
+	return err
+}
+
+// rehash hashes the partial file from disk
+func (d *download) rehash() error {
+	d.hasher = sha256.New()
+	d.hashed = 0
+
+	file, err := os.Open(d.partPath)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	d.hashed, err = io.Copy(d.hasher, file)
+	return err
+}
+
+// requestDownload sends a signed range request for a resource file
+// The sender is only locked until the response headers arrive so other messages are not blocked by long downloads
+func (s *Sender) requestDownload(ctx context.Context, resourceHash string, offset int64) (*http.Response, error) {
+	// initialize if needed
+	if s.httpClient == nil {
+		s.Init()
+	}
+
+	// get mutex lock
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	// set Proxy
+	if s.Proxy != "" && strings.ToLower(s.Proxy) != "none" {
+		urlI := url.URL{}
+		urlProxy, _ := urlI.Parse(s.Proxy)
+		s.transport.Proxy = http.ProxyURL(urlProxy)
+	} else {
+		s.transport.Proxy = nil
+	}
+
+	// create request object
+	uri := fmt.Sprintf("/core/download/%s/", resourceHash)
+	req, err := http.NewRequestWithContext(ctx, "GET", strings.TrimSuffix(s.ControllerURL, "/")+uri, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	// the body cannot be signed so the request is authenticated by signing the uri and a timestamp
+	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+	req.Header.Set("User-Agent", userAgent)
+	req.Header.Set("client-uuid", s.ClientUUID)
+	req.Header.Set("X-Ghost-Timestamp", timestamp)
+	sig, algorithm := s.signDataWith(s.ClientPrivateKey, []byte(uri+"\n"+timestamp))
+	req.Header.Set("X-Ghost-Signature", base64.StdEncoding.EncodeToString(sig))
+	req.Header.Set("X-Ghost-Signature-Algorithm", algorithm)
+	if offset > 0 {
+		req.Header.Set("Range", fmt.Sprintf("bytes=%d-", offset))
+	}
+
+	// no overall timeout -- stalls are detected by the caller
+	downloadClient := &http.Client{Transport: s.transport, CheckRedirect: s.httpClient.CheckRedirect}
+	resp, err := downloadClient.Do(req)
+	if err != nil {
+		return nil, &NetworkError{URL: req.URL.String(), Err: err}
+	}
+
+	return resp, nil
+}
+
+// stallReader resets a stall timer whenever data is read
+type stallReader struct {
+	reader io.Reader
+	stall  *time.Timer
+}
+
+// Read implements io.Reader
+func (r *stallReader) Read(p []byte) (int, error) {
+	n, err := r.reader.Read(p)
+	if n > 0 {
+		r.stall.Reset(downloadStallTimeout)
+	}
+	return n, err
+}
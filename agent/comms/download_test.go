@@ -0,0 +1,166 @@
+package comms
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/pem"
+	"errors"
+	"ghost/agent/logger"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+)
+
+// downloadServer serves one resource file and records the Range header of every request
+type downloadServer struct {
+	content     []byte
+	ignoreRange bool // answer range requests with the whole file
+	cutFirst    bool // close the first response after half of the file
+	mutex       sync.Mutex
+	ranges      []string
+}
+
+func (d *downloadServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	d.mutex.Lock()
+	d.ranges = append(d.ranges, r.Header.Get("Range"))
+	first := len(d.ranges) == 1
+	d.mutex.Unlock()
+
+	if r.Header.Get("X-Ghost-Signature") == "" {
+		http.Error(w, "unsigned", http.StatusForbidden)
+		return
+	}
+	if d.ignoreRange {
+		r.Header.Del("Range")
+	}
+	if d.cutFirst && first {
+		w.Header().Set("Content-Length", strconv.Itoa(len(d.content)))
+		w.WriteHeader(http.StatusOK)
+		w.Write(d.content[:len(d.content)/2])
+		return
+	}
+	http.ServeContent(w, r, "resource", time.Time{}, bytes.NewReader(d.content))
+}
+
+// testDownloadSender returns a sender for a test controller
+func testDownloadSender(t *testing.T, controllerURL string) *Sender {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &Sender{
+		ControllerURL:    controllerURL,
+		ClientUUID:       "test",
+		ClientPrivateKey: string(pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(key)})),
+		Log:              &logger.Logger{Filename: filepath.Join(t.TempDir(), "test.log"), Level: "ERROR"},
+	}
+}
+
+func TestDownloadResource(t *testing.T) {
+	content := make([]byte, 64*1024)
+	if _, err := rand.Read(content); err != nil {
+		t.Fatal(err)
+	}
+	sum := sha256.Sum256(content)
+	hash := hex.EncodeToString(sum[:])
+	garbage := bytes.Repeat([]byte{0xff}, 1000)
+
+	tests := []struct {
+		name        string
+		partial     []byte // left by an earlier download
+		ignoreRange bool
+		cutFirst    bool
+		ranges      []string
+		wantErr     bool
+	}{
+		{"fresh", nil, false, false, []string{""}, false},
+		{"resume partial file", content[:1000], false, false, []string{"bytes=1000-"}, false},
+		{"partial file complete", content, false, false, []string{"bytes=65536-"}, false},
+		{"range not honoured", content[:1000], true, false, []string{"bytes=1000-"}, false},
+		{"partial file not a prefix", garbage, false, false, []string{"bytes=1000-"}, true},
+		{"resume interrupted transfer", nil, false, true, []string{"", "bytes=32768-"}, false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			server := &downloadServer{content: content, ignoreRange: test.ignoreRange, cutFirst: test.cutFirst}
+			controller := httptest.NewServer(server)
+			defer controller.Close()
+
+			path := filepath.Join(t.TempDir(), "resource")
+			if test.partial != nil {
+				if err := ioutil.WriteFile(path+".part", test.partial, 0600); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			err := testDownloadSender(t, controller.URL).DownloadResource(context.Background(), hash, path, 0600)
+			if (err != nil) != test.wantErr {
+				t.Fatalf("DownloadResource error = %v, want error %v", err, test.wantErr)
+			}
+
+			if len(server.ranges) != len(test.ranges) {
+				t.Fatalf("requested ranges %q, want %q", server.ranges, test.ranges)
+			}
+			for i := range test.ranges {
+				if server.ranges[i] != test.ranges[i] {
+					t.Errorf("request %v range = %q, want %q", i, server.ranges[i], test.ranges[i])
+				}
+			}
+
+			if _, err := os.Stat(path + ".part"); !os.IsNotExist(err) {
+				t.Errorf("partial file left behind (%v)", err)
+			}
+			got, readErr := ioutil.ReadFile(path)
+			if test.wantErr {
+				if readErr == nil {
+					t.Error("unverified file was moved into place")
+				}
+				return
+			}
+			if !bytes.Equal(got, content) {
+				t.Errorf("downloaded %v bytes that do not match the resource (%v)", len(got), readErr)
+			}
+		})
+	}
+}
+
+func TestDownloadResourceNotSupported(t *testing.T) {
+	controller := httptest.NewServer(http.NotFoundHandler())
+	defer controller.Close()
+
+	err := testDownloadSender(t, controller.URL).DownloadResource(context.Background(), "00", filepath.Join(t.TempDir(), "resource"), 0600)
+	if !errors.Is(err, ErrDownloadNotSupported) {
+		t.Errorf("DownloadResource error = %v, want %v", err, ErrDownloadNotSupported)
+	}
+}
+
+func TestDownloadResourceCancelled(t *testing.T) {
+	controller := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "unavailable", http.StatusServiceUnavailable)
+	}))
+	defer controller.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(time.Millisecond*200, cancel)
+
+	start := time.Now()
+	err := testDownloadSender(t, controller.URL).DownloadResource(ctx, "00", filepath.Join(t.TempDir(), "resource"), 0600)
+	if !errors.Is(err, context.Canceled) {
+		t.Errorf("DownloadResource error = %v, want %v", err, context.Canceled)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("DownloadResource took %v to notice the cancellation", elapsed)
+	}
+}
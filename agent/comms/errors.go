@@ -0,0 +1,98 @@
+// Package comms error types returned when communicating with the controller
+package comms
+
+import (
+	"fmt"
+	"net/http"
+	"time"
+)
+
+// maximum number of response body bytes kept in a StatusError
+const maxErrorBody = 1024
+
+// NetworkError is returned when the controller could not be reached (or the connection failed part way)
+type NetworkError struct {
+	URL string
+	Err error
+}
+
+func (e *NetworkError) Error() string {
+	return "NETWORK ERROR: " + e.Err.Error()
+}
+
+// Unwrap returns the underlying transport error
+func (e *NetworkError) Unwrap() error {
+	return e.Err
+}
+
+// StatusError is returned when the controller responds with a status other than 200 OK
+type StatusError struct {
+	StatusCode int
+	Status     string        // e.g. "503 Service Unavailable"
+	Body       string        // start of the response body
+	RetryAfter time.Duration // delay requested with a Retry-After header (zero if none)
+}
+
+func (e *StatusError) Error() string {
+	return "Received bad status: " + e.Status
+}
+
+// Temporary reports whether the request may succeed if retried later
+// (throttling, timeouts and unavailable or overloaded controllers)
+func (e *StatusError) Temporary() bool {
+	switch e.StatusCode {
+	case http.StatusRequestTimeout, http.StatusTooEarly, http.StatusTooManyRequests,
+		http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+		return true
+	}
+	return false
+}
+
+// Rejected reports whether the controller refused the content of the request (malformed, too large or invalid)
+// or keeps failing on it (server errors other than the temporary 502, 503 and 504).
+// Sending the same request again will not help. Authentication errors and missing endpoints
+// are not the request's fault and are not rejections
+func (e *StatusError) Rejected() bool {
+	switch e.StatusCode {
+	case http.StatusBadRequest, http.StatusRequestEntityTooLarge, http.StatusUnprocessableEntity:
+		return true
+	}
+	return e.StatusCode >= http.StatusInternalServerError && !e.Temporary()
+}
+
+// newStatusError creates a StatusError from a response and its body
+func newStatusError(resp *http.Response, body []byte) *StatusError {
+	if len(body) > maxErrorBody {
+		body = body[:maxErrorBody]
+	}
+	return &StatusError{
+		StatusCode: resp.StatusCode,
+		Status:     resp.Status,
+		Body:       string(body),
+		RetryAfter: parseRetryAfter(resp.Header.Get("Retry-After")),
+	}
+}
+
+// SignatureError is returned when a controller response is not signed by the controller's certificate
+type SignatureError struct {
+	URI string
+}
+
+func (e *SignatureError) Error() string {
+	return "unable to verify response signature"
+}
+
+// DecodeError is returned when a controller response cannot be read or parsed
+type DecodeError struct {
+	What string // what was being decoded, e.g. "payload map"
+	Err  error
+}
+
+func (e *DecodeError) Error() string {
+	return fmt.Sprintf("Unable to %s: %v", e.What, e.Err)
+}
+
+// Unwrap returns the underlying decoding error
+func (e *DecodeError) Unwrap() error {
+	return e.Err
+}
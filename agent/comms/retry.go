@@ -0,0 +1,209 @@
+// Package comms retry policy, backoff and per endpoint circuit breakers
+package comms
+
+import (
+	"errors"
+	mathrand "math/rand"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ErrCircuitOpen is returned (wrapped in a NetworkError) instead of contacting an endpoint that has been failing
+var ErrCircuitOpen = errors.New("circuit breaker open: endpoint recently failed")
+
+// RetryPolicy controls how failed requests to the controller are retried
+type RetryPolicy struct {
+	BaseInterval     time.Duration // delay ceiling after the first failure
+	MaxInterval      time.Duration // upper limit of the delay ceiling
+	BreakerThreshold int           // consecutive failures before an endpoint's circuit opens
+	BreakerCooldown  time.Duration // time an open circuit stays open before the endpoint is tried again
+}
+
+// DefaultRetryPolicy is used for any RetryPolicy value left at zero
+var DefaultRetryPolicy = RetryPolicy{
+	BaseInterval:     time.Second * 5,
+	MaxInterval:      time.Minute * 5,
+	BreakerThreshold: 3,
+	BreakerCooldown:  time.Minute * 5,
+}
+
+// withDefaults fills unset values from DefaultRetryPolicy
+func (p RetryPolicy) withDefaults() RetryPolicy {
+	if p.BaseInterval <= 0 {
+		p.BaseInterval = DefaultRetryPolicy.BaseInterval
+	}
+	if p.MaxInterval <= 0 {
+		p.MaxInterval = DefaultRetryPolicy.MaxInterval
+	}
+	if p.MaxInterval < p.BaseInterval {
+		p.MaxInterval = p.BaseInterval
+	}
+	if p.BreakerThreshold <= 0 {
+		p.BreakerThreshold = DefaultRetryPolicy.BreakerThreshold
+	}
+	if p.BreakerCooldown <= 0 {
+		p.BreakerCooldown = DefaultRetryPolicy.BreakerCooldown
+	}
+	return p
+}
+
+// Backoff computes delays between retries of a failing operation using exponential backoff with full jitter
+// A Backoff is not safe for concurrent use; each retry loop should have its own
+type Backoff struct {
+	Policy   RetryPolicy
+	failures int
+}
+
+// NewBackoff returns a Backoff using the given policy
+func NewBackoff(policy RetryPolicy) *Backoff {
+	return &Backoff{Policy: policy.withDefaults()}
+}
+
+// Next records a failure and returns how long to wait before retrying
+// The delay is random between zero and BaseInterval * 2^failures (capped at MaxInterval)
+// but never shorter than a Retry-After requested by the controller
+func (b *Backoff) Next(err error) time.Duration {
+	policy := b.Policy.withDefaults()
+	b.failures++
+
+	ceiling := policy.BaseInterval
+	for i := 1; i < b.failures && ceiling < policy.MaxInterval; i++ {
+		ceiling *= 2
+	}
+	if ceiling > policy.MaxInterval {
+		ceiling = policy.MaxInterval
+	}
+	delay := time.Duration(mathrand.Int63n(int64(ceiling) + 1))
+
+	if retryAfter := RetryAfter(err); retryAfter > delay {
+		delay = retryAfter
+	}
+	return delay
+}
+
+// Reset clears the failure count after a success
+func (b *Backoff) Reset() {
+	b.failures = 0
+}
+
+// Failures returns the number of consecutive failures
+func (b *Backoff) Failures() int {
+	return b.failures
+}
+
+// RetryAfter returns the delay requested by the controller with a Retry-After header (zero if none)
+func RetryAfter(err error) time.Duration {
+	var statusErr *StatusError
+	if errors.As(err, &statusErr) {
+		return statusErr.RetryAfter
+	}
+	return 0
+}
+
+// IsConnectivityError reports whether an error means the active controller / proxy could not be used
+// (the network failed or the controller is unavailable), as opposed to the controller rejecting a request
+func IsConnectivityError(err error) bool {
+	var networkErr *NetworkError
+	var statusErr *StatusError
+	if errors.As(err, &networkErr) {
+		return true
+	}
+	return errors.As(err, &statusErr) && statusErr.Temporary()
+}
+
+// parseRetryAfter parses a Retry-After header given in seconds or as an HTTP date
+func parseRetryAfter(value string) time.Duration {
+	value = strings.TrimSpace(value)
+	if value == "" {
+		return 0
+	}
+	if seconds, err := strconv.Atoi(value); err == nil && seconds > 0 {
+		return time.Second * time.Duration(seconds)
+	}
+	if date, err := http.ParseTime(value); err == nil {
+		if delay := time.Until(date); delay > 0 {
+			return delay
+		}
+	}
+	return 0
+}
+
+// breaker struct tracks failures of a single controller / proxy endpoint
+type breaker struct {
+	failures  int
+	openUntil time.Time
+}
+
+// breakers struct holds the circuit breakers of all endpoints a sender has used
+type breakers struct {
+	mutex    sync.Mutex
+	policy   RetryPolicy
+	byTarget map[string]*breaker
+}
+
+// newBreakers creates an empty set of circuit breakers
+func newBreakers(policy RetryPolicy) *breakers {
+	return &breakers{policy: policy.withDefaults(), byTarget: make(map[string]*breaker)}
+}
+
+// endpointKey identifies a controller / proxy endpoint
+func endpointKey(controllerURL, proxy string) string {
+	if strings.ToLower(proxy) == "none" {
+		proxy = ""
+	}
+	return strings.TrimSuffix(controllerURL, "/") + " via " + proxy
+}
+
+// allow reports whether an endpoint may be used (its circuit is closed or its cooldown has passed)
+func (b *breakers) allow(key string) bool {
+	if b == nil {
+		return true
+	}
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	br, ok := b.byTarget[key]
+	return !ok || time.Now().After(br.openUntil)
+}
+
+// record updates an endpoint's circuit with the result of a request
+// The circuit opens after BreakerThreshold consecutive connectivity failures,
+// or straight away for as long as the controller asked with Retry-After
+func (b *breakers) record(key string, err error) {
+	if b == nil || errors.Is(err, ErrCircuitOpen) {
+		return
+	}
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	br, ok := b.byTarget[key]
+	if !ok {
+		br = &breaker{}
+		b.byTarget[key] = br
+	}
+
+	if err == nil || !IsConnectivityError(err) {
+		br.failures = 0
+		br.openUntil = time.Time{}
+		return
+	}
+
+	br.failures++
+	if br.failures >= b.policy.BreakerThreshold {
+		br.openUntil = time.Now().Add(b.policy.BreakerCooldown)
+	}
+	if retryAfter := RetryAfter(err); retryAfter > 0 && time.Now().Add(retryAfter).After(br.openUntil) {
+		br.openUntil = time.Now().Add(retryAfter)
+	}
+}
+
+// setPolicy replaces the policy used for new failures
+func (b *breakers) setPolicy(policy RetryPolicy) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	b.policy = policy.withDefaults()
+}
@@ -0,0 +1,182 @@
+package comms
+
+import (
+	"errors"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestBackoffNext(t *testing.T) {
+	policy := RetryPolicy{BaseInterval: time.Second, MaxInterval: time.Second * 10}
+	networkErr := &NetworkError{URL: "https://controller/", Err: errors.New("connection refused")}
+
+	tests := []struct {
+		failures int           // failures before the one measured
+		ceiling  time.Duration // largest delay allowed
+	}{
+		{0, time.Second},
+		{1, time.Second * 2},
+		{2, time.Second * 4},
+		{3, time.Second * 8},
+		{4, time.Second * 10},
+		{20, time.Second * 10},
+	}
+
+	for _, test := range tests {
+		backoff := NewBackoff(policy)
+		for i := 0; i < test.failures; i++ {
+			backoff.Next(networkErr)
+		}
+		for i := 0; i < 50; i++ {
+			b := *backoff
+			if delay := b.Next(networkErr); delay < 0 || delay > test.ceiling {
+				t.Errorf("delay after %v failures = %v, want 0 to %v", test.failures+1, delay, test.ceiling)
+			}
+		}
+		if got := backoff.Failures(); got != test.failures {
+			t.Errorf("Failures() = %v, want %v", got, test.failures)
+		}
+	}
+}
+
+func TestBackoffRetryAfterAndReset(t *testing.T) {
+	backoff := NewBackoff(RetryPolicy{BaseInterval: time.Millisecond, MaxInterval: time.Millisecond})
+
+	throttled := &StatusError{StatusCode: http.StatusTooManyRequests, RetryAfter: time.Minute}
+	if delay := backoff.Next(throttled); delay != time.Minute {
+		t.Errorf("delay = %v, want the requested %v", delay, time.Minute)
+	}
+
+	backoff.Next(nil)
+	backoff.Reset()
+	if got := backoff.Failures(); got != 0 {
+		t.Errorf("Failures() after Reset = %v, want 0", got)
+	}
+}
+
+func TestRetryPolicyDefaults(t *testing.T) {
+	tests := []struct {
+		name   string
+		policy RetryPolicy
+		want   RetryPolicy
+	}{
+		{"zero", RetryPolicy{}, DefaultRetryPolicy},
+		{"configured", RetryPolicy{time.Second, time.Minute, 5, time.Hour}, RetryPolicy{time.Second, time.Minute, 5, time.Hour}},
+		{"max below base", RetryPolicy{BaseInterval: time.Minute, MaxInterval: time.Second}, RetryPolicy{time.Minute, time.Minute, DefaultRetryPolicy.BreakerThreshold, DefaultRetryPolicy.BreakerCooldown}},
+	}
+
+	for _, test := range tests {
+		if got := test.policy.withDefaults(); got != test.want {
+			t.Errorf("%s: withDefaults() = %+v, want %+v", test.name, got, test.want)
+		}
+	}
+}
+
+func TestBreakers(t *testing.T) {
+	networkErr := &NetworkError{URL: "https://controller/", Err: errors.New("connection refused")}
+	unavailable := &StatusError{StatusCode: http.StatusServiceUnavailable}
+	rejected := &StatusError{StatusCode: http.StatusBadRequest}
+	throttled := &StatusError{StatusCode: http.StatusTooManyRequests, RetryAfter: time.Hour}
+
+	tests := []struct {
+		name    string
+		results []error
+		allowed bool
+	}{
+		{"no requests", nil, true},
+		{"below threshold", []error{networkErr, unavailable}, true},
+		{"threshold reached", []error{networkErr, unavailable, networkErr}, false},
+		{"success resets", []error{networkErr, networkErr, nil, networkErr}, true},
+		{"rejection is not a connectivity failure", []error{networkErr, networkErr, rejected, networkErr}, true},
+		{"retry after opens straight away", []error{throttled}, false},
+		{"open circuit errors are not counted", []error{networkErr, networkErr, ErrCircuitOpen, &NetworkError{Err: ErrCircuitOpen}}, true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			b := newBreakers(RetryPolicy{BreakerThreshold: 3, BreakerCooldown: time.Hour})
+			key := endpointKey("https://controller/", "none")
+			for _, err := range test.results {
+				b.record(key, err)
+			}
+			if got := b.allow(key); got != test.allowed {
+				t.Errorf("allow() = %v, want %v", got, test.allowed)
+			}
+			if !b.allow(endpointKey("https://other/", "")) {
+				t.Error("failures of one endpoint closed the circuit of another")
+			}
+		})
+	}
+}
+
+func TestBreakerCooldown(t *testing.T) {
+	b := newBreakers(RetryPolicy{BreakerThreshold: 1, BreakerCooldown: time.Millisecond * 50})
+	key := endpointKey("https://controller", "http://proxy:8080")
+
+	b.record(key, &NetworkError{Err: errors.New("timeout")})
+	if b.allow(key) {
+		t.Fatal("circuit closed after a failure at threshold 1")
+	}
+	time.Sleep(time.Millisecond * 60)
+	if !b.allow(key) {
+		t.Error("circuit still open after the cooldown")
+	}
+
+	var none *breakers
+	if !none.allow(key) {
+		t.Error("nil breakers refused an endpoint")
+	}
+}
+
+func TestEndpointKey(t *testing.T) {
+	if endpointKey("https://controller/", "none") != endpointKey("https://controller", "") {
+		t.Error("trailing slash or proxy none changed the endpoint key")
+	}
+	if endpointKey("https://controller", "") == endpointKey("https://controller", "http://proxy:8080") {
+		t.Error("proxy not part of the endpoint key")
+	}
+}
+
+func TestParseRetryAfter(t *testing.T) {
+	tests := []struct {
+		value string
+		min   time.Duration
+		max   time.Duration
+	}{
+		{"", 0, 0},
+		{"120", time.Minute * 2, time.Minute * 2},
+		{" 5 ", time.Second * 5, time.Second * 5},
+		{"-1", 0, 0},
+		{"soon", 0, 0},
+		{time.Now().Add(time.Hour).UTC().Format(http.TimeFormat), time.Minute * 59, time.Hour},
+		{time.Now().Add(-time.Hour).UTC().Format(http.TimeFormat), 0, 0},
+	}
+
+	for _, test := range tests {
+		if got := parseRetryAfter(test.value); got < test.min || got > test.max {
+			t.Errorf("parseRetryAfter(%q) = %v, want %v to %v", test.value, got, test.min, test.max)
+		}
+	}
+}
+
+func TestIsConnectivityError(t *testing.T) {
+	tests := []struct {
+		err  error
+		want bool
+	}{
+		{&NetworkError{Err: errors.New("connection refused")}, true},
+		{&StatusError{StatusCode: http.StatusServiceUnavailable}, true},
+		{&StatusError{StatusCode: http.StatusTooManyRequests}, true},
+		{&StatusError{StatusCode: http.StatusBadRequest}, false},
+		{&StatusError{StatusCode: http.StatusForbidden}, false},
+		{errors.New("other"), false},
+		{nil, false},
+	}
+
+	for _, test := range tests {
+		if got := IsConnectivityError(test.err); got != test.want {
+			t.Errorf("IsConnectivityError(%v) = %v, want %v", test.err, got, test.want)
+		}
+	}
+}
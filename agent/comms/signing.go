@@ -0,0 +1,261 @@
+// Package comms signature algorithms for signed envelopes
+package comms
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"net/http"
+	"strings"
+	"sync"
+)
+
+// Signature algorithms, labelled in the SIGNATURE_ALGORITHM field of signed envelopes
+const (
+	AlgRS256 = "RS256" // RSA PKCS #1 v1.5 with SHA-256 -- assumed when an envelope has no label
+	AlgPS256 = "PS256" // RSA-PSS with SHA-256
+	AlgES256 = "ES256" // ECDSA P-256 with SHA-256
+	AlgEdDSA = "EdDSA" // Ed25519
+)
+
+// signatureAlgorithmField labels the algorithm of the SIGNATURE field of an envelope
+const signatureAlgorithmField = "SIGNATURE_ALGORITHM"
+
+// signatureAlgorithmsHeader is set by controllers to list the signature algorithms they verify
+// Controllers that do not set it are assumed to only verify RS256
+const signatureAlgorithmsHeader = "X-Ghost-Signature-Algorithms"
+
+// signerCache keeps parsed private keys so every signed message does not parse (and check) the pem key again
+type signerCache struct {
+	mutex   sync.Mutex
+	signers map[string]crypto.Signer // by pem private key
+}
+
+// get returns the parsed pem private key
+// Only the current and previous keys are in use at any time, so the cache is emptied when it grows past a few keys
+// A nil cache (sender not initialized) parses the key every time
+func (c *signerCache) get(keyPEM string) (crypto.Signer, error) {
+	if c == nil {
+		return ParsePrivateKey(keyPEM)
+	}
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if signer, ok := c.signers[keyPEM]; ok {
+		return signer, nil
+	}
+
+	signer, err := ParsePrivateKey(keyPEM)
+	if err != nil {
+		return nil, err
+	}
+	if c.signers == nil || len(c.signers) >= 4 {
+		c.signers = make(map[string]crypto.Signer)
+	}
+	c.signers[keyPEM] = signer
+	return signer, nil
+}
+
+// ParsePrivateKey parses a pem private key (PKCS #1 RSA, SEC 1 EC or PKCS #8 RSA, ECDSA and Ed25519 keys)
+func ParsePrivateKey(keyPEM string) (crypto.Signer, error) {
+	block, _ := pem.Decode([]byte(keyPEM))
+	if block == nil {
+		return nil, errors.New("failed to decode PEM block of private key")
+	}
+
+	switch block.Type {
+	case "RSA PRIVATE KEY":
+		return x509.ParsePKCS1PrivateKey(block.Bytes)
+	case "EC PRIVATE KEY":
+		return x509.ParseECPrivateKey(block.Bytes)
+	}
+
+	key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+	signer, ok := key.(crypto.Signer)
+	if !ok {
+		return nil, errors.New("unsupported private key type")
+	}
+	return signer, nil
+}
+
+// ParsePublicKey parses a pem certificate, PKIX public key or PKCS #1 RSA public key
+func ParsePublicKey(keyPEM string) (crypto.PublicKey, error) {
+	block, _ := pem.Decode([]byte(keyPEM))
+	if block == nil {
+		return nil, errors.New("failed to decode PEM block of public key")
+	}
+
+	switch block.Type {
+	case "CERTIFICATE":
+		cert, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			return nil, err
+		}
+		return cert.PublicKey, nil
+	case "RSA PUBLIC KEY":
+		// agents used to label PKIX keys as RSA PUBLIC KEY
+		if key, err := x509.ParsePKCS1PublicKey(block.Bytes); err == nil {
+			return key, nil
+		}
+	}
+	return x509.ParsePKIXPublicKey(block.Bytes)
+}
+
+// KeyAlgorithm returns the algorithm used to sign with a key
+// RSA keys use preferred if it is PS256 and RS256 otherwise
+func KeyAlgorithm(key crypto.PublicKey, preferred string) (string, error) {
+	switch k := key.(type) {
+	case *rsa.PublicKey:
+		if preferred == AlgPS256 {
+			return AlgPS256, nil
+		}
+		return AlgRS256, nil
+	case *ecdsa.PublicKey:
+		if k.Curve != elliptic.P256() {
+			return "", errors.New("unsupported ECDSA curve " + k.Curve.Params().Name)
+		}
+		return AlgES256, nil
+	case ed25519.PublicKey:
+		return AlgEdDSA, nil
+	}
+	return "", errors.New("unsupported key type")
+}
+
+// Sign signs data with a key using the given algorithm
+func Sign(key crypto.Signer, algorithm string, data []byte) ([]byte, error) {
+	if err := checkAlgorithm(key.Public(), algorithm); err != nil {
+		return nil, err
+	}
+
+	// Ed25519 signs the message itself
+	if algorithm == AlgEdDSA {
+		return key.Sign(rand.Reader, data, crypto.Hash(0))
+	}
+
+	hashed := sha256.Sum256(data)
+	if algorithm == AlgPS256 {
+		return key.Sign(rand.Reader, hashed[:], &rsa.PSSOptions{SaltLength: rsa.PSSSaltLengthEqualsHash, Hash: crypto.SHA256})
+	}
+
+	// PKCS #1 v1.5 for RS256 and ASN.1 signatures for ES256
+	return key.Sign(rand.Reader, hashed[:], crypto.SHA256)
+}
+
+// Verify checks a signature of data made with the given algorithm
+func Verify(key crypto.PublicKey, algorithm string, data, signature []byte) error {
+	if algorithm == "" {
+		algorithm = AlgRS256
+	}
+	if err := checkAlgorithm(key, algorithm); err != nil {
+		return err
+	}
+
+	hashed := sha256.Sum256(data)
+	switch algorithm {
+	case AlgRS256:
+		return rsa.VerifyPKCS1v15(key.(*rsa.PublicKey), crypto.SHA256, hashed[:], signature)
+	case AlgPS256:
+		return rsa.VerifyPSS(key.(*rsa.PublicKey), crypto.SHA256, hashed[:], signature, &rsa.PSSOptions{SaltLength: rsa.PSSSaltLengthAuto})
+	case AlgES256:
+		if !ecdsa.VerifyASN1(key.(*ecdsa.PublicKey), hashed[:], signature) {
+			return errors.New("ECDSA verification error")
+		}
+	case AlgEdDSA:
+		if !ed25519.Verify(key.(ed25519.PublicKey), data, signature) {
+			return errors.New("Ed25519 verification error")
+		}
+	}
+	return nil
+}
+
+// checkAlgorithm makes sure an algorithm can be used with a key
+// (so a signature cannot be checked with an algorithm the key was not made for)
+func checkAlgorithm(key crypto.PublicKey, algorithm string) error {
+	keyAlgorithm, err := KeyAlgorithm(key, algorithm)
+	if err != nil {
+		return err
+	}
+	if keyAlgorithm != algorithm {
+		return errors.New("signature algorithm " + algorithm + " does not match the key type")
+	}
+	return nil
+}
+
+// algSet holds the signature algorithms the active controller verifies
+// It has its own lock as it is read and updated both with and without the sender locked
+type algSet struct {
+	mutex      sync.RWMutex
+	algorithms []string
+}
+
+// contains reports whether an algorithm is in the set. A nil set (sender not initialized) is empty
+func (a *algSet) contains(algorithm string) bool {
+	if a == nil {
+		return false
+	}
+
+	a.mutex.RLock()
+	defer a.mutex.RUnlock()
+
+	for _, accepted := range a.algorithms {
+		if accepted == algorithm {
+			return true
+		}
+	}
+	return false
+}
+
+// replace sets the algorithms in the set
+func (a *algSet) replace(algorithms []string) {
+	if a == nil {
+		return
+	}
+
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	a.algorithms = algorithms
+}
+
+// AcceptsAlgorithm reports whether the active controller has said it verifies signatures made with an algorithm
+// RS256 is always accepted. Safe to call while other goroutines are using the sender
+func (s *Sender) AcceptsAlgorithm(algorithm string) bool {
+	return algorithm == AlgRS256 || s.acceptedAlgorithms.contains(algorithm)
+}
+
+// learnAlgorithms records the signature algorithms the controller verifies
+// Responses without the header leave what was learned from earlier responses in place
+func (s *Sender) learnAlgorithms(resp *http.Response) {
+	header := resp.Header.Get(signatureAlgorithmsHeader)
+	if header == "" {
+		return
+	}
+
+	var algorithms []string
+	for _, algorithm := range strings.Split(header, ",") {
+		if algorithm = strings.TrimSpace(algorithm); algorithm != "" {
+			algorithms = append(algorithms, algorithm)
+		}
+	}
+	s.acceptedAlgorithms.replace(algorithms)
+}
+
+// signingAlgorithm returns the algorithm the sender signs with when using a private key (the sender must be locked)
+// RSA keys are signed with PS256 when configured and the controller accepts it
+func (s *Sender) signingAlgorithm(key crypto.Signer) (string, error) {
+	preferred := AlgRS256
+	if s.SignatureAlgorithm == AlgPS256 && s.AcceptsAlgorithm(AlgPS256) {
+		preferred = AlgPS256
+	}
+	return KeyAlgorithm(key.Public(), preferred)
+}
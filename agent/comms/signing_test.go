@@ -0,0 +1,115 @@
+package comms
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"testing"
+)
+
+// testSigners returns a key of each supported type by signature algorithm
+func testSigners(t *testing.T) map[string]crypto.Signer {
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, edKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return map[string]crypto.Signer{
+		AlgRS256: rsaKey,
+		AlgPS256: rsaKey,
+		AlgES256: ecKey,
+		AlgEdDSA: edKey,
+	}
+}
+
+func TestSignVerify(t *testing.T) {
+	data := []byte(`{"uuid":"test","message":"hello"}`)
+
+	for algorithm, key := range testSigners(t) {
+		t.Run(algorithm, func(t *testing.T) {
+			signature, err := Sign(key, algorithm, data)
+			if err != nil {
+				t.Fatalf("Sign: %v", err)
+			}
+			if err := Verify(key.Public(), algorithm, data, signature); err != nil {
+				t.Errorf("Verify: %v", err)
+			}
+
+			// tampered data
+			tampered := append([]byte{}, data...)
+			tampered[0] = '['
+			if err := Verify(key.Public(), algorithm, tampered, signature); err == nil {
+				t.Error("Verify accepted tampered data")
+			}
+		})
+	}
+}
+
+func TestVerifyDefaultsToRS256(t *testing.T) {
+	key := testSigners(t)[AlgRS256]
+	data := []byte("unlabelled envelope")
+
+	signature, err := Sign(key, AlgRS256, data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := Verify(key.Public(), "", data, signature); err != nil {
+		t.Errorf("Verify without algorithm: %v", err)
+	}
+}
+
+func TestSignWrongAlgorithm(t *testing.T) {
+	signers := testSigners(t)
+	data := []byte("data")
+
+	tests := []struct {
+		key       string
+		algorithm string
+	}{
+		{AlgRS256, AlgES256},
+		{AlgRS256, AlgEdDSA},
+		{AlgES256, AlgRS256},
+		{AlgES256, AlgPS256},
+		{AlgEdDSA, AlgES256},
+		{AlgRS256, "HS256"},
+	}
+
+	for _, test := range tests {
+		key := signers[test.key]
+		if _, err := Sign(key, test.algorithm, data); err == nil {
+			t.Errorf("Sign with %s key and %s algorithm succeeded", test.key, test.algorithm)
+		}
+
+		signature, err := Sign(key, test.key, data)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := Verify(key.Public(), test.algorithm, data, signature); err == nil {
+			t.Errorf("Verify of %s signature as %s succeeded", test.key, test.algorithm)
+		}
+	}
+}
+
+func TestVerifyRS256AsPS256(t *testing.T) {
+	key := testSigners(t)[AlgRS256]
+	data := []byte("data")
+
+	signature, err := Sign(key, AlgRS256, data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := Verify(key.Public(), AlgPS256, data, signature); err == nil {
+		t.Error("PKCS #1 v1.5 signature verified as PSS")
+	}
+}
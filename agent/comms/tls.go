@@ -0,0 +1,120 @@
+// Package comms TLS verification and certificate pinning
+package comms
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"strings"
+)
+
+// TLS pin modes
+const (
+	PinNone        = ""            // certificate chain and host name are verified against the CA bundle
+	PinCertificate = "certificate" // the controller must present exactly ServerCertificate (no chain verification)
+	PinSPKI        = "spki"        // the chain is verified and the controller's public key must match ServerCertificate or TLSPinnedKeys
+)
+
+// errPinMismatch is returned when the controller's certificate does not match the configured pins
+var errPinMismatch = errors.New("pin mismatch")
+
+// tlsConfig builds the TLS client configuration from the sender's verification settings
+func (s *Sender) tlsConfig() (*tls.Config, error) {
+	config := &tls.Config{MinVersion: tls.VersionTLS12}
+
+	// trust the configured CA bundle instead of the system roots
+	if s.TLSCABundle != "" {
+		pemBytes, err := ioutil.ReadFile(s.TLSCABundle)
+		if err != nil {
+			return nil, errors.New("unable to read CA bundle: " + err.Error())
+		}
+		config.RootCAs = x509.NewCertPool()
+		if !config.RootCAs.AppendCertsFromPEM(pemBytes) {
+			return nil, errors.New("no certificates found in CA bundle " + s.TLSCABundle)
+		}
+	}
+
+	switch strings.ToLower(s.TLSPinMode) {
+	case PinNone:
+		return config, nil
+
+	case PinCertificate:
+		pinned, err := parseCertificate(s.ServerCertificate)
+		if err != nil {
+			return nil, errors.New("unable to pin server certificate: " + err.Error())
+		}
+
+		// the exact certificate match replaces chain verification so self signed controller certificates work
+		config.InsecureSkipVerify = true
+		config.VerifyConnection = func(state tls.ConnectionState) error {
+			if len(state.PeerCertificates) == 0 || !bytes.Equal(state.PeerCertificates[0].Raw, pinned.Raw) {
+				return fmt.Errorf("certificate %w: controller did not present the configured ServerCertificate", errPinMismatch)
+			}
+			return nil
+		}
+		return config, nil
+
+	case PinSPKI:
+		pins := make(map[string]bool)
+		if pinned, err := parseCertificate(s.ServerCertificate); err == nil {
+			pins[spkiHash(pinned)] = true
+		}
+		for _, pin := range s.TLSPinnedKeys {
+			pins[strings.TrimPrefix(pin, "sha256/")] = true
+		}
+		if len(pins) == 0 {
+			return nil, errors.New("SPKI pinning requires a ServerCertificate or TLSPinnedKeys")
+		}
+
+		// runs after the normal chain verification
+		config.VerifyConnection = func(state tls.ConnectionState) error {
+			if len(state.PeerCertificates) == 0 || !pins[spkiHash(state.PeerCertificates[0])] {
+				return fmt.Errorf("public key %w: controller key is not in the configured pins", errPinMismatch)
+			}
+			return nil
+		}
+		return config, nil
+	}
+
+	return nil, errors.New("unknown TLS pin mode: " + s.TLSPinMode)
+}
+
+// spkiHash returns the base64 encoded sha256 of a certificate's subject public key info
+func spkiHash(cert *x509.Certificate) string {
+	sum := sha256.Sum256(cert.RawSubjectPublicKeyInfo)
+	return base64.StdEncoding.EncodeToString(sum[:])
+}
+
+// parseCertificate parses a pem encoded certificate
+func parseCertificate(certPEM string) (*x509.Certificate, error) {
+	block, _ := pem.Decode([]byte(certPEM))
+	if block == nil {
+		return nil, errors.New("failed to decode PEM block of certificate")
+	}
+	return x509.ParseCertificate(block.Bytes)
+}
+
+// describeConnectionError returns a short explanation of why a connection to the controller failed
+func describeConnectionError(err error) string {
+	var unknownAuthority x509.UnknownAuthorityError
+	var hostname x509.HostnameError
+	var invalid x509.CertificateInvalidError
+
+	switch {
+	case errors.As(err, &unknownAuthority):
+		return "TLS certificate is not signed by a trusted CA: " + err.Error()
+	case errors.As(err, &hostname):
+		return "TLS certificate does not match the controller host name: " + err.Error()
+	case errors.As(err, &invalid):
+		return "TLS certificate is not valid: " + err.Error()
+	case errors.Is(err, errPinMismatch):
+		return "TLS " + err.Error()
+	}
+	return err.Error()
+}
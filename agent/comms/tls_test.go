@@ -0,0 +1,138 @@
+package comms
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"math/big"
+	"testing"
+	"time"
+)
+
+// testCertificate returns a self signed certificate of key
+func testCertificate(t *testing.T, key crypto.Signer, serial int64) *x509.Certificate {
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(serial),
+		Subject:      pkix.Name{CommonName: "controller"},
+		DNSNames:     []string{"controller"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, key.Public(), key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cert
+}
+
+// testKey returns a new P-256 key
+func testKey(t *testing.T) crypto.Signer {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return key
+}
+
+func certificatePEM(cert *x509.Certificate) string {
+	return string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert.Raw}))
+}
+
+func TestTLSPinning(t *testing.T) {
+	controllerKey := testKey(t)
+	controller := testCertificate(t, controllerKey, 1)
+	reissued := testCertificate(t, controllerKey, 2) // same key, new certificate
+	nextKey := testCertificate(t, testKey(t), 3)     // announced key for rollover
+	other := testCertificate(t, testKey(t), 4)
+
+	tests := []struct {
+		name   string
+		sender Sender
+		peer   *x509.Certificate
+		want   bool
+	}{
+		{"certificate match", Sender{TLSPinMode: PinCertificate, ServerCertificate: certificatePEM(controller)}, controller, true},
+		{"certificate mode case", Sender{TLSPinMode: "Certificate", ServerCertificate: certificatePEM(controller)}, controller, true},
+		{"certificate reissued", Sender{TLSPinMode: PinCertificate, ServerCertificate: certificatePEM(controller)}, reissued, false},
+		{"certificate mismatch", Sender{TLSPinMode: PinCertificate, ServerCertificate: certificatePEM(controller)}, other, false},
+		{"spki match", Sender{TLSPinMode: PinSPKI, ServerCertificate: certificatePEM(controller)}, controller, true},
+		{"spki reissued", Sender{TLSPinMode: PinSPKI, ServerCertificate: certificatePEM(controller)}, reissued, true},
+		{"spki mismatch", Sender{TLSPinMode: PinSPKI, ServerCertificate: certificatePEM(controller)}, other, false},
+		{"spki pinned key", Sender{TLSPinMode: PinSPKI, ServerCertificate: certificatePEM(controller), TLSPinnedKeys: []string{spkiHash(nextKey)}}, nextKey, true},
+		{"spki pinned key prefix", Sender{TLSPinMode: PinSPKI, TLSPinnedKeys: []string{"sha256/" + spkiHash(nextKey)}}, nextKey, true},
+		{"spki pinned key only", Sender{TLSPinMode: PinSPKI, TLSPinnedKeys: []string{spkiHash(nextKey)}}, controller, false},
+		{"no peer certificate", Sender{TLSPinMode: PinSPKI, ServerCertificate: certificatePEM(controller)}, nil, false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			config, err := test.sender.tlsConfig()
+			if err != nil {
+				t.Fatalf("tlsConfig: %v", err)
+			}
+
+			var state tls.ConnectionState
+			if test.peer != nil {
+				state.PeerCertificates = []*x509.Certificate{test.peer}
+			}
+			err = config.VerifyConnection(state)
+			if got := err == nil; got != test.want {
+				t.Fatalf("VerifyConnection = %v, want match %v", err, test.want)
+			}
+			if err != nil && !errors.Is(err, errPinMismatch) {
+				t.Errorf("VerifyConnection = %v, want a pin mismatch", err)
+			}
+		})
+	}
+}
+
+func TestTLSConfigModes(t *testing.T) {
+	controller := certificatePEM(testCertificate(t, testKey(t), 1))
+
+	tests := []struct {
+		name          string
+		sender        Sender
+		wantErr       bool
+		skipVerify    bool
+		verifyPinning bool
+	}{
+		{"no pinning", Sender{ServerCertificate: controller}, false, false, false},
+		{"certificate pinning skips chain verification", Sender{TLSPinMode: PinCertificate, ServerCertificate: controller}, false, true, true},
+		{"spki pinning keeps chain verification", Sender{TLSPinMode: PinSPKI, ServerCertificate: controller}, false, false, true},
+		{"certificate pinning without certificate", Sender{TLSPinMode: PinCertificate}, true, false, false},
+		{"spki pinning without pins", Sender{TLSPinMode: PinSPKI}, true, false, false},
+		{"unknown mode", Sender{TLSPinMode: "fingerprint", ServerCertificate: controller}, true, false, false},
+		{"missing CA bundle", Sender{TLSCABundle: "/nonexistent/ca.pem"}, true, false, false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			config, err := test.sender.tlsConfig()
+			if (err != nil) != test.wantErr {
+				t.Fatalf("tlsConfig error = %v, want error %v", err, test.wantErr)
+			}
+			if err != nil {
+				return
+			}
+			if config.InsecureSkipVerify != test.skipVerify {
+				t.Errorf("InsecureSkipVerify = %v, want %v", config.InsecureSkipVerify, test.skipVerify)
+			}
+			if (config.VerifyConnection != nil) != test.verifyPinning {
+				t.Errorf("VerifyConnection set = %v, want %v", config.VerifyConnection != nil, test.verifyPinning)
+			}
+			if config.MinVersion != tls.VersionTLS12 {
+				t.Errorf("MinVersion = %x, want TLS 1.2", config.MinVersion)
+			}
+		})
+	}
+}
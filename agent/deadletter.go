@@ -0,0 +1,113 @@
+// Dead letter mode -- inspects, requeues or purges messages the controller rejected
+package main
+
+import (
+	"fmt"
+	"ghost/agent/client"
+	"os"
+	"path/filepath"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/jessevdk/go-flags"
+)
+
+// deadLetterPreview is the number of message characters "deadletter list" prints without --full
+const deadLetterPreview = 60
+
+// DeadLetterMain runs "deadletter list", "deadletter requeue" and "deadletter purge"
+// Requeued messages are sent by the agent the next time its message queue manager runs
+// INPUT: args ([]string), command line arguments following "deadletter"
+// OUTPUT: process exit code
+func DeadLetterMain(args []string) int {
+	var opts struct {
+		IDs  []int  `long:"id" description:"Dead letter to act on (may be repeated)"`
+		All  bool   `long:"all" description:"Requeue or purge every dead letter"`
+		URI  string `long:"uri" description:"Only act on messages for this post uri"`
+		Full bool   `long:"full" description:"List complete messages instead of a preview"`
+		Args struct {
+			Command string `description:"list, requeue or purge"`
+		} `positional-args:"yes" required:"yes"`
+	}
+
+	parser := flags.NewParser(&opts, flags.Default)
+	parser.Usage = "deadletter [OPTIONS] list|requeue|purge"
+	if _, err := parser.ParseArgs(args); err != nil {
+		return 1
+	}
+	command := opts.Args.Command
+	if command != "list" && command != "requeue" && command != "purge" {
+		fmt.Fprintf(os.Stderr, "Unknown deadletter command %q: use list, requeue or purge\n", command)
+		return 1
+	}
+	// never requeue or purge everything by accident
+	if command != "list" && len(opts.IDs) == 0 && !opts.All && opts.URI == "" {
+		fmt.Fprintf(os.Stderr, "Select the dead letters to %s with --id, --uri or --all\n", command)
+		return 1
+	}
+
+	// the local database lives in the install directory
+	var agent client.Client
+	var err error
+	agent.InstallDir, err = filepath.Abs(filepath.Dir(os.Args[0]))
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Unable to find install directory: %v\n", err)
+		return 1
+	}
+	if err := agent.OpenLocalDb(); err != nil {
+		fmt.Fprintf(os.Stderr, "Unable to open local database: %v\n", err)
+		return 1
+	}
+	defer agent.LocalDb.Close()
+
+	switch command {
+	case "requeue":
+		n, err := agent.LocalDb.DeadLetterRequeue(opts.IDs, opts.URI)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Unable to requeue dead letters: %v\n", err)
+			return 1
+		}
+		fmt.Printf("Requeued %v messages\n", n)
+	case "purge":
+		n, err := agent.LocalDb.DeadLetterPurge(opts.IDs, opts.URI)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Unable to purge dead letters: %v\n", err)
+			return 1
+		}
+		fmt.Printf("Purged %v messages\n", n)
+	default:
+		letters, err := agent.LocalDb.DeadLetterSelect(opts.IDs, opts.URI)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Unable to read dead letters: %v\n", err)
+			return 1
+		}
+		printDeadLetters(letters, opts.Full)
+	}
+	return 0
+}
+
+// printDeadLetters writes dead letters to standard output as a table
+func printDeadLetters(letters []client.DeadLetter, full bool) {
+	if len(letters) == 0 {
+		fmt.Println("No dead letters")
+		return
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "ID\tREJECTED\tURI\tSTATUS\tERROR\tMESSAGE")
+	for _, letter := range letters {
+		message := letter.PostString
+		if !full && len(message) > deadLetterPreview {
+			message = message[:deadLetterPreview] + "..."
+		}
+		fmt.Fprintf(w, "%v\t%s\t%s\t%v\t%s\t%s\n", letter.ID, letter.Rejected.Local().Format(time.RFC3339),
+			letter.PostURI, letter.StatusCode, oneLine(letter.Error), oneLine(message))
+	}
+	w.Flush()
+}
+
+// oneLine replaces line breaks and tabs so a value fits in a table cell
+func oneLine(s string) string {
+	return strings.NewReplacer("\r", " ", "\n", " ", "\t", " ").Replace(s)
+}
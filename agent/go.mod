@@ -8,7 +8,9 @@ require (
 	github.com/mattn/go-sqlite3 v1.14.8
 	github.com/mitchellh/go-ps v1.0.0
 	github.com/shirou/gopsutil v3.21.7+incompatible
+	golang.org/x/crypto v0.0.0-20211117183948-ae814b36b871
 	golang.org/x/sys v0.0.0-20210820121016-41cdb8703e55
+	golang.org/x/term v0.0.0-20210503060354-a79de5458b56
 	gopkg.in/natefinch/lumberjack.v2 v2.0.0
 	gopkg.in/yaml.v2 v2.4.0
 )
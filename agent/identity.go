@@ -0,0 +1,143 @@
+// Identity mode -- exports and imports the agent identity so a reinstalled host keeps its registration
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"ghost/agent/client"
+	"ghost/agent/logger"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/jessevdk/go-flags"
+	"golang.org/x/term"
+)
+
+// IdentityPassphraseEnv is the environment variable the bundle passphrase can be passed in
+const IdentityPassphraseEnv = "GHOST_IDENTITY_PASSPHRASE"
+
+// IdentityMain runs "identity export" and "identity import"
+// The agent must not be running while an identity is imported
+// INPUT: args ([]string), command line arguments following "identity"
+// OUTPUT: process exit code
+func IdentityMain(args []string) int {
+	var opts struct {
+		PassphraseFile string `long:"passphrase-file" description:"File holding the bundle passphrase (default: GHOST_IDENTITY_PASSPHRASE or prompt)"`
+		Force          bool   `long:"force" description:"Import over an agent that is registered with a different identity"`
+		Args           struct {
+			Command    string `description:"export or import"`
+			ConfigFile string `description:"YAML formatted configuration file"`
+			BundleFile string `description:"Identity bundle to write (export) or read (import)"`
+		} `positional-args:"yes" required:"yes"`
+	}
+
+	parser := flags.NewParser(&opts, flags.Default)
+	parser.Usage = "identity [OPTIONS] export|import"
+	if _, err := parser.ParseArgs(args); err != nil {
+		return 1
+	}
+	if opts.Args.Command != "export" && opts.Args.Command != "import" {
+		fmt.Fprintf(os.Stderr, "Unknown identity command %q: use export or import\n", opts.Args.Command)
+		return 1
+	}
+
+	// the key store is opened from the install directory with the agent's configuration
+	config, err := client.LoadConfig(opts.Args.ConfigFile)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Unable to load configuration: %v\n", err)
+		return 1
+	}
+	agent := client.Client{Config: config, ConfigPath: opts.Args.ConfigFile}
+	agent.InstallName = filepath.Base(os.Args[0])
+	agent.InstallDir, err = filepath.Abs(filepath.Dir(os.Args[0]))
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Unable to find install directory: %v\n", err)
+		return 1
+	}
+	agent.Log = logger.Logger{Filename: filepath.Join(agent.InstallDir, "ghost.log"), Level: config.LogLevel}
+
+	if err := agent.OpenLocalDb(); err != nil {
+		fmt.Fprintf(os.Stderr, "Unable to open local database: %v\n", err)
+		return 1
+	}
+	defer agent.LocalDb.Close()
+	if err := agent.EncryptKeyStore(); err != nil {
+		fmt.Fprintf(os.Stderr, "Unable to unlock key store: %v\n", err)
+		return 1
+	}
+
+	passphrase, err := identityPassphrase(opts.PassphraseFile, opts.Args.Command == "export")
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Unable to read passphrase: %v\n", err)
+		return 1
+	}
+
+	if opts.Args.Command == "export" {
+		bundle, err := agent.ExportIdentity(passphrase)
+		if err == nil {
+			err = ioutil.WriteFile(opts.Args.BundleFile, bundle, 0600)
+		}
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Unable to export identity: %v\n", err)
+			return 1
+		}
+		fmt.Printf("Identity exported to %s\n", opts.Args.BundleFile)
+		return 0
+	}
+
+	bundle, err := ioutil.ReadFile(opts.Args.BundleFile)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Unable to read identity bundle: %v\n", err)
+		return 1
+	}
+	identity, err := agent.ImportIdentity(bundle, passphrase, opts.Force)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Unable to import identity: %v\n", err)
+		return 1
+	}
+	fmt.Printf("Imported identity of agent %s\n", identity.UUID)
+	return 0
+}
+
+// identityPassphrase reads the bundle passphrase from a file, the environment or standard input
+// Passphrases typed at a terminal are not echoed and, if confirm is set, have to be entered twice
+func identityPassphrase(path string, confirm bool) (string, error) {
+	if path != "" {
+		content, err := ioutil.ReadFile(path)
+		return strings.TrimRight(string(content), "\r\n"), err
+	}
+	if passphrase := os.Getenv(IdentityPassphraseEnv); passphrase != "" {
+		return passphrase, nil
+	}
+
+	// piped passphrases are read as a single line
+	stdin := int(os.Stdin.Fd())
+	if !term.IsTerminal(stdin) {
+		line, err := bufio.NewReader(os.Stdin).ReadString('\n')
+		if err != nil && line == "" {
+			return "", err
+		}
+		return strings.TrimRight(line, "\r\n"), nil
+	}
+
+	fmt.Fprint(os.Stderr, "Passphrase: ")
+	passphrase, err := term.ReadPassword(stdin)
+	fmt.Fprintln(os.Stderr)
+	if err != nil || !confirm {
+		return string(passphrase), err
+	}
+
+	fmt.Fprint(os.Stderr, "Repeat passphrase: ")
+	repeated, err := term.ReadPassword(stdin)
+	fmt.Fprintln(os.Stderr)
+	if err != nil {
+		return "", err
+	}
+	if string(repeated) != string(passphrase) {
+		return "", errors.New("passphrases do not match")
+	}
+	return string(passphrase), nil
+}
@@ -0,0 +1,25 @@
+// Manages periodic refreshes of host inventory
+package main
+
+import (
+	"context"
+	"ghost/agent/client"
+)
+
+// InventoryManager collects host information and inventory documents at the inventory interval, reporting changes to the controller
+// Returns when the context is cancelled
+func InventoryManager(ctx context.Context, client *client.Client) {
+	for {
+		if _, _, err := client.RefreshInventory(); err != nil {
+			client.Log.Error("Unable to refresh host inventory: %v", err)
+		}
+		if _, err := client.RefreshInventoryDocuments(); err != nil {
+			client.Log.Error("Unable to refresh inventory documents: %v", err)
+		}
+
+		if !client.Sleep(ctx, client.InventoryInterval()) {
+			client.Log.Debug("Inventory manager stopped")
+			return
+		}
+	}
+}
@@ -6,6 +6,8 @@ import (
 	"io"
 	"log"
 	"os"
+	"sync"
+	"time"
 
 	"gopkg.in/natefinch/lumberjack.v2"
 )
@@ -22,6 +24,10 @@ type Logger struct {
 	error      log.Logger
 	fatal      log.Logger
 	isInit     bool
+	levelMutex sync.RWMutex
+	lastMutex  sync.Mutex
+	lastError  string
+	lastTime   time.Time
 }
 
 //Initializes logger for first use
@@ -43,9 +49,11 @@ func (l *Logger) Init() {
 		l.MaxBackUps = 3
 	}
 
+	l.levelMutex.Lock()
 	if l.Level == "" {
 		l.Level = "DEBUG"
 	}
+	l.levelMutex.Unlock()
 
 	//set up the logging function
 	lj := lumberjack.Logger{
@@ -91,7 +99,7 @@ func (l *Logger) Debug(text string, args ...interface{}) {
 	if !l.isInit {
 		l.Init()
 	}
-	if l.Level == "DEBUG" {
+	if level := l.GetLevel(); level == "DEBUG" {
 		l.debug.Printf(text, args...)
 	}
 }
@@ -101,7 +109,7 @@ func (l *Logger) Info(text string, args ...interface{}) {
 	if !l.isInit {
 		l.Init()
 	}
-	if l.Level == "DEBUG" || l.Level == "INFO" {
+	if level := l.GetLevel(); level == "DEBUG" || level == "INFO" {
 		l.info.Printf(text, args...)
 	}
 }
@@ -111,7 +119,7 @@ func (l *Logger) Warn(text string, args ...interface{}) {
 	if !l.isInit {
 		l.Init()
 	}
-	if l.Level == "DEBUG" || l.Level == "INFO" || l.Level == "WARN" {
+	if level := l.GetLevel(); level == "DEBUG" || level == "INFO" || level == "WARN" {
 		l.warning.Printf(text, args...)
 	}
 }
@@ -122,7 +130,9 @@ func (l *Logger) Error(text string, args ...interface{}) {
 		l.Init()
 	}
 	//always show error messages
-	l.error.Printf(text, args...)
+	message := fmt.Sprintf(text, args...)
+	l.setLastError(message)
+	l.error.Printf("%s", message)
 }
 
 //Logs fatal error message and then exits
@@ -132,6 +142,36 @@ func (l *Logger) Fatal(text string, args ...interface{}) {
 	}
 	//always show error messages
 	message := fmt.Sprintf(text, args...)
+	l.setLastError(message)
 	l.fatal.Printf(message)
 	os.Exit(1)
 }
+
+//Sets the log level; safe to call while other goroutines are logging
+func (l *Logger) SetLevel(level string) {
+	l.levelMutex.Lock()
+	defer l.levelMutex.Unlock()
+	l.Level = level
+}
+
+//Returns the log level
+func (l *Logger) GetLevel() string {
+	l.levelMutex.RLock()
+	defer l.levelMutex.RUnlock()
+	return l.Level
+}
+
+//Returns the last error message logged and when it was logged (empty if none)
+func (l *Logger) LastError() (string, time.Time) {
+	l.lastMutex.Lock()
+	defer l.lastMutex.Unlock()
+	return l.lastError, l.lastTime
+}
+
+//Records the last error message for health reporting
+func (l *Logger) setLastError(message string) {
+	l.lastMutex.Lock()
+	defer l.lastMutex.Unlock()
+	l.lastError = message
+	l.lastTime = time.Now().UTC()
+}
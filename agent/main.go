@@ -3,12 +3,16 @@
 package main
 
 import (
+	"context"
 	"ghost/agent/client"
 	"ghost/agent/logger"
 	"io/ioutil"
 	"log"
 	"os"
+	"os/signal"
 	"path/filepath"
+	"sync"
+	"syscall"
 	"time"
 
 	"github.com/jessevdk/go-flags"
@@ -17,14 +21,33 @@ import (
 
 var version string
 
+// time allowed to deliver queued messages during shutdown
+const shutdownFlushTimeout = time.Second * 10
+
 func main() {
 	var err error
 
+	// run as supervisor of the agent process if requested
+	if len(os.Args) > 1 && os.Args[1] == "nanny" {
+		os.Exit(NannyMain(os.Args[2:]))
+	}
+
+	// export or import the agent identity if requested
+	if len(os.Args) > 1 && os.Args[1] == "identity" {
+		os.Exit(IdentityMain(os.Args[2:]))
+	}
+
+	// inspect, requeue or purge rejected messages if requested
+	if len(os.Args) > 1 && os.Args[1] == "deadletter" {
+		os.Exit(DeadLetterMain(os.Args[2:]))
+	}
+
 	// Parse commandline options
 	var opts struct {
-		Debug   bool `short:"d" long:"debug" description:"Debug mode (no file hash verification & offline mode)"`
-		Offline bool `short:"o" long:"offline" description:"Run offline while still verifying file hashes"`
-		Args    struct {
+		Debug      bool `short:"d" long:"debug" description:"Debug mode (no file hash verification & offline mode)"`
+		Offline    bool `short:"o" long:"offline" description:"Run offline while still verifying file hashes"`
+		RekeyStore bool `long:"rekey-store" description:"Re-encrypt the key store with a new key encryption key and exit (stop the agent first)"`
+		Args       struct {
 			ConfigFile string `description:"YAML formatted configuration file"`
 		} `positional-args:"yes" required:"yes"`
 	}
@@ -62,9 +85,29 @@ func main() {
 	// create logger
 	client.Log = logger.Logger{Filename: filepath.Join(client.InstallDir, "ghost.log")} //TODO: config file name
 
+	// key store maintenance
+	if opts.RekeyStore {
+		if err := client.RekeyStore(); err != nil {
+			client.Log.Fatal("Unable to rekey key store: %v", err)
+		}
+		os.Exit(0)
+	}
+
+	// create run context shared by all managers -- cancelling it shuts the agent down
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	client.Shutdown = cancel
+
+	// tracks running managers so shutdown can wait for them
+	var wg sync.WaitGroup
+
 	// start heartbeat
 	if !client.Debug && !opts.Offline {
-		go client.Heartbeat()
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			client.Heartbeat(ctx)
+		}()
 	}
 
 	// load client values
@@ -72,22 +115,84 @@ func main() {
 
 	// check for binary updates
 	if !client.Debug {
-		if !client.VerifyBinary() {
+		if !client.VerifyBinary(ctx) {
 			client.Log.Fatal("No suitable client binary found... want %s: have: %s", client.Config.BinaryHash, client.BinaryHash)
 		}
 	}
 
+	// shut down gracefully on SIGINT / SIGTERM
+	// registered after bootstrap so an agent stuck registering can still be stopped by the default handler
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+	go func() {
+		sig := <-signals
+		client.Log.Info("Received %v. Shutting down...", sig)
+		cancel()
+
+		// a second signal skips the graceful shutdown
+		sig = <-signals
+		client.Log.Error("Received %v during shutdown. Exiting now", sig)
+		os.Exit(1)
+	}()
+
+	// reload configuration file on SIGHUP
+	reloads := make(chan os.Signal, 1)
+	signal.Notify(reloads, syscall.SIGHUP)
+	go func() {
+		for range reloads {
+			client.Log.Info("Received SIGHUP. Reloading configuration...")
+			if err := client.ReloadConfig(); err != nil {
+				client.Log.Error("Unable to reload configuration: %v", err)
+			}
+		}
+	}()
+
 	// start client checkin and message managers
+	var messageWg sync.WaitGroup
 	if !client.Offline {
-		go CheckinManager(&client)
-		go MessageQueueManager(&client)
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			CheckinManager(ctx, &client)
+		}()
+
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			InventoryManager(ctx, &client)
+		}()
+
+		messageWg.Add(1)
+		go func() {
+			defer messageWg.Done()
+			MessageQueueManager(ctx, &client)
+		}()
 	}
 
 	// start plugin manager
-	go PluginManager(&client)
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		PluginManager(ctx, &client)
+	}()
+
+	// run until shut down
+	<-ctx.Done()
+
+	// wait for managers to stop -- the plugin manager releases running plugins first
+	wg.Wait()
+
+	// plugin tasks received after the plugin manager stopped are run again when the controller resends them
+	client.ReleasePluginTasks()
+
+	// deliver what is left in the message queue, including the final plugin status updates
+	messageWg.Wait()
+	if !client.Offline {
+		FlushMessageQueue(&client, shutdownFlushTimeout)
+	}
 
-	// loop forever
-	for {
-		time.Sleep(time.Minute * 1)
+	if err := client.LocalDb.Close(); err != nil {
+		client.Log.Error("Unable to close local database: %v", err)
 	}
+	client.Log.Info("Agent shut down")
 }
@@ -2,83 +2,226 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
 	"ghost/agent/client"
-	"strings"
+	"ghost/agent/comms"
 	"time"
 )
 
 // MessageQueueManager processes messages in the message queue - should run in its own go routine
-func MessageQueueManager(client *client.Client) {
-	// run forever
+// Returns when the context is cancelled. Remaining messages should be sent with FlushMessageQueue
+func MessageQueueManager(ctx context.Context, client *client.Client) {
+	// run until shut down
 	for {
+		sleep := client.GetPollTime()
 
-		// get a message from queue
-		messages, rowIds, err := client.LocalDb.MessageQueueSelectURI("/core/pluginlog/")
-		if err != nil {
-			client.Log.Error("Error reading message queue: %v", err)
-		}
+		// drop messages nobody is waiting for anymore
+		expireMessages(client)
 
-		// sleep if we have no messages
-		if len(messages) == 0 {
+		// sleep shorter if there are likely more messages waiting
+		full := false
+		var retryAfter time.Duration
+		for _, uri := range queuedURIs(client) {
+			n, err := sendMessageBatch(ctx, client, uri)
+			if n >= client.QueueBatchLimit(uri) {
+				full = true
+			}
+			if delay := comms.RetryAfter(err); delay > retryAfter {
+				retryAfter = delay
+			}
+		}
+		if full {
+			sleep = time.Second * 1
+		} else {
 			client.LocalDb.Vacuum() // clean up db
-			time.Sleep(client.PollTime)
-			continue
 		}
 
-		// create marshal message
-		msgBytes, err := json.Marshal(messages)
-		if err != nil {
-			client.Log.Error("Unable to marshal message: %v", err)
-			// remove messages
-			if n, err := client.LocalDb.MessageQueueDelete(rowIds); err != nil {
-				client.Log.Error("Unable to remove messages: %v", err)
-			} else {
-				client.Log.Debug("Removed %v messages from message_queue", n)
+		// wait as long as the controller asked if it is throttling the agent
+		if retryAfter > sleep {
+			sleep = retryAfter
+		}
+
+		if !client.Sleep(ctx, sleep) {
+			client.Log.Debug("Message queue manager stopped")
+			return
+		}
+	}
+}
+
+// FlushMessageQueue sends queued messages until the queue is empty, the controller
+// is unreachable or the timeout expires. Used during agent shutdown
+func FlushMessageQueue(client *client.Client, timeout time.Duration) {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	expireMessages(client)
+
+	total := 0
+	for _, uri := range queuedURIs(client) {
+		for {
+			n, err := sendMessageBatch(ctx, client, uri)
+			total += n
+			if err != nil || n == 0 {
+				break
 			}
-			time.Sleep(client.PollTime)
+		}
+	}
+	client.Log.Info("Flushed %v messages from message_queue", total)
+}
+
+// expireMessages removes queued messages whose time-to-live has passed
+func expireMessages(client *client.Client) {
+	n, err := client.LocalDb.MessageQueueExpire()
+	if err != nil {
+		client.Log.Error("Unable to remove expired messages: %v", err)
+	} else if n > 0 {
+		client.Log.Info("Removed %v expired messages from message_queue", n)
+	}
+}
+
+// queuedURIs returns the controller endpoints messages are waiting for
+// Every message is posted to the post_uri it was queued with. Messages for unknown or empty uris
+// (e.g. queued by other versions) can never be delivered and are removed
+func queuedURIs(agent *client.Client) []string {
+	uris, err := agent.LocalDb.MessageQueueURIs()
+	if err != nil {
+		agent.Log.Error("Error reading message queue: %v", err)
+	}
+
+	known := uris[:0]
+	for _, uri := range uris {
+		if client.IsQueueURI(uri) {
+			known = append(known, uri)
 			continue
 		}
+		n, err := agent.LocalDb.MessageQueueDeleteURI(uri)
+		if err != nil {
+			agent.Log.Error("Unable to remove messages for unknown uri %q: %v", uri, err)
+		} else {
+			agent.Log.Error("Removed %v messages queued for unknown uri %q", n, uri)
+		}
+	}
+	return known
+}
 
-		// send messages
-		_, err = client.Sender.Send(msgBytes, "/core/pluginlog/")
+// sendMessageBatch sends the oldest messages queued for uri to the controller, up to the uri's batch limit
+// Returns the number of messages removed from the queue and any error that stopped the batch from being delivered
+func sendMessageBatch(ctx context.Context, client *client.Client, uri string) (int, error) {
 
-		//handle possible errors
+	// get a message from queue
+	messages, rowIds, err := client.LocalDb.MessageQueueSelectURI(uri, client.QueueBatchLimit(uri))
+	if err != nil {
+		client.Log.Error("Error reading message queue: %v", err)
+		return 0, err
+	}
+
+	// nothing to do if we have no messages
+	if len(messages) == 0 {
+		return 0, nil
+	}
+
+	return deliverMessages(client, uri, messages, rowIds, func(batch []string) error {
+		msgBytes, err := json.Marshal(batch)
 		if err != nil {
+			return err
+		}
+		_, err = client.Sender.SendContext(ctx, msgBytes, uri)
+		return err
+	})
+}
 
-			// check for a bad status code
-			if strings.Contains(err.Error(), "500 Internal Server Error") || strings.Contains(err.Error(), "400 Bad Request") {
-				// remove the message if we get a bad status code
-				client.Log.Error("Received bad status code from server, %v. Removing message from queue", err.Error())
-				if n, err := client.LocalDb.MessageQueueDelete(rowIds); err != nil {
-					client.Log.Error("Unable to remove messages: %v", err)
-				} else {
-					client.Log.Debug("Removed %v messages from message_queue", n)
-				}
-
-			} else {
-				// some other error occured (network related), let's just wait and try again
-				client.Log.Debug("Controller unreachable: %v", err)
-			}
+// deliverMessages sends messages to the controller with send and removes them from the queue once delivered
+// A batch the controller rejects is split until the rejected messages are isolated. These are moved to the dead_letter
+// table, so a message the controller never accepts cannot hold up the messages queued after it
+// Returns the number of messages removed from the queue and any error that stopped delivery
+func deliverMessages(client *client.Client, uri string, messages []string, rowIds []int, send func(batch []string) error) (int, error) {
+	delivered, rejected, err := bisectBatch(messages, send)
 
-		} else {
-			// everything is good. Let's remove the messages from the local database
-			client.Log.Debug("Successfully sent %v messages to controller", len(messages))
-			if n, err := client.LocalDb.MessageQueueDelete(rowIds); err != nil {
-				client.Log.Error("Unable to remove messages: %v", err)
-			} else {
-				client.Log.Debug("Removed %v messages from message_queue", n)
+	// remove what the controller accepted
+	removed := 0
+	if len(delivered) > 0 {
+		deliveredIds := make([]int, len(delivered))
+		for i, index := range delivered {
+			deliveredIds[i] = rowIds[index]
+		}
+		client.Log.Debug("Successfully sent %v messages to controller", len(delivered))
+		removed = removeMessages(client, deliveredIds)
+	}
+
+	for _, rejection := range rejected {
+		rowID := rowIds[rejection.index]
+		client.Log.Error("Controller rejected message %v for %s, %v. Moving message to dead_letter", rowID, uri, rejection.err)
+		reason := rejection.err.Error()
+		if rejection.err.Body != "" {
+			reason += ": " + rejection.err.Body
+		}
+		if err := client.LocalDb.MessageQueueDeadLetter(rowID, reason, rejection.err.StatusCode, client.DeadLetterSize()); err != nil {
+			client.Log.Error("Unable to move message to dead_letter: %v", err)
+			return removed, err
+		}
+		removed++
+	}
+
+	if err != nil {
+		// some other error occured (network related, throttling, authentication or an unavailable controller), let's just wait and try again
+		client.Log.Debug("Unable to deliver messages to %s, keeping them queued: %v", uri, err)
+	}
+	return removed, err
+}
+
+// rejection is a message the controller refused on its own
+type rejection struct {
+	index int // index of the message in the batch
+	err   *comms.StatusError
+}
+
+// bisectBatch sends messages as one batch, splitting batches the controller rejects in halves
+// until the rejected messages are isolated
+// Returns the indexes of the delivered messages and the rejected messages, in order, and the first error
+// that is not a rejection (delivery stops there)
+func bisectBatch(messages []string, send func(batch []string) error) (delivered []int, rejected []rejection, err error) {
+	var deliver func(start, end int) error
+	deliver = func(start, end int) error {
+		err := send(messages[start:end])
+		if err == nil {
+			for i := start; i < end; i++ {
+				delivered = append(delivered, i)
 			}
+			return nil
 		}
 
-		// sleep longer messages are less than 100
-		if len(messages) >= 100 {
-			time.Sleep(time.Second * 1)
-			continue
-		} else {
-			client.LocalDb.Vacuum() // clean up db
-			time.Sleep(client.PollTime)
+		// only content the controller refused is worth splitting up
+		var statusErr *comms.StatusError
+		if !errors.As(err, &statusErr) || !statusErr.Rejected() {
+			return err
 		}
+		if end-start == 1 {
+			rejected = append(rejected, rejection{index: start, err: statusErr})
+			return nil
+		}
+
+		middle := start + (end-start)/2
+		if err := deliver(start, middle); err != nil {
+			return err
+		}
+		return deliver(middle, end)
+	}
+
+	if len(messages) > 0 {
+		err = deliver(0, len(messages))
+	}
+	return delivered, rejected, err
+}
 
+// removeMessages deletes messages from the queue, logging the result
+func removeMessages(client *client.Client, rowIds []int) int {
+	n, err := client.LocalDb.MessageQueueDelete(rowIds)
+	if err != nil {
+		client.Log.Error("Unable to remove messages: %v", err)
+	} else {
+		client.Log.Debug("Removed %v messages from message_queue", n)
 	}
+	return n
 }
@@ -0,0 +1,189 @@
+package main
+
+import (
+	"errors"
+	"ghost/agent/client"
+	"ghost/agent/comms"
+	"ghost/agent/logger"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// fakeSend returns a send function that refuses batches containing a message starting with "bad" with status
+// and fails every batch with failure (if set). Sent batches are recorded in sent
+func fakeSend(status int, failure error, sent *[][]string) func(batch []string) error {
+	return func(batch []string) error {
+		*sent = append(*sent, batch)
+		if failure != nil {
+			return failure
+		}
+		for _, message := range batch {
+			if strings.HasPrefix(message, "bad") {
+				return &comms.StatusError{StatusCode: status}
+			}
+		}
+		return nil
+	}
+}
+
+func TestBisectBatch(t *testing.T) {
+	networkErr := &comms.NetworkError{URL: "https://controller/core/message/", Err: errors.New("connection refused")}
+
+	tests := []struct {
+		name      string
+		messages  []string
+		status    int
+		failure   error
+		delivered []int
+		rejected  []int
+		sends     int
+		wantErr   bool
+	}{
+		{"empty", nil, 400, nil, nil, nil, 0, false},
+		{"all delivered", []string{"a", "b", "c", "d"}, 400, nil, []int{0, 1, 2, 3}, nil, 1, false},
+		{"one bad among eight", []string{"a", "b", "c", "d", "e", "bad", "g", "h"}, 422, nil, []int{0, 1, 2, 3, 4, 6, 7}, []int{5}, 7, false},
+		{"too large", []string{"a", "bad"}, 413, nil, []int{0}, []int{1}, 3, false},
+		{"all rejected", []string{"bad1", "bad2", "bad3"}, 400, nil, nil, []int{0, 1, 2}, 5, false},
+		{"not found is not split", []string{"a", "bad"}, 404, nil, nil, nil, 1, true},
+		{"server error", []string{"a", "bad"}, 500, nil, []int{0}, []int{1}, 3, false},
+		{"not implemented", []string{"a", "bad"}, 501, nil, []int{0}, []int{1}, 3, false},
+		{"bad gateway is not split", []string{"a", "bad"}, 502, nil, nil, nil, 1, true},
+		{"unavailable is not split", []string{"a", "bad"}, 503, nil, nil, nil, 1, true},
+		{"gateway timeout is not split", []string{"a", "bad"}, 504, nil, nil, nil, 1, true},
+		{"unauthorized is not split", []string{"a", "bad"}, 401, nil, nil, nil, 1, true},
+		{"network error", []string{"a", "b"}, 400, networkErr, nil, nil, 1, true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var sent [][]string
+			delivered, rejected, err := bisectBatch(test.messages, fakeSend(test.status, test.failure, &sent))
+
+			if (err != nil) != test.wantErr {
+				t.Fatalf("error = %v, want error %v", err, test.wantErr)
+			}
+			if !reflect.DeepEqual(delivered, test.delivered) {
+				t.Errorf("delivered = %v, want %v", delivered, test.delivered)
+			}
+			var rejectedIndexes []int
+			for _, r := range rejected {
+				if r.err.StatusCode != test.status {
+					t.Errorf("rejection of %v has status %v, want %v", r.index, r.err.StatusCode, test.status)
+				}
+				rejectedIndexes = append(rejectedIndexes, r.index)
+			}
+			if !reflect.DeepEqual(rejectedIndexes, test.rejected) {
+				t.Errorf("rejected = %v, want %v", rejectedIndexes, test.rejected)
+			}
+			if len(sent) != test.sends {
+				t.Errorf("sent %v requests (%v), want %v", len(sent), sent, test.sends)
+			}
+		})
+	}
+}
+
+func TestBisectBatchStopsAtFirstFailure(t *testing.T) {
+	// the right half fails with a server error after the left half was delivered
+	messages := []string{"a", "bad", "c", "d"}
+	var sent [][]string
+	send := func(batch []string) error {
+		sent = append(sent, batch)
+		switch {
+		case len(batch) == 1 && batch[0] == "bad":
+			return &comms.StatusError{StatusCode: 400}
+		case batch[0] == "c":
+			return &comms.StatusError{StatusCode: 503}
+		case len(batch) > 1 && batch[1] == "bad":
+			return &comms.StatusError{StatusCode: 400}
+		case len(batch) == 4:
+			return &comms.StatusError{StatusCode: 400}
+		}
+		return nil
+	}
+
+	delivered, rejected, err := bisectBatch(messages, send)
+
+	var statusErr *comms.StatusError
+	if !errors.As(err, &statusErr) || statusErr.StatusCode != 503 {
+		t.Fatalf("error = %v, want 503 status error", err)
+	}
+	if !reflect.DeepEqual(delivered, []int{0}) {
+		t.Errorf("delivered = %v, want [0]", delivered)
+	}
+	if len(rejected) != 1 || rejected[0].index != 1 {
+		t.Errorf("rejected = %+v, want index 1", rejected)
+	}
+}
+
+func TestDeliverMessages(t *testing.T) {
+	tests := []struct {
+		name       string
+		messages   []string
+		status     int
+		removed    int
+		queued     []string
+		deadLetter []string
+		wantErr    bool
+	}{
+		{"all delivered", []string{"a", "b"}, 400, 2, nil, nil, false},
+		{"one rejected", []string{"a", "bad", "c"}, 400, 3, nil, []string{"bad"}, false},
+		{"all rejected", []string{"bad1", "bad2", "bad3"}, 400, 3, nil, []string{"bad1", "bad2", "bad3"}, false},
+		{"server error", []string{"bad1", "bad2"}, 500, 2, nil, []string{"bad1", "bad2"}, false},
+		{"unavailable", []string{"a", "bad"}, 503, 0, []string{"a", "bad"}, nil, true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			installDir := t.TempDir()
+			agent := &client.Client{
+				LocalDb: client.Database{Name: filepath.Join(installDir, "ghost.db")},
+				Log:     logger.Logger{Filename: filepath.Join(installDir, "test.log"), Level: "ERROR"},
+			}
+			if err := agent.LocalDb.Init(); err != nil {
+				t.Fatal(err)
+			}
+			defer agent.LocalDb.Close()
+
+			for _, message := range test.messages {
+				if err := agent.LocalDb.MessageQueueInsert(message, client.InventoryURI); err != nil {
+					t.Fatal(err)
+				}
+			}
+			messages, rowIds, err := agent.LocalDb.MessageQueueSelectURI(client.InventoryURI, 10)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			var sent [][]string
+			removed, err := deliverMessages(agent, client.InventoryURI, messages, rowIds, fakeSend(test.status, nil, &sent))
+			if (err != nil) != test.wantErr {
+				t.Fatalf("error = %v, want error %v", err, test.wantErr)
+			}
+			if removed != test.removed {
+				t.Errorf("removed %v messages, want %v", removed, test.removed)
+			}
+
+			queued, _, err := agent.LocalDb.MessageQueueSelectURI(client.InventoryURI, 10)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(queued, test.queued) {
+				t.Errorf("queued = %v, want %v", queued, test.queued)
+			}
+
+			letters, err := agent.LocalDb.DeadLetterSelect(nil, "")
+			if err != nil {
+				t.Fatal(err)
+			}
+			var deadLetter []string
+			for _, letter := range letters {
+				deadLetter = append(deadLetter, letter.PostString)
+			}
+			if !reflect.DeepEqual(deadLetter, test.deadLetter) {
+				t.Errorf("dead letters = %v, want %v", deadLetter, test.deadLetter)
+			}
+		})
+	}
+}
@@ -0,0 +1,335 @@
+// Nanny mode -- supervises the agent as a child process
+package main
+
+import (
+	"ghost/agent/client"
+	"ghost/agent/logger"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"os/signal"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/jessevdk/go-flags"
+)
+
+// an agent that runs at least this long is considered stable and is restarted without delay
+const nannyStableUptime = time.Minute * 2
+
+// time allowed for the agent to shut down gracefully before it is killed
+const nannyStopTimeout = time.Second * 30
+
+// how often the heartbeat file is checked
+const nannyCheckInterval = time.Second * 5
+
+// Nanny struct stores the state of the agent supervisor
+type Nanny struct {
+	BinaryPath       string        // agent binary; <BinaryPath>.new is swapped in before each start
+	ConfigPath       string        // configuration file passed to the agent
+	InstallDir       string        // directory containing the heartbeat file
+	HeartbeatTimeout time.Duration // the agent is restarted if the heartbeat is older than this
+	MaxBackoff       time.Duration // upper limit of the delay between restarts of a crashing agent
+	HealthWindow     time.Duration // time a new binary has to become healthy before it is rolled back
+	LocalDb          client.Database
+	Log              logger.Logger
+	failures         int // consecutive runs shorter than nannyStableUptime
+}
+
+// NannyMain parses nanny mode options and runs the supervisor until it receives SIGINT / SIGTERM
+// INPUT: args ([]string), command line arguments following "nanny"
+// OUTPUT: process exit code
+func NannyMain(args []string) int {
+	var opts struct {
+		HeartbeatTimeout int `long:"heartbeat-timeout" default:"60" description:"Seconds without a heartbeat before the agent is restarted"`
+		MaxBackoff       int `long:"max-backoff" default:"300" description:"Maximum seconds to wait between restarts of a crashing agent"`
+		HealthWindow     int `long:"health-window" default:"300" description:"Seconds a new agent binary has to become healthy before it is rolled back"`
+		Args             struct {
+			ConfigFile string `description:"YAML formatted configuration file"`
+		} `positional-args:"yes" required:"yes"`
+	}
+
+	parser := flags.NewParser(&opts, flags.Default)
+	parser.Usage = "nanny [OPTIONS]"
+	if _, err := parser.ParseArgs(args); err != nil {
+		return 1
+	}
+
+	// the nanny runs from the same binary and install directory as the agent
+	binaryPath, err := filepath.Abs(os.Args[0])
+	if err != nil {
+		return 1
+	}
+	configPath, err := filepath.Abs(opts.Args.ConfigFile)
+	if err != nil {
+		return 1
+	}
+
+	nanny := Nanny{
+		BinaryPath:       binaryPath,
+		ConfigPath:       configPath,
+		InstallDir:       filepath.Dir(binaryPath),
+		HeartbeatTimeout: time.Second * time.Duration(opts.HeartbeatTimeout),
+		MaxBackoff:       time.Second * time.Duration(opts.MaxBackoff),
+		HealthWindow:     time.Second * time.Duration(opts.HealthWindow),
+	}
+	nanny.Log = logger.Logger{Filename: filepath.Join(nanny.InstallDir, "nanny.log"), Level: "INFO"}
+
+	// update tracking is shared with the agent through its local database
+	nanny.LocalDb = client.Database{Name: filepath.Join(nanny.InstallDir, "ghost.db")}
+	if err := nanny.LocalDb.Init(); err != nil {
+		nanny.Log.Error("Unable to open local database: %v", err)
+		return 1
+	}
+	defer nanny.LocalDb.Close()
+
+	return nanny.Run()
+}
+
+// Run starts the agent and restarts it whenever it exits or its heartbeat goes stale
+// Returns the process exit code once the nanny is asked to stop
+func (n *Nanny) Run() int {
+	n.Log.Info("Nanny starting. Supervising %s %s", n.BinaryPath, n.ConfigPath)
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM, syscall.SIGHUP)
+
+	for {
+		// restore files from updates that never became healthy
+		n.rollbackExpired()
+
+		// swap in any binary update left by the agent
+		if err := n.SwapBinary(); err != nil {
+			n.Log.Error("Unable to swap in new agent binary: %v", err)
+		}
+
+		// start agent
+		cmd := exec.Command(n.BinaryPath, n.ConfigPath)
+		cmd.Dir = n.InstallDir
+		cmd.Stdout = ioutil.Discard // the agent keeps its own log file
+		cmd.Stderr = os.Stderr
+		started := time.Now()
+		if err := cmd.Start(); err != nil {
+			n.Log.Error("Unable to start agent: %v", err)
+		} else {
+			n.Log.Info("Agent started with PID %v", cmd.Process.Pid)
+			if stop := n.supervise(cmd, started, signals); stop {
+				n.Log.Info("Nanny shut down")
+				return 0
+			}
+		}
+
+		// restart immediately after a stable run, otherwise back off
+		delay := n.backoff(time.Since(started))
+		if delay > 0 {
+			n.Log.Info("Agent ran for %v. Restarting in %v", time.Since(started).Round(time.Second), delay)
+		}
+
+		if !n.wait(delay, signals) {
+			n.Log.Info("Nanny shut down")
+			return 0
+		}
+	}
+}
+
+// wait pauses for the given delay
+// Returns false if the nanny was asked to stop in the meantime
+func (n *Nanny) wait(delay time.Duration, signals chan os.Signal) bool {
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+
+	for {
+		select {
+		case sig := <-signals:
+			// nothing to reload while the agent is down
+			if sig != syscall.SIGHUP {
+				n.Log.Info("Received %v", sig)
+				return false
+			}
+		case <-timer.C:
+			return true
+		}
+	}
+}
+
+// supervise waits for the agent to exit, killing it if its heartbeat goes stale
+// or an update it is running misses its health deadline
+// Returns true if the nanny was asked to stop
+func (n *Nanny) supervise(cmd *exec.Cmd, started time.Time, signals chan os.Signal) bool {
+	exited := make(chan error, 1)
+	go func() { exited <- cmd.Wait() }()
+
+	ticker := time.NewTicker(nannyCheckInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case err := <-exited:
+			if err != nil {
+				n.Log.Error("Agent exited: %v", err)
+			} else {
+				n.Log.Info("Agent exited")
+			}
+			return false
+
+		case sig := <-signals:
+			// pass reload requests on to the agent
+			if sig == syscall.SIGHUP {
+				cmd.Process.Signal(syscall.SIGHUP)
+				continue
+			}
+			n.Log.Info("Received %v. Stopping agent...", sig)
+			n.stopAgent(cmd, exited)
+			return true
+
+		case <-ticker.C:
+			if age := n.heartbeatAge(started); age > n.HeartbeatTimeout {
+				n.Log.Error("Agent heartbeat is stale (%v old). Restarting agent...", age.Round(time.Second))
+				n.stopAgent(cmd, exited)
+				return false
+			}
+			if n.expiredUpdate() {
+				n.Log.Error("Agent update did not become healthy in time. Restarting agent to roll back...")
+				n.stopAgent(cmd, exited)
+				return false
+			}
+		}
+	}
+}
+
+// stopAgent asks the agent to shut down gracefully and kills it if it does not exit in time
+func (n *Nanny) stopAgent(cmd *exec.Cmd, exited chan error) {
+	// not supported on Windows -- fall through to kill
+	if err := cmd.Process.Signal(syscall.SIGTERM); err == nil {
+		select {
+		case <-exited:
+			return
+		case <-time.After(nannyStopTimeout):
+			n.Log.Error("Agent did not shut down within %v", nannyStopTimeout)
+		}
+	}
+
+	cmd.Process.Kill()
+	<-exited
+}
+
+// heartbeatAge returns the time since the agent last wrote its heartbeat file
+// Heartbeats older than the agent's start time are ignored so a new agent gets the full timeout to start up
+func (n *Nanny) heartbeatAge(started time.Time) time.Duration {
+	last := started
+
+	raw, err := ioutil.ReadFile(filepath.Join(n.InstallDir, "heartbeat"))
+	if err == nil {
+		if nanos, err := strconv.ParseInt(strings.TrimSpace(string(raw)), 10, 64); err == nil {
+			if beat := time.Unix(0, nanos); beat.After(last) {
+				last = beat
+			}
+		}
+	}
+
+	return time.Since(last)
+}
+
+// backoff returns how long to wait before restarting an agent that ran for uptime
+// The delay doubles with each consecutive short run up to MaxBackoff
+func (n *Nanny) backoff(uptime time.Duration) time.Duration {
+	if uptime >= nannyStableUptime {
+		n.failures = 0
+		return 0
+	}
+
+	n.failures++
+	delay := time.Second
+	for i := 1; i < n.failures && delay < n.MaxBackoff; i++ {
+		delay *= 2
+	}
+	if delay > n.MaxBackoff {
+		delay = n.MaxBackoff
+	}
+	return delay
+}
+
+// expiredUpdate reports whether a pending update has passed its health deadline
+func (n *Nanny) expiredUpdate() bool {
+	updates, err := n.LocalDb.PendingUpdates()
+	if err != nil {
+		return false
+	}
+	for _, update := range updates {
+		if time.Now().After(update.Deadline) {
+			return true
+		}
+	}
+	return false
+}
+
+// rollbackExpired restores the last known good files of pending updates that passed their health deadline
+// Must only be called while the agent is stopped
+func (n *Nanny) rollbackExpired() {
+	updates, err := n.LocalDb.PendingUpdates()
+	if err != nil {
+		n.Log.Error("Unable to read pending updates: %v", err)
+		return
+	}
+
+	for _, update := range updates {
+		if !time.Now().After(update.Deadline) {
+			continue
+		}
+
+		n.Log.Error("Rolling back %v. Not healthy by %v", update, update.Deadline.Local().Format(time.RFC3339))
+		reason := "not healthy within " + update.Deadline.Sub(update.Started).String()
+		if err := n.LocalDb.RollbackUpdate(update, reason); err != nil {
+			n.Log.Error("Unable to roll back %v: %v", update, err)
+			continue
+		}
+		n.Log.Info("Restored %s from %s", update.Path, update.BackupPath)
+
+		// a restored binary must not be replaced by a leftover download of the failed one
+		if update.Kind == client.UpdateBinary {
+			os.Remove(n.BinaryPath + ".new")
+		}
+	}
+}
+
+// SwapBinary replaces the agent binary with <BinaryPath>.new if one has been downloaded
+// The update is recorded as pending so it is rolled back if the new agent does not become healthy.
+// The last known good binary is kept as <BinaryPath>.bak
+func (n *Nanny) SwapBinary() error {
+	newPath := n.BinaryPath + ".new"
+	if _, err := os.Stat(newPath); os.IsNotExist(err) {
+		return nil
+	}
+
+	n.Log.Info("New agent binary found. Swapping %s into place...", newPath)
+
+	newHash, err := client.FileSHA256(newPath)
+	if err != nil {
+		return err
+	}
+
+	// back up the current binary and start the health window
+	if err := n.LocalDb.BeginUpdate(client.UpdateBinary, n.BinaryPath, newHash, n.HealthWindow); err != nil {
+		return err
+	}
+
+	// move the new binary into place
+	if err := os.Rename(newPath, n.BinaryPath); err != nil {
+		// Windows will not replace a binary that is in use (e.g. by this nanny) but allows it to be renamed
+		oldPath := n.BinaryPath + ".old"
+		os.Remove(oldPath)
+		if err := os.Rename(n.BinaryPath, oldPath); err != nil {
+			return err
+		}
+		if err := os.Rename(newPath, n.BinaryPath); err != nil {
+			os.Rename(oldPath, n.BinaryPath)
+			return err
+		}
+	}
+
+	n.Log.Info("Agent binary updated to %s. Last known good binary saved to %s", newHash, n.BinaryPath+".bak")
+	return nil
+}
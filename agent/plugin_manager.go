@@ -2,22 +2,59 @@
 package main
 
 import (
+	"context"
+	"errors"
 	"ghost/agent/client"
 	"os"
+	"sync"
 	"time"
-
-	ps "github.com/mitchellh/go-ps"
 )
 
+// how often unused resource files are removed from the blob store
+const blobCollectInterval = time.Hour
+
+// pluginDefinitions maps plugin UUIDs to the plugin definitions last seen by the plugin manager
+type pluginDefinitions map[string]client.Plugin
+
+// pluginRunRequests maps plugin UUIDs to run_plugin tasks waiting for the plugin to be launched
+type pluginRunRequests map[string]client.Task
+
 // PluginManager enforces plugin execution policy
-func PluginManager(client *client.Client) {
+// Plugins are read from the active configuration on every pass so configuration reloads are applied in place:
+// new plugins are launched, removed plugins are killed and running plugins whose definition changed are restarted.
+// Returns when the context is cancelled, after every managed plugin has been released
+func PluginManager(ctx context.Context, client *client.Client) {
 	//this will help us determine if an already running plugin is currently managed, or was managed by a previously running instance
 	currentManager := os.Getpid()
 
-	// loop forever checking on plugins
+	// tracks launch and resume goroutines so shutdown can wait for them to release their plugins
+	var wg sync.WaitGroup
+
+	// plugin definitions seen on the previous pass, used to detect configuration changes
+	known := make(pluginDefinitions)
+
+	// closed when the goroutine that launched a plugin has recorded its exit
+	launched := make(map[string]chan struct{})
+
+	// last blob store garbage collection
+	var lastCollect time.Time
+
+	// run_plugin tasks waiting for their plugin to be launched
+	runNow := make(pluginRunRequests)
+
+	// loop until shut down checking on plugins
 	for {
+		config := client.GetConfig()
+
+		// take plugin tasks queued by the controller
+		takePluginTasks(client, config, runNow, launched)
+
 		// process each plugin in the configuration
-		for _, plugin := range client.Config.Plugins {
+		for _, plugin := range config.Plugins {
+			// don't start anything new once shutting down
+			if ctx.Err() != nil {
+				break
+			}
 
 			// get stored plugin history from database
 			p, err := client.LocalDb.PluginSelectUUID(plugin.UUID)
@@ -34,8 +71,37 @@ func PluginManager(client *client.Client) {
 			//flag for resuming plugin management
 			resumeManaging := false
 
+			// restart running plugins whose configuration changed
+			// plugins that are not running pick up the new definition on their next launch
+			previous, seen := known[plugin.UUID]
+			known[plugin.UUID] = plugin
+			if seen && !previous.SameDefinition(plugin) {
+				if isRunning, err := plugin.IsRunning(client); err != nil {
+					client.Log.Error("%v", err)
+					continue
+				} else if isRunning {
+					client.Log.Info("Configuration of plugin %v(%v) changed. Restarting...", plugin.Name, plugin.UUID)
+					stopPlugin(client, plugin, launched[plugin.UUID])
+					launchPlugin = true
+				}
+			}
+
+			// run now if the controller asked for it
+			runTask, runRequested := runNow[plugin.UUID]
+			delete(runNow, plugin.UUID)
+			if runRequested && !launchPlugin {
+				if isRunning, err := plugin.IsRunning(client); err != nil {
+					client.CompleteTask(runTask, nil, err)
+					continue
+				} else if isRunning {
+					client.CompleteTask(runTask, map[string]string{"result": "already running"}, nil)
+				} else {
+					launchPlugin = true
+				}
+			}
+
 			// process oneshot plugins
-			if plugin.Mode == "oneshot" {
+			if plugin.Mode == "oneshot" && !launchPlugin {
 
 				// check plugin status
 				if p.Status == "" {
@@ -46,14 +112,14 @@ func PluginManager(client *client.Client) {
 					// if errored, check for retry flag
 					if plugin.RetryFailure {
 						launchPlugin = true
-					} else {
+					} else if !launchPlugin {
 						continue
 					}
 				}
 			}
 
 			// process persistent plugins
-			if plugin.Mode == "persistent" {
+			if plugin.Mode == "persistent" && !launchPlugin {
 				if isRunning, err := plugin.IsRunning(client); err != nil {
 					client.Log.Error("%v", err)
 					continue
@@ -65,7 +131,7 @@ func PluginManager(client *client.Client) {
 			}
 
 			// process periodic plugins
-			if plugin.Mode == "periodic" {
+			if plugin.Mode == "periodic" && !launchPlugin {
 
 				// check if pocess is running
 				if isRunning, err := plugin.IsRunning(client); err != nil {
@@ -87,62 +153,162 @@ func PluginManager(client *client.Client) {
 				//launch plugin in new goroutine
 				client.Log.Info("Launching plugin %v(%v)", plugin.Name, plugin.UUID)
 				ch := make(chan int, 1)
-				go plugin.LaunchBinary(ch, client, currentManager)
+				done := make(chan struct{})
+				launched[plugin.UUID] = done
+				plugin := plugin
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+					defer close(done)
+					plugin.LaunchBinary(ctx, ch, client, currentManager)
+				}()
 				<-ch // block until process has been launched
+
+				if runRequested {
+					client.CompleteTask(runTask, map[string]string{"result": "launched"}, nil)
+				}
 			} else if resumeManaging {
 				//new go routine will find plugin PID and resume throttling it
 				client.Log.Info("Resuming plugin throttling for %v(%v)", plugin.Name, plugin.UUID)
 				ch := make(chan int, 1)
-				go plugin.ResumePlugin(ch, client, currentManager)
+				plugin := plugin
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+					plugin.ResumePlugin(ctx, ch, client, currentManager)
+				}()
 				<-ch // block until process has been properly resumed
 			}
+		}
 
-			// Remove running plugins not found in current config
-			// Get all running plugins from local database
-			runningPlugins, err := client.LocalDb.PluginSelectStatus("running")
-			if err != nil {
-				client.Log.Error("unable to read keystore: %v", err)
-				continue
-			}
+		// Remove running plugins not found in current config
+		// Get all running plugins from local database
+		runningPlugins, err := client.LocalDb.PluginSelectStatus("running")
+		if err != nil {
+			client.Log.Error("unable to read keystore: %v", err)
+		}
 
-			// Check if UUIDs are present in current configuration
-			for _, runningPlugin := range runningPlugins {
-				found := false
-				for _, plugin := range client.Config.Plugins {
-					if plugin.UUID == runningPlugin.UUID {
-						found = true
-					}
+		// Check if UUIDs are present in current configuration
+		for _, runningPlugin := range runningPlugins {
+			found := false
+			for _, plugin := range config.Plugins {
+				if plugin.UUID == runningPlugin.UUID {
+					found = true
 				}
+			}
 
-				// remove unfound plugins
-				if !found {
-					// Kill any running processes
-					if runningPlugin.ProcessID != 0 {
-						// get process
-						proc, _ := ps.FindProcess(p.ProcessID)
-						// if a process was returned ... kill it
-						if proc != nil {
-							// but only if process name matches the one stored in the database
-							if proc.Executable() == p.ProcessName {
-								// get real process using the os package
-								if process, err := os.FindProcess(proc.Pid()); err == nil {
-									// kill it -- errors are ignored
-									process.Kill()
-								}
-							}
-						}
-					}
+			// remove unfound plugins
+			if !found && ctx.Err() == nil {
+				client.Log.Info("Plugin %v(%v) removed from configuration. Stopping...", runningPlugin.Name, runningPlugin.UUID)
 
-					// Update status
-					runningPlugin.Status = "complete"
-					runningPlugin.StatusMessage = "removed from configuration"
-					client.LocalDb.PluginInsert(runningPlugin)
-					continue
-				}
+				// Kill any running processes
+				stopPlugin(client, runningPlugin, launched[runningPlugin.UUID])
+				delete(known, runningPlugin.UUID)
+
+				// Update status
+				runningPlugin.Status = "complete"
+				runningPlugin.StatusMessage = "removed from configuration"
+				client.LocalDb.PluginInsert(runningPlugin)
+			}
+		}
+
+		// forget launch goroutines that have finished
+		for uuid, done := range launched {
+			select {
+			case <-done:
+				delete(launched, uuid)
+			default:
+			}
+		}
+
+		// clean up the blob store
+		if time.Since(lastCollect) > blobCollectInterval && ctx.Err() == nil {
+			lastCollect = time.Now()
+			if err := client.CollectBlobs(); err != nil {
+				client.Log.Error("Unable to clean up blob store: %v", err)
 			}
 		}
 
 		// sleep
-		time.Sleep(time.Second * 3)
+		if !client.Sleep(ctx, time.Second*3) {
+			client.Log.Info("Plugin manager stopping. Releasing managed plugins...")
+			wg.Wait()
+
+			// run_plugin tasks that were not launched are run again when the controller resends them
+			for _, task := range runNow {
+				client.ReleaseTask(task)
+			}
+			client.Log.Debug("Plugin manager stopped")
+			return
+		}
+	}
+}
+
+// takePluginTasks takes the plugin tasks queued by the controller without blocking
+// Kill tasks are run straight away; run tasks are added to runNow for the current pass
+func takePluginTasks(client *client.Client, config client.Config, runNow pluginRunRequests, launched map[string]chan struct{}) {
+	for {
+		select {
+		case task := <-client.PluginTasks:
+			takePluginTask(client, config, task, runNow, launched)
+		default:
+			return
+		}
+	}
+}
+
+// takePluginTask runs a kill_plugin task or adds a run_plugin task to runNow
+func takePluginTask(client *client.Client, config client.Config, task client.Task, runNow pluginRunRequests, launched map[string]chan struct{}) {
+	// find the plugin in the active configuration
+	index := -1
+	for i, plugin := range config.Plugins {
+		if plugin.UUID == task.Args["plugin_uuid"] {
+			index = i
+		}
+	}
+	if index < 0 {
+		client.CompleteTask(task, nil, errors.New("plugin "+task.Args["plugin_uuid"]+" is not in the configuration"))
+		return
+	}
+	plugin := config.Plugins[index]
+
+	if !task.StopsPlugin() {
+		runNow[plugin.UUID] = task
+		return
+	}
+
+	if isRunning, err := plugin.IsRunning(client); err != nil {
+		client.CompleteTask(task, nil, err)
+		return
+	} else if !isRunning {
+		client.CompleteTask(task, map[string]string{"result": "not running"}, nil)
+		return
+	}
+	client.Log.Info("Stopping plugin %v(%v) as requested by the controller", plugin.Name, plugin.UUID)
+	stopPlugin(client, plugin, launched[plugin.UUID])
+
+	// persistent plugins are launched again on the next pass
+	result := "killed"
+	if plugin.Mode == "persistent" {
+		result = "restarted"
+	}
+	client.CompleteTask(task, map[string]string{"result": result}, nil)
+}
+
+// stopPlugin kills a plugin's process and waits for the goroutine that launched it (if any)
+// to record the exit, so its status update cannot overwrite a relaunch
+func stopPlugin(client *client.Client, plugin client.Plugin, launched chan struct{}) {
+	if err := plugin.Kill(client); err != nil {
+		client.Log.Error("Unable to stop plugin %v(%v): %v", plugin.Name, plugin.UUID, err)
+	}
+
+	if launched == nil {
+		return
+	}
+
+	select {
+	case <-launched:
+	case <-time.After(time.Second * 10):
+		client.Log.Error("Timed out waiting for plugin %v(%v) to exit", plugin.Name, plugin.UUID)
 	}
 }